@@ -0,0 +1,572 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type command struct {
+	Name  string
+	Args  string // what follows the options in the usage line
+	Help  string
+	Flags func(fs *flag.FlagSet) // options on top of the global ones
+	Run   func(args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			Name:  "upload",
+			Args:  "file1.gcode file2.nc ...",
+			Help:  "Upload files to the printer.",
+			Flags: uploadFileFlags,
+			Run:   runUpload,
+		},
+		{
+			Name:  "print",
+			Args:  "file.gcode | start <file on printer> | pause | resume | stop",
+			Help:  "Upload a file and start printing it, or control the active job.",
+			Flags: uploadFlags,
+			Run:   runPrint,
+		},
+		{
+			Name:  "watch",
+			Args:  "dir[=host] ...",
+			Help:  "Upload files that show up in the directories, each directory may go to its own printer.",
+			Flags: watchFlags,
+			Run:   runWatch,
+		},
+		{
+			Name:  "queue",
+			Args:  "add file ... | list | priority <id> <n> | cancel <id> ... | run",
+			Help:  "Queue jobs for the first idle printer that matches them, and run the queue.",
+			Flags: queueFlags,
+			Run:   runQueue,
+		},
+		{
+			Name:  "history",
+			Help:  "List or export the uploads, -host picks printers or groups.",
+			Flags: historyFlags,
+			Run:   runHistory,
+		},
+		{
+			Name: "discover",
+			Help: "Look for printers on the local network and remember them in the known hosts.",
+			Run:  runDiscover,
+		},
+		{
+			Name: "hosts",
+			Help: "List the known hosts.",
+			Run:  runHosts,
+		},
+		{
+			Name:  "serve",
+			Help:  "Run an OctoPrint and Moonraker compatible server that slicers can upload to, for one printer or several (-host J1A,J1B, a group or -all).",
+			Flags: serveFlags,
+			Run:   runServe,
+		},
+		{
+			Name:  "preheat",
+			Help:  "Set the temperatures of the tools and the bed.",
+			Flags: preheatFlags,
+			Run:   runPreheat,
+		},
+		{
+			Name: "home",
+			Help: "Home the printer.",
+			Run:  runHome,
+		},
+		{
+			Name:  "status",
+			Help:  "Show the state, temperatures and job progress of the printer.",
+			Flags: statusFlags,
+			Run:   runStatus,
+		},
+		{
+			Name:  "fix",
+			Args:  "file.gcode ...",
+			Help:  "Run SMFix on files and write the result instead of uploading it.",
+			Flags: fixOnlyFlags,
+			Run:   runFix,
+		},
+		{
+			Name:  "emulate",
+			Args:  "J1 | Artisan | A150 | A250 | A350",
+			Help:  "Run a virtual printer on this machine.",
+			Flags: emulateFlags,
+			Run:   runEmulate,
+		},
+		{
+			Name: "help",
+			Args: "[command]",
+			Help: "Show the options of a command.",
+			Run:  runHelp,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.Name, flag.ExitOnError)
+	globalFlags(fs)
+	if c.Flags != nil {
+		c.Flags(fs)
+	}
+	fs.Usage = func() {
+		ex, _ := os.Executable()
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [options] %s\n\n%s\n\nOptions:\n", filepath.Base(ex), c.Name, c.Args, c.Help)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// run parses the options of the command and runs it
+func (c *command) run(args []string) error {
+	fs := c.flagSet()
+	fs.Parse(args)
+	if err := checkOutput(); err != nil {
+		return err
+	}
+	return c.Run(fs.Args())
+}
+
+func uploadFileFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&StartPrint, "print", StartPrint, "start printing the uploaded file")
+	uploadFlags(fs)
+}
+
+func watchFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&WatchInterval, "interval", WatchInterval, "how often the directories are scanned")
+	fs.DurationVar(&WatchSettle, "settle", WatchSettle, "how long a file must stay unchanged before it is uploaded")
+	rediscoverFlags(fs)
+	uploadFileFlags(fs)
+}
+
+// what queue add asks of the printer
+var jobModel, jobToolhead, jobTags string
+var jobPriority int
+
+// where queue run takes OctoPrint uploads, none without -listen or OCTOPRINT
+var queueListenAddr string
+
+func queueFlags(fs *flag.FlagSet) {
+	fs.StringVar(&QueueDir, "queue", QueueDir, "directory of the job queue")
+	fs.StringVar(&jobModel, "model", jobModel, "add: the job needs a printer of this model, e.g. J1")
+	fs.StringVar(&jobToolhead, "toolhead", jobToolhead, "add: the job needs a printer with this toolhead: in the known hosts")
+	fs.StringVar(&jobTags, "tags", jobTags, "add: the job needs a printer with all these tags: in the known hosts, comma separated")
+	fs.IntVar(&jobPriority, "priority", jobPriority, "add: jobs with a higher priority go first")
+	fs.StringVar(&queueListenAddr, "listen", OctoPrintListenAddr, "run: take OctoPrint uploads into the queue on this address")
+	fs.DurationVar(&QueueInterval, "interval", QueueInterval, "run: how often idle printers are looked for")
+	rediscoverFlags(fs)
+	octoPrintAuthFlags(fs)
+	uploadFileFlags(fs)
+}
+
+// what history lists
+var historySince, historyUntil, historyStatus, historyFormat, historyExport string
+
+func historyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&historySince, "since", historySince, "uploads since a date (2023-07-01), a time (2023-07-01 15:04) or a duration ago (24h)")
+	fs.StringVar(&historyUntil, "until", historyUntil, "uploads before a time, a date includes the day")
+	fs.StringVar(&historyStatus, "status", historyStatus, "only uploads that are ok or failed")
+	fs.StringVar(&historyFormat, "format", historyFormat, "text, csv or json, json by default with -output json")
+	fs.StringVar(&historyExport, "export", historyExport, "write to this file instead of stdout")
+}
+
+// serve every known host instead of -host
+var serveAll bool
+
+// where serve listens, OCTOPRINT or :8844
+var serveListenAddr string
+
+func serveFlags(fs *flag.FlagSet) {
+	listen := OctoPrintListenAddr
+	if listen == "" {
+		listen = ":8844"
+	}
+	fs.StringVar(&serveListenAddr, "listen", listen, "listen address of the OctoPrint server")
+	fs.BoolVar(&serveAll, "all", serveAll, "serve every printer of the known hosts")
+	prusaLinkFlags(fs)
+	mdnsFlags(fs)
+	rediscoverFlags(fs)
+	octoPrintAuthFlags(fs)
+	fixFlags(fs)
+}
+
+func fixOnlyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&FixOutput, "fix-output", FixOutput, "file or directory for the result, '-' is stdout")
+	fixFlags(fs)
+}
+
+func emulateFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Emulate.ID, "id", Emulate.ID, "printer id of the virtual printer")
+	fs.StringVar(&Emulate.Model, "model", Emulate.Model, "model: the virtual printer reports in discovery")
+	fs.StringVar(&Emulate.Protocol, "protocol", Emulate.Protocol, "protocol of the virtual printer (sacp/http), defaults to the model's")
+	fs.StringVar(&Emulate.Dir, "dir", Emulate.Dir, "directory for files uploaded to the virtual printer")
+	fs.Float64Var(&Emulate.Speed, "speed", Emulate.Speed, "gcode lines per second of simulated prints")
+}
+
+func runUpload(args []string) error {
+	if len(args) == 0 {
+		return errNoInputFiles
+	}
+	if NoFix {
+		log.Println("smfix disabled")
+	}
+	return withPrinters(func(printers []*Printer) error {
+		return uploadFiles(printers, args, StartPrint)
+	})
+}
+
+func runPrint(args []string) error {
+	if len(args) == 0 {
+		return errNoInputFiles
+	}
+	switch args[0] {
+	case "pause", "resume", "stop":
+		return withPrinter(func(printer *Printer) error {
+			return jobCommand(printer, args[0])
+		})
+	case "start":
+		if len(args) != 2 {
+			return fmt.Errorf("%w: print start takes the name of one file on the printer", errUsage)
+		}
+		return withPrinter(func(printer *Printer) error {
+			log.Printf("Starting print: %s", args[1])
+			if err := Connector.StartPrint(printer, args[1]); err != nil {
+				return err
+			}
+			emit(Event{Event: "job", Printer: printer, Action: "start", File: args[1]})
+			return nil
+		})
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("%w: print accepts only one file", errUsage)
+	}
+	return withPrinters(func(printers []*Printer) error {
+		return uploadFiles(printers, args, true)
+	})
+}
+
+func runWatch(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: watch needs a directory", errUsage)
+	}
+	if NoFix {
+		log.Println("smfix disabled")
+	}
+	return watchFolders(args)
+}
+
+// runQueue runs a queue subcommand, whose options follow its name
+func runQueue(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: queue needs add, list, priority, cancel or run", errUsage)
+	}
+	fs := findCommand("queue").flagSet()
+	fs.Parse(args[1:])
+	args, sub := fs.Args(), args[0]
+
+	queue, err := NewJobQueue(QueueDir)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "add":
+		if len(args) == 0 {
+			return errNoInputFiles
+		}
+		for _, file := range args {
+			if err := addJob(queue, file); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "list", "ls":
+		jobs, err := queue.Jobs()
+		if err != nil {
+			return err
+		}
+		if jsonOutput() {
+			for _, job := range jobs {
+				emit(Event{Event: "queue", Job: job})
+			}
+			return nil
+		}
+		printJobs(os.Stdout, jobs)
+		return nil
+
+	case "priority":
+		if len(args) != 2 {
+			return fmt.Errorf("%w: queue priority takes a job id and a number", errUsage)
+		}
+		priority, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("%w: %s", errUsage, err)
+		}
+		return queue.SetPriority(args[0], priority)
+
+	case "cancel":
+		if len(args) == 0 {
+			return fmt.Errorf("%w: queue cancel takes job ids", errUsage)
+		}
+		for _, id := range args {
+			if err := queue.Cancel(id); err != nil {
+				return err
+			}
+			log.Printf("Job %s cancelled", id)
+		}
+		return nil
+
+	case "run":
+		if NoFix {
+			log.Println("smfix disabled")
+		}
+		ls := NewLocalStorage(KnownHosts)
+		defer ls.Save()
+		printers := ls.Printers
+		if hosts := ls.Expand(Host); len(hosts) > 0 {
+			if printers, err = findPrinters(ls, hosts); err != nil {
+				return err
+			}
+		}
+		if len(printers) == 0 {
+			return fmt.Errorf("%w: the queue needs known hosts or -host", errPrinterNotFound)
+		}
+		defer ls.Add(printers...)
+		defer startDiscoveryService(ls, RediscoverInterval).Close()
+		return runQueueDaemon(queue, printers, queueListenAddr)
+	}
+	return fmt.Errorf("%w: unknown queue command %s", errUsage, sub)
+}
+
+func addJob(queue *JobQueue, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errFileInvalid, err)
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err != nil {
+		return fmt.Errorf("%w: %s", errFileInvalid, err)
+	} else if st.Size() < FILE_SIZE_MIN {
+		return fmt.Errorf("%w: %s", errFileEmpty, file)
+	}
+
+	job := &Job{
+		Name:     normalizedFilename(filepath.Base(file)),
+		Priority: jobPriority,
+		Print:    StartPrint,
+		Fix:      FixDefaults.Merge(nil),
+		JobConstraints: JobConstraints{
+			Model:    jobModel,
+			Toolhead: jobToolhead,
+			Tags:     splitList(jobTags),
+		},
+	}
+	if err := queue.Add(job, f); err != nil {
+		return err
+	}
+	log.Printf("Job %s queued: %s", job.ID, job.Name)
+	if jsonOutput() {
+		emit(Event{Event: "queue", Job: job})
+	} else {
+		fmt.Println(job.ID)
+	}
+	return nil
+}
+
+func printJobs(w io.Writer, jobs []*Job) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPRIORITY\tSTATE\tFILE\tNEEDS\tPRINTER\tERROR")
+	for _, job := range jobs {
+		needs := []string{}
+		if job.Model != "" {
+			needs = append(needs, "model="+job.Model)
+		}
+		if job.Toolhead != "" {
+			needs = append(needs, "toolhead="+job.Toolhead)
+		}
+		if len(job.Tags) > 0 {
+			needs = append(needs, "tags="+strings.Join(job.Tags, ","))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", job.ID, job.Priority, job.State, job.Name, strings.Join(needs, " "), job.Printer, job.Error)
+	}
+	tw.Flush()
+}
+
+func runHistory(args []string) error {
+	now := time.Now()
+	filter := &HistoryFilter{
+		Printers: NewLocalStorage(KnownHosts).Expand(Host),
+		Status:   historyStatus,
+	}
+	var err error
+	if filter.Since, err = parseHistoryTime(historySince, now, false); err != nil {
+		return err
+	}
+	if filter.Until, err = parseHistoryTime(historyUntil, now, true); err != nil {
+		return err
+	}
+	if filter.Status != "" && filter.Status != HistoryOK && filter.Status != HistoryFailed {
+		return fmt.Errorf("%w: -status %s, want ok or failed", errUsage, filter.Status)
+	}
+
+	format := historyFormat
+	if format == "" {
+		format = OutputText
+		if jsonOutput() {
+			format = OutputJSON
+		}
+	}
+	write := map[string]func(io.Writer, []*HistoryEntry) error{
+		OutputText: func(w io.Writer, entries []*HistoryEntry) error {
+			printHistory(w, entries)
+			return nil
+		},
+		OutputJSON: writeHistoryJSON,
+		"csv":      writeHistoryCSV,
+	}[format]
+	if write == nil {
+		return fmt.Errorf("%w: -format %s, want text, csv or json", errUsage, format)
+	}
+
+	entries, err := readHistory(HistoryFile, filter)
+	if err != nil {
+		return err
+	}
+	if historyExport == "" {
+		return write(os.Stdout, entries)
+	}
+	f, err := os.Create(historyExport)
+	if err != nil {
+		return err
+	}
+	if err := write(f, entries); err != nil {
+		f.Close()
+		return err
+	}
+	log.Printf("%d uploads written to %s", len(entries), historyExport)
+	return f.Close()
+}
+
+func runDiscover(args []string) error {
+	printers, err := Discover(DiscoverTimeout)
+	if err != nil {
+		return err
+	}
+	ls := NewLocalStorage(KnownHosts)
+	ls.Add(printers...)
+	if err := ls.Save(); err != nil {
+		return err
+	}
+	for _, p := range printers {
+		if jsonOutput() {
+			emit(Event{Event: "discovered", Printer: p})
+		} else {
+			fmt.Println(p.String())
+		}
+	}
+	if len(printers) == 0 {
+		return fmt.Errorf("%w: no printers found", errPrinterNotFound)
+	}
+	return nil
+}
+
+func runHosts(args []string) error {
+	for _, p := range NewLocalStorage(KnownHosts).Printers {
+		if jsonOutput() {
+			emit(Event{Event: "host", Printer: p})
+		} else {
+			fmt.Println(p.String())
+		}
+	}
+	return nil
+}
+
+func runServe(args []string) error {
+	if serveAll {
+		names := []string{}
+		for _, p := range NewLocalStorage(KnownHosts).Printers {
+			names = append(names, p.Name())
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("%w: no known hosts, run discover first", errPrinterNotFound)
+		}
+		Host = strings.Join(names, ",")
+	}
+	return withKnownPrinters(func(ls *LocalStorage, printers []*Printer) error {
+		defer startDiscoveryService(ls, RediscoverInterval).Close()
+		return startOctoPrintServer(serveListenAddr, printers)
+	})
+}
+
+func runPreheat(args []string) error {
+	if Tool1Temperature == 0 && Tool2Temperature == 0 && BedTemperature == 0 && !Home {
+		return fmt.Errorf("%w: preheat needs -tool1, -tool2, -bed or -home", errUsage)
+	}
+	return withPrinter(preheat)
+}
+
+func runHome(args []string) error {
+	return withPrinter(func(printer *Printer) error {
+		log.Println("Homing...")
+		if err := Connector.PreHeatCommands(printer, 0, 0, 0, true); err != nil {
+			return err
+		}
+		emit(Event{Event: "preheat", Printer: printer, Action: "home"})
+		return nil
+	})
+}
+
+func runStatus(args []string) error {
+	return withPrinter(func(printer *Printer) error {
+		return printStatus(printer, StatusRefresh)
+	})
+}
+
+func runFix(args []string) error {
+	return fixFiles(args, FixOutput, fixOptionsFor(Host))
+}
+
+func runEmulate(args []string) error {
+	if len(args) > 0 {
+		Emulate.Name = args[0]
+	}
+	if Emulate.Name == "" {
+		return fmt.Errorf("%w: emulate needs the printer to emulate, e.g. J1", errUsage)
+	}
+	return startEmulator(Emulate)
+}
+
+func runHelp(args []string) error {
+	if len(args) == 0 {
+		flag_usage()
+		return nil
+	}
+	c := findCommand(args[0])
+	if c == nil {
+		return fmt.Errorf("%w: unknown command %s", errUsage, args[0])
+	}
+	c.flagSet().Usage()
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestCommandFlagsKeepGlobalOptions(t *testing.T) {
+	origHost, origPrint, origFix := Host, StartPrint, FixDefaults
+	t.Cleanup(func() { Host, StartPrint, FixDefaults = origHost, origPrint, origFix })
+	Host, StartPrint, FixDefaults = "", false, FixOptions{}
+
+	// sm2uploader -host J1V19 upload -print -preheat part.gcode
+	top := flag.NewFlagSet("sm2uploader", flag.ContinueOnError)
+	top.SetOutput(io.Discard)
+	legacyFlags(top)
+	if err := top.Parse([]string{"-host", "J1V19", "upload", "-print", "-preheat", "part.gcode"}); err != nil {
+		t.Fatal(err)
+	}
+	cmd := findCommand(top.Arg(0))
+	if cmd == nil {
+		t.Fatalf("no command for %q", top.Arg(0))
+	}
+
+	fs := cmd.flagSet()
+	if err := fs.Parse(top.Args()[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if Host != "J1V19" || !StartPrint || !FixDefaults.Enabled("preheat") {
+		t.Errorf("host %q, print %v, fix %v", Host, StartPrint, FixDefaults)
+	}
+	if got := fs.Args(); len(got) != 1 || got[0] != "part.gcode" {
+		t.Errorf("args = %v", got)
+	}
+
+	if findCommand("part.gcode") != nil {
+		t.Error("a file name taken for a command")
+	}
+}
+
+func TestServeAndQueueListenDefaults(t *testing.T) {
+	orig := OctoPrintListenAddr
+	t.Cleanup(func() { OctoPrintListenAddr = orig })
+	OctoPrintListenAddr = ""
+
+	// help serve builds the serve flags first, that must not make the queue listen
+	for _, order := range [][]string{{"serve", "queue"}, {"queue", "serve"}} {
+		sets := map[string]*flag.FlagSet{}
+		for _, name := range order {
+			sets[name] = findCommand(name).flagSet()
+		}
+		if got := sets["serve"].Lookup("listen").DefValue; got != ":8844" {
+			t.Errorf("%v: serve -listen default %q", order, got)
+		}
+		if got := sets["queue"].Lookup("listen").DefValue; got != "" {
+			t.Errorf("%v: queue -listen default %q", order, got)
+		}
+		if OctoPrintListenAddr != "" {
+			t.Errorf("%v: OctoPrintListenAddr set to %q", order, OctoPrintListenAddr)
+		}
+	}
+}
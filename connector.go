@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"time"
@@ -13,9 +14,13 @@ const (
 )
 
 var (
-	errFileEmpty      = errors.New("File is empty.")
-	errFileTooLarge   = errors.New("File is too large.")
-	ErrNotImplemented = errors.New("not implemented")
+	errFileEmpty       = errors.New("File is empty.")
+	errFileTooLarge    = errors.New("File is too large.")
+	errFileInvalid     = errors.New("invalid file")
+	errPrinterNotFound = errors.New("printer not found")
+	errAccessDenied    = errors.New("access denied")
+	errUploadFailed    = errors.New("upload failed")
+	ErrNotImplemented  = errors.New("not implemented")
 )
 
 type Payload struct {
@@ -23,6 +28,8 @@ type Payload struct {
 	Name  string
 	Size  int64
 	Print bool
+	Fix   FixOptions
+	MD5   string // of what was sent, known once the payload is opened
 }
 
 func (p *Payload) SetName(name string) {
@@ -33,16 +40,6 @@ func (p *Payload) ReadableSize() string {
 	return humanReadableSize(p.Size)
 }
 
-func (p *Payload) GetContent(nofix bool) (cont []byte, err error) {
-	if nofix || !p.ShouldBeFix() {
-		cont, err = io.ReadAll(p.File)
-	} else {
-		cont, err = postProcess(p.File)
-		p.Size = int64(len(cont))
-	}
-	return cont, err
-}
-
 func (p *Payload) ShouldBeFix() bool {
 	return shouldBeFix(p.Name)
 }
@@ -53,11 +50,12 @@ func NewPayload(file io.Reader, name string, size int64, print bool) *Payload {
 		Name:  normalizedFilename(name),
 		Size:  size,
 		Print: print,
+		Fix:   FixDefaults.Merge(nil),
 	}
 }
 
 type connector struct {
-	handlers []Handler
+	handlers []func() Handler
 }
 
 type Handler interface {
@@ -68,88 +66,150 @@ type Handler interface {
 	SetToolTemperature(int, int) error
 	SetBedTemperature(int, int) error
 	Home() error
+	StartPrint(string) error
+	PausePrint() error
+	ResumePrint() error
+	StopPrint() error
+	Status() (*PrinterStatus, error)
 }
 
-func (c *connector) RegisterHandler(h Handler) {
-	c.handlers = append(c.handlers, h)
+// RegisterHandler adds a protocol, newHandler makes the handler of a single
+// session with a printer.
+func (c *connector) RegisterHandler(newHandler func() Handler) {
+	c.handlers = append(c.handlers, newHandler)
 }
 
-// Upload to upload a file to a printer
-func (c *connector) Upload(printer *Printer, payload *Payload) error {
-	// Iterate through all handlers
-	for _, h := range c.handlers {
-		// Check if handler can ping the printer
-		if h.Ping(printer) {
-			// Connect to the printer
-			if err := h.Connect(); err != nil {
-				return err
-			}
-			defer h.Disconnect()
+// withHandler connects to the printer through the first handler that can
+// reach it, and runs fn on that connection. Every call has its own handler, so
+// sessions with several printers can run at the same time. A printer that
+// does not answer is looked for by its id once, it may have a new address.
+func (c *connector) withHandler(printer *Printer, fn func(Handler) error) error {
+	for attempt := 0; ; attempt++ {
+		// Iterate through all handlers
+		for _, newHandler := range c.handlers {
+			h := newHandler()
+			// Check if handler can ping the printer
+			if h.Ping(printer) {
+				// Connect to the printer
+				if err := h.Connect(); err != nil {
+					return err
+				}
+				defer h.Disconnect()
 
-			if payload.Size > FILE_SIZE_MAX {
-				return errFileTooLarge
-			}
-			if payload.Size < FILE_SIZE_MIN {
-				return errFileEmpty
-			}
-			// Upload the file to the printer
-			if err := h.Upload(payload); err != nil {
-				return err
+				return fn(h)
 			}
-
-			// Return nil if successful
-			return nil
+		}
+		if attempt > 0 || !resolvePrinter(printer) {
+			break
 		}
 	}
 	// Return error if printer is not available
-	return errors.New("Printer " + printer.IP + " is not available.")
+	return fmt.Errorf("%w: %s is not available", errPrinterNotFound, printer.Addr())
+}
+
+// Upload to upload a file to a printer
+func (c *connector) Upload(printer *Printer, payload *Payload) (err error) {
+	start, size, protocol := time.Now(), payload.Size, ""
+	defer func() {
+		recordUpload(newHistoryEntry(printer, payload, protocol, size, start, err))
+	}()
+
+	// refuse before anything is read or the printer is bothered
+	if payload.Size > FILE_SIZE_MAX {
+		return errFileTooLarge
+	}
+	if payload.Size < FILE_SIZE_MIN {
+		return errFileEmpty
+	}
+	// the settings of the upload win over the printer's own
+	payload.Fix = printer.Fix.Merge(payload.Fix)
+	return c.withHandler(printer, func(h Handler) error {
+		protocol = handlerProtocol(h)
+		// Upload the file to the printer
+		return h.Upload(payload)
+	})
 }
 
 func (c *connector) PreHeatCommands(printer *Printer, tool_1_temperature int, tool_2_temperature int, bed_temperature int, home bool) error {
-	// Iterate through all handlers
-	for _, h := range c.handlers {
-		// Check if handler can ping the printer
-		if h.Ping(printer) {
-			// Connect to the printer
-			if err := h.Connect(); err != nil {
+	return c.withHandler(printer, func(h Handler) error {
+		// Send the GCode command to the printer
+		if tool_1_temperature > 0 {
+			if err := h.SetToolTemperature(0, tool_1_temperature); err != nil && !errors.Is(err, ErrNotImplemented) {
 				return err
 			}
-			defer h.Disconnect()
-
-			// Send the GCode command to the printer
-			if tool_1_temperature > 0 {
-				if err := h.SetToolTemperature(0, tool_1_temperature); err != nil && !errors.Is(err, ErrNotImplemented) {
-					return err
-				}
+		}
+		if tool_2_temperature > 0 {
+			if err := h.SetToolTemperature(1, tool_2_temperature); err != nil && !errors.Is(err, ErrNotImplemented) {
+				return err
 			}
-			if tool_2_temperature > 0 {
-				if err := h.SetToolTemperature(1, tool_2_temperature); err != nil && !errors.Is(err, ErrNotImplemented) {
-					return err
-				}
+		}
+		if bed_temperature > 0 {
+			if err := h.SetBedTemperature(0, bed_temperature); err != nil && !errors.Is(err, ErrNotImplemented) {
+				return err
 			}
-			if bed_temperature > 0 {
-				if err := h.SetBedTemperature(0, bed_temperature); err != nil && !errors.Is(err, ErrNotImplemented) {
-					return err
-				}
-				if err := h.SetBedTemperature(1, bed_temperature); err != nil && !errors.Is(err, ErrNotImplemented) {
-					return err
-				}
+			if err := h.SetBedTemperature(1, bed_temperature); err != nil && !errors.Is(err, ErrNotImplemented) {
+				return err
 			}
-			if home {
-				if err := h.Home(); err != nil && !errors.Is(err, ErrNotImplemented) {
-					return err
-				}
+		}
+		if home {
+			if err := h.Home(); err != nil && !errors.Is(err, ErrNotImplemented) {
+				return err
 			}
-			// Return nil if successful
-			return nil
 		}
-	}
-	// Return error if printer is not available
-	return errors.New("Printer " + printer.IP + " is not available.")
+		return nil
+	})
+}
+
+// StartPrint starts printing a file that is already stored on the printer
+func (c *connector) StartPrint(printer *Printer, filename string) error {
+	return c.withHandler(printer, func(h Handler) error {
+		return h.StartPrint(normalizedFilename(filename))
+	})
+}
+
+// PausePrint pauses the active job
+func (c *connector) PausePrint(printer *Printer) error {
+	return c.withHandler(printer, func(h Handler) error {
+		return h.PausePrint()
+	})
+}
+
+// ResumePrint resumes a paused job
+func (c *connector) ResumePrint(printer *Printer) error {
+	return c.withHandler(printer, func(h Handler) error {
+		return h.ResumePrint()
+	})
+}
+
+// StopPrint stops the active job
+func (c *connector) StopPrint(printer *Printer) error {
+	return c.withHandler(printer, func(h Handler) error {
+		return h.StopPrint()
+	})
+}
+
+// Status queries what the printer is doing
+func (c *connector) Status(printer *Printer) (st *PrinterStatus, err error) {
+	err = c.withHandler(printer, func(h Handler) error {
+		st, err = h.Status()
+		return err
+	})
+	return st, err
 }
 
 var Connector = &connector{}
 
+// handlerProtocol names the protocol a handler talks
+func handlerProtocol(h Handler) string {
+	switch h.(type) {
+	case *SACPConnector:
+		return "SACP"
+	case *HTTPConnector:
+		return "HTTP"
+	}
+	return ""
+}
+
 // ping the printer to see if it is available
 func ping(ip string, port string, timeout int) bool {
 	if timeout <= 0 {
@@ -1,22 +1,23 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"time"
 
-	"github.com/gosuri/uilive"
 	"github.com/imroc/req/v3"
 )
 
 const (
-	HTTPPort    = "8080"
 	HTTPTimeout = 5
 )
 
+var (
+	HTTPPort = "8080"
+)
+
 const (
 	AuthStatusApproved = 1 + iota
 	AuthStatusDenied
@@ -32,7 +33,7 @@ func (hc *HTTPConnector) Ping(p *Printer) bool {
 	if p.Sacp {
 		return false
 	}
-	if ping(p.IP, HTTPPort, 3) {
+	if ping(p.Addr(), HTTPPort, 3) {
 		hc.printer = p
 		return true
 	}
@@ -50,12 +51,12 @@ func (hc *HTTPConnector) Connect() error {
 		SetRetryFixedInterval(1 * time.Second).
 		SetRetryCondition(func(r *req.Response, err error) bool {
 			if Debug {
-				log.Printf("-- retrying %s -> %d, token %s", r.Request.URL, r.StatusCode, hc.printer.Token)
+				log.Printf("-- retrying %s -> %d, token %s", r.Request.URL, r.StatusCode, hc.printer.GetToken())
 			}
 
 			// token expired
-			if r.StatusCode == 403 && hc.printer.Token != "" {
-				hc.printer.Token = ""
+			if r.StatusCode == 403 && hc.printer.GetToken() != "" {
+				hc.printer.SetToken("")
 				// reconnect with no token to get new one
 				return true
 			}
@@ -67,8 +68,8 @@ func (hc *HTTPConnector) Connect() error {
 		return err
 	}
 	if resp.StatusCode == 200 {
-		if hc.printer.Token != result.Token {
-			hc.printer.Token = result.Token
+		if hc.printer.GetToken() != result.Token {
+			hc.printer.SetToken(result.Token)
 		}
 		tip := false
 		for {
@@ -83,7 +84,7 @@ func (hc *HTTPConnector) Connect() error {
 				// wait for auth on HMI
 				<-time.After(2 * time.Second)
 			case AuthStatusDenied:
-				return fmt.Errorf("access denied")
+				return errAccessDenied
 			}
 		}
 		/*
@@ -99,7 +100,7 @@ func (hc *HTTPConnector) Connect() error {
 }
 
 func (hc *HTTPConnector) Disconnect() (err error) {
-	if hc.client != nil && hc.printer.Token != "" {
+	if hc.client != nil && hc.printer.GetToken() != "" {
 		_, err = hc.request().Post(hc.URL("/disconnect"))
 	}
 	return
@@ -120,6 +121,36 @@ func (hc *HTTPConnector) Home() (err error) {
 	return
 }
 
+func (hc *HTTPConnector) StartPrint(filename string) (err error) {
+	// the HTTP API can only start a job together with its upload (/prepare_print)
+	err = ErrNotImplemented
+	return
+}
+
+func (hc *HTTPConnector) PausePrint() error {
+	return hc.post("/pause_print")
+}
+
+func (hc *HTTPConnector) ResumePrint() error {
+	return hc.post("/resume_print")
+}
+
+func (hc *HTTPConnector) StopPrint() error {
+	return hc.post("/stop_print")
+}
+
+// post sends a bare command to the printer and checks its status code
+func (hc *HTTPConnector) post(path string) error {
+	resp, err := hc.request().Post(hc.URL(path))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s error %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
 func (hc *HTTPConnector) Upload(payload *Payload) (err error) {
 	finished := make(chan empty, 1)
 	defer func() {
@@ -141,49 +172,28 @@ func (hc *HTTPConnector) Upload(payload *Payload) (err error) {
 		}
 	}()
 
-	w := uilive.New()
-	w.Start()
-	log.SetOutput(w)
-	defer func() {
-		w.Stop()
-		log.SetOutput(os.Stderr)
-	}()
-	var writeErr error
+	// the heartbeat keeps the connection while SMFix runs
+	content, err := payload.Open(NoFix)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
 
 	file := req.FileUpload{
 		ParamName: "file",
 		FileName:  payload.Name,
 		GetFileContent: func() (io.ReadCloser, error) {
-			// Read content first to avoid pipe issues in launchctl
-			content, err := payload.GetContent(NoFix)
-			if !NoFix {
-				log.SetOutput(os.Stderr)
-				if err != nil {
-					log.Printf("G-Code fix error(ignored): %s", err)
-				} else if payload.ShouldBeFix() {
-					log.Printf("G-Code fixed")
-				}
-				log.SetOutput(w)
-			}
-			if err != nil {
-				writeErr = err
-				return nil, err
-			}
-			// Return a simple reader instead of pipe
-			return io.NopCloser(bytes.NewReader(content)), nil
+			return io.NopCloser(content.Reader()), nil
 		},
-		FileSize: payload.Size,
+		FileSize: content.Size,
 		// ContentType: "application/octet-stream",
 	}
 	r := hc.request(0)
 	r.SetFileUpload(file)
+	progress := newProgress("HTTP", hc.printer, payload.Name)
+	defer progress.Done()
 	r.SetUploadCallbackWithInterval(func(info req.UploadInfo) {
-		if info.FileSize > 0 {
-			perc := float64(info.UploadedSize) / float64(info.FileSize) * 100.0
-			log.Printf("  - HTTP sending %.1f%%", perc)
-		} else {
-			log.Printf("  - HTTP sending %s...", humanReadableSize(info.UploadedSize))
-		}
+		progress.Update(info.UploadedSize, info.FileSize)
 	}, 35*time.Millisecond)
 
 	if payload.Print {
@@ -197,11 +207,6 @@ func (hc *HTTPConnector) Upload(payload *Payload) (err error) {
 	} else {
 		_, err = r.Post(hc.URL("/upload"))
 	}
-	if err == nil && writeErr != nil {
-		err = writeErr
-	} else if writeErr != nil {
-		log.Printf("HTTP upload write error: %v", writeErr)
-	}
 	return
 }
 
@@ -221,14 +226,21 @@ func (hc *HTTPConnector) request(timeout ...int) *req.Request {
 
 	req := hc.client.SetTimeout(time.Second * time.Duration(to)).R()
 	// for GET
-	req.SetQueryParam("token", hc.printer.Token)
+	req.SetQueryParam("token", hc.printer.GetToken())
 	// for POST
-	req.SetFormData(map[string]string{"token": hc.printer.Token})
+	req.SetFormData(map[string]string{"token": hc.printer.GetToken()})
 
 	return req
 }
 
 func (hc *HTTPConnector) checkStatus() (status int) {
+	status, _ = hc.fetchStatus()
+	return
+}
+
+// fetchStatus reads /status, which doubles as the heartbeat and the
+// authorization check.
+func (hc *HTTPConnector) fetchStatus() (status int, body []byte) {
 	r, err := hc.request().Get(hc.URL("/status"))
 	if Debug {
 		log.Printf("-- heartbeat: %d, err(%s)", r.StatusCode, err)
@@ -236,9 +248,9 @@ func (hc *HTTPConnector) checkStatus() (status int) {
 	if err == nil {
 		switch r.StatusCode {
 		case 200:
-			return AuthStatusApproved
+			return AuthStatusApproved, r.Bytes()
 		case 204:
-			return AuthStatusWaiting
+			return AuthStatusWaiting, nil
 			// case 401:
 			// 	return AuthStatusDenied
 			// case 403:
@@ -246,16 +258,74 @@ func (hc *HTTPConnector) checkStatus() (status int) {
 			// 	return AuthStatusExpired
 		}
 	}
-	return AuthStatusDenied
+	return AuthStatusDenied, nil
+}
+
+// httpStatus is the body of /api/v1/status
+type httpStatus struct {
+	Status                     string  `json:"status"`
+	NozzleTemperature          float64 `json:"nozzleTemperature"`
+	NozzleTargetTemperature    float64 `json:"nozzleTargetTemperature"`
+	NozzleTemperature1         float64 `json:"nozzleTemperature1"`
+	NozzleTargetTemperature1   float64 `json:"nozzleTargetTemperature1"`
+	NozzleTemperature2         float64 `json:"nozzleTemperature2"`
+	NozzleTargetTemperature2   float64 `json:"nozzleTargetTemperature2"`
+	HeatedBedTemperature       float64 `json:"heatedBedTemperature"`
+	HeatedBedTargetTemperature float64 `json:"heatedBedTargetTemperature"`
+	FileName                   string  `json:"fileName"`
+	Progress                   float64 `json:"progress"`
+	ElapsedTime                int64   `json:"elapsedTime"`   // ms
+	RemainingTime              int64   `json:"remainingTime"` // ms
+}
+
+func (s *httpStatus) PrinterStatus() *PrinterStatus {
+	st := &PrinterStatus{
+		State: s.Status,
+		Bed: Temperature{
+			Current: s.HeatedBedTemperature,
+			Target:  s.HeatedBedTargetTemperature,
+		},
+		File:      s.FileName,
+		Progress:  s.Progress,
+		Elapsed:   time.Duration(s.ElapsedTime) * time.Millisecond,
+		Remaining: time.Duration(s.RemainingTime) * time.Millisecond,
+	}
+	if st.State == "" {
+		st.State = StateUnknown
+	}
+	// dual extruder modules report each nozzle separately
+	if s.NozzleTemperature1 != 0 || s.NozzleTemperature2 != 0 {
+		st.Nozzles = []Temperature{
+			{Current: s.NozzleTemperature1, Target: s.NozzleTargetTemperature1},
+			{Current: s.NozzleTemperature2, Target: s.NozzleTargetTemperature2},
+		}
+	} else {
+		st.Nozzles = []Temperature{
+			{Current: s.NozzleTemperature, Target: s.NozzleTargetTemperature},
+		}
+	}
+	return st
+}
+
+func (hc *HTTPConnector) Status() (*PrinterStatus, error) {
+	status, body := hc.fetchStatus()
+	if status != AuthStatusApproved {
+		return nil, errAccessDenied
+	}
+	var result httpStatus
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	return result.PrinterStatus(), nil
 }
 
 /*
 URL to make url with path
 */
 func (hc *HTTPConnector) URL(path string) string {
-	return fmt.Sprintf("http://%s:%s/api/v1%s", hc.printer.IP, HTTPPort, path)
+	return fmt.Sprintf("http://%s:%s/api/v1%s", hc.printer.Addr(), HTTPPort, path)
 }
 
 func init() {
-	Connector.RegisterHandler(&HTTPConnector{})
+	Connector.RegisterHandler(func() Handler { return &HTTPConnector{} })
 }
@@ -1,29 +1,40 @@
 package main
 
 import (
+	"errors"
+	"io"
 	"log"
 	"net"
-	"os"
+	"path/filepath"
+	"strings"
 	"time"
-
-	"github.com/gosuri/uilive"
 )
 
 const (
-	SACPPort    = "8888"
 	SACPTimeout = 5
 )
 
+var (
+	SACPPort = "8888"
+
+	// how many times an upload reconnects after the connection drops
+	UploadRetries = 5
+	// first wait before reconnecting, doubled on every attempt
+	sacpReconnectDelay = time.Second
+)
+
+const sacpMaxReconnectDelay = 10 * time.Second
+
 type SACPConnector struct {
 	printer *Printer
-	conn    net.Conn
+	client  *SACPClient
 }
 
 func (sc *SACPConnector) Ping(p *Printer) bool {
 	// if !p.Sacp {
 	// 	return false
 	// }
-	if ping(p.IP, SACPPort, 3) {
+	if ping(p.Addr(), SACPPort, 3) {
 		sc.printer = p
 		return true
 
@@ -32,58 +43,133 @@ func (sc *SACPConnector) Ping(p *Printer) bool {
 }
 
 func (sc *SACPConnector) Connect() (err error) {
-	conn, err := SACP_connect(sc.printer.IP, SACPTimeout*time.Second)
-	if conn != nil {
-		sc.conn = conn
+	client, err := SACP_connect(sc.printer.Addr(), SACPTimeout*time.Second)
+	if client != nil {
+		sc.client = client
 	}
 	return err
 }
 
 func (sc *SACPConnector) Disconnect() error {
-	if sc.conn != nil {
-		SACP_disconnect(sc.conn, SACPTimeout*time.Second)
-		sc.conn.Close()
+	if sc.client != nil {
+		SACP_disconnect(sc.client, SACPTimeout*time.Second)
+		sc.client.Close()
+		sc.client = nil
 	}
 	return nil
 }
 
 func (sc *SACPConnector) Upload(payload *Payload) (err error) {
-	content, err := payload.GetContent(NoFix)
-	if !NoFix {
-		if err != nil {
-			log.Printf("G-Code fix error(ignored): %s", err)
-		} else if payload.ShouldBeFix() {
-			log.Printf("G-Code fixed")
+	content, err := payload.Open(NoFix)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	err = sc.upload(payload.Name, content)
+	if err == nil && payload.Print {
+		log.Printf("Starting print: %s", payload.Name)
+		err = SACP_start_print(sc.client, sacpHeadType(payload.Name), payload.Name, content.MD5Hex(), SACPTimeout*time.Second)
+	}
+	return
+}
+
+/*
+upload sends the file and reconnects when the connection drops halfway. The
+printer keeps the chunks it already got for a file with the same MD5, so a
+new handshake carries on from the first missing chunk.
+*/
+func (sc *SACPConnector) upload(name string, content *PayloadContent) error {
+	delay := sacpReconnectDelay
+	progress := newProgress("SACP", sc.printer, name)
+	defer progress.Done()
+	for attempt := 0; ; attempt++ {
+		err := SACP_start_upload(sc.client, name, content, content.Size, content.MD5, progress.Update, SACPTimeout*time.Second)
+		if err == nil || !isSACPConnectionError(err) || attempt >= UploadRetries {
+			return err
+		}
+
+		log.Printf("Upload interrupted: %s, reconnecting in %s (%d/%d)", err, delay, attempt+1, UploadRetries)
+		sc.client.Close()
+		time.Sleep(delay)
+		if delay *= 2; delay > sacpMaxReconnectDelay {
+			delay = sacpMaxReconnectDelay
+		}
+
+		client, cerr := SACP_connect(sc.printer.Addr(), SACPTimeout*time.Second)
+		if cerr != nil {
+			// keep the old client around, the next attempt fails fast on it
+			continue
 		}
+		sc.client = client
 	}
+}
 
-	w := uilive.New()
-	w.Start()
-	log.SetOutput(w)
-	defer func() {
-		w.Stop()
-		log.SetOutput(os.Stderr)
-	}()
+// isSACPConnectionError tells whether err means the connection is gone, as
+// opposed to the printer refusing the request.
+func isSACPConnectionError(err error) bool {
+	var ne net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, errTimeoutExceeded) ||
+		errors.Is(err, errClientClosed) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.As(err, &ne)
+}
+
+func (sc *SACPConnector) StartPrint(filename string) (err error) {
+	// the printer accepts an empty checksum for files it already has
+	err = SACP_start_print(sc.client, sacpHeadType(filename), filename, "", SACPTimeout*time.Second)
+	return
+}
 
-	err = SACP_start_upload(sc.conn, payload.Name, content, SACPTimeout*time.Second)
+func (sc *SACPConnector) PausePrint() (err error) {
+	err = SACP_pause_print(sc.client, SACPTimeout*time.Second)
+	return
+}
+
+func (sc *SACPConnector) ResumePrint() (err error) {
+	err = SACP_resume_print(sc.client, SACPTimeout*time.Second)
+	return
+}
+
+func (sc *SACPConnector) StopPrint() (err error) {
+	err = SACP_stop_print(sc.client, SACPTimeout*time.Second)
 	return
 }
 
 func (sc *SACPConnector) SetToolTemperature(tool_id int, temperature int) (err error) {
-	err = SACP_set_tool_temperature(sc.conn, uint8(tool_id), uint16(temperature), SACPTimeout*time.Second)
+	err = SACP_set_tool_temperature(sc.client, uint8(tool_id), uint16(temperature), SACPTimeout*time.Second)
 	return
 }
 
 func (sc *SACPConnector) SetBedTemperature(tool_id int, temperature int) (err error) {
-	err = SACP_set_bed_temperature(sc.conn, uint8(tool_id), uint16(temperature), SACPTimeout*time.Second)
+	err = SACP_set_bed_temperature(sc.client, uint8(tool_id), uint16(temperature), SACPTimeout*time.Second)
 	return
 }
 
 func (sc *SACPConnector) Home() (err error) {
-	err = SACP_home(sc.conn, SACPTimeout*time.Second)
+	err = SACP_home(sc.client, SACPTimeout*time.Second)
 	return
 }
 
+func (sc *SACPConnector) Status() (*PrinterStatus, error) {
+	return SACP_get_status(sc.client, SACPTimeout*time.Second)
+}
+
+// sacpHeadType guesses the toolhead a job is meant for from its extension,
+// the same way Luban names its exports.
+func sacpHeadType(filename string) uint8 {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".nc":
+		return 1 // laser
+	case ".cnc":
+		return 2 // CNC
+	default:
+		return 0 // 3D printing
+	}
+}
+
 func init() {
-	Connector.RegisterHandler(&SACPConnector{})
+	Connector.RegisterHandler(func() Handler { return &SACPConnector{} })
 }
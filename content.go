@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+)
+
+/*
+PayloadContent is what actually goes to the printer: the file itself when it
+can be read at random, or a temporary copy of it. Either way the content is
+never held in memory as a whole, and its MD5 is known before the upload
+starts.
+*/
+type PayloadContent struct {
+	r    io.ReaderAt
+	Size int64
+	MD5  [md5.Size]byte
+
+	tmp []*os.File
+}
+
+// Reader returns a new reader from the start of the content
+func (c *PayloadContent) Reader() io.Reader {
+	return io.NewSectionReader(c.r, 0, c.Size)
+}
+
+func (c *PayloadContent) ReadAt(p []byte, off int64) (int, error) {
+	return c.r.ReadAt(p, off)
+}
+
+func (c *PayloadContent) MD5Hex() string {
+	return hex.EncodeToString(c.MD5[:])
+}
+
+// Close removes the temporary files, the original file is left open
+func (c *PayloadContent) Close() error {
+	var err error
+	for _, f := range c.tmp {
+		f.Close()
+		if e := os.Remove(f.Name()); e != nil && err == nil {
+			err = e
+		}
+	}
+	c.tmp = nil
+	return err
+}
+
+// spoolContent writes through fn into a temporary file, hashing on the way.
+// It fails as soon as more than FILE_SIZE_MAX bytes are written.
+func spoolContent(fn func(io.Writer) error) (*PayloadContent, error) {
+	f, err := os.CreateTemp("", "sm2uploader-*")
+	if err != nil {
+		return nil, err
+	}
+	out := &PayloadContent{r: f, tmp: []*os.File{f}}
+
+	h := md5.New()
+	w := &limitedWriter{w: io.MultiWriter(f, h), n: FILE_SIZE_MAX}
+	if err := fn(w); err != nil {
+		out.Close()
+		return nil, err
+	}
+	out.Size = FILE_SIZE_MAX - w.n
+	copy(out.MD5[:], h.Sum(nil))
+	return out, nil
+}
+
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errFileTooLarge
+	}
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// openPayload gives random access to the payload. Files that already allow
+// it (os.File, multipart uploads) are only read once for the MD5, streams are
+// copied into a temporary file.
+func openPayload(p *Payload) (*PayloadContent, error) {
+	if p.Size > FILE_SIZE_MAX {
+		return nil, errFileTooLarge
+	}
+
+	if ra, ok := p.File.(io.ReaderAt); ok && p.Size > 0 {
+		c := &PayloadContent{r: ra, Size: p.Size}
+		h := md5.New()
+		n, err := io.Copy(h, io.NewSectionReader(ra, 0, p.Size))
+		if err != nil {
+			return nil, err
+		}
+		if n != p.Size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		copy(c.MD5[:], h.Sum(nil))
+		return c, nil
+	}
+
+	return spoolContent(func(w io.Writer) error {
+		_, err := io.Copy(w, p.File)
+		return err
+	})
+}
+
+/*
+Open prepares the content of the payload for an upload, running SMFix on it
+with the payload's options unless nofix is set. A failed fix is logged and the file is sent as it is.
+The caller must Close the content.
+*/
+func (p *Payload) Open(nofix bool) (*PayloadContent, error) {
+	c, err := openPayload(p)
+	if err != nil {
+		return nil, err
+	}
+	if nofix || !p.ShouldBeFix() {
+		p.MD5 = c.MD5Hex()
+		return c, nil
+	}
+
+	if c.Size > SMFixMaxSize {
+		log.Printf("G-Code not fixed: %s is %s, SMFix runs on files up to %s", p.Name, humanReadableSize(c.Size), humanReadableSize(SMFixMaxSize))
+		p.MD5 = c.MD5Hex()
+		return c, nil
+	}
+
+	fixed, err := spoolContent(func(w io.Writer) error {
+		return postProcess(c.Reader(), w, p.Fix)
+	})
+	if err != nil {
+		log.Printf("G-Code fix error(ignored): %s", err)
+		p.MD5 = c.MD5Hex()
+		return c, nil
+	}
+	log.Printf("G-Code fixed")
+	c.Close()
+	p.Size = fixed.Size
+	p.MD5 = fixed.MD5Hex()
+	return fixed, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// onlyReader hides the io.ReaderAt of the underlying reader
+type onlyReader struct{ r io.Reader }
+
+func (o onlyReader) Read(p []byte) (int, error) { return o.r.Read(p) }
+
+type failReader struct{ t *testing.T }
+
+func (f failReader) Read(p []byte) (int, error) {
+	f.t.Error("payload was read")
+	return 0, io.EOF
+}
+
+func TestPayloadOpen(t *testing.T) {
+	content := bytes.Repeat([]byte("G1 X1 Y1\n"), 1000)
+
+	tests := []struct {
+		name    string
+		file    io.Reader
+		spooled bool
+	}{
+		{"reader at", bytes.NewReader(content), false},
+		{"stream", onlyReader{bytes.NewReader(content)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewPayload(tt.file, "part.gcode", int64(len(content)), false).Open(true)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if c.Size != int64(len(content)) || c.MD5 != md5.Sum(content) {
+				t.Fatalf("size %d md5 %s, want %d %x", c.Size, c.MD5Hex(), len(content), md5.Sum(content))
+			}
+			if got, _ := io.ReadAll(c.Reader()); !bytes.Equal(got, content) {
+				t.Fatal("content differs")
+			}
+			chunk := make([]byte, 9)
+			if _, err := c.ReadAt(chunk, 9*500); err != nil || string(chunk) != "G1 X1 Y1\n" {
+				t.Fatalf("ReadAt = %q, %v", chunk, err)
+			}
+
+			if (len(c.tmp) > 0) != tt.spooled {
+				t.Fatalf("spooled = %v, want %v", len(c.tmp) > 0, tt.spooled)
+			}
+			var names []string
+			for _, f := range c.tmp {
+				names = append(names, f.Name())
+			}
+			c.Close()
+			for _, name := range names {
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("%s was not removed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestPayloadOpenFix(t *testing.T) {
+	gcode := "; Postprocessed by smfix\nG28\nG4 S0\nG1 X1\n"
+	p := NewPayload(onlyReader{strings.NewReader(gcode)}, "part.gcode", int64(len(gcode)), false)
+	c, err := p.Open(false)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer c.Close()
+
+	got, _ := io.ReadAll(c.Reader())
+	if strings.Contains(string(got), "G4") || !strings.Contains(string(got), "G1 X1") {
+		t.Fatalf("fixed content:\n%s", got)
+	}
+	if p.Size != int64(len(got)) || c.MD5 != md5.Sum(got) {
+		t.Fatalf("size %d md5 %s do not match the fixed content", p.Size, c.MD5Hex())
+	}
+}
+
+func TestUploadSizeLimits(t *testing.T) {
+	tests := []struct {
+		size int64
+		want error
+	}{
+		{FILE_SIZE_MAX + 1, errFileTooLarge},
+		{0, errFileEmpty},
+	}
+	for _, tt := range tests {
+		// the printer does not exist, the size is checked before anything else
+		payload := NewPayload(failReader{t}, "big.cnc", tt.size, false)
+		if err := Connector.Upload(&Printer{IP: "192.0.2.1"}, payload); !errors.Is(err, tt.want) {
+			t.Errorf("size %d: Upload error = %v, want %v", tt.size, err, tt.want)
+		}
+	}
+
+	w := &limitedWriter{w: io.Discard, n: 4}
+	if _, err := w.Write([]byte("12345")); err != errFileTooLarge {
+		t.Errorf("limitedWriter error = %v, want %v", err, errFileTooLarge)
+	}
+}
@@ -5,15 +5,137 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	// the strategies of -discover
+	DiscoverBroadcast = "broadcast"
+	DiscoverScan      = "scan"
+	DiscoverSeed      = "seed"
+	DiscoverProbe     = "probe"
+	DiscoverMDNS      = "mdns"
+
+	// the most addresses -scan takes, a /16
+	maxScanHosts = 1 << 16
+)
+
+var (
+	DiscoverPort = 20054
+
+	// comma separated strategies, scan and seed only run with addresses
+	DiscoverStrategies = DiscoverBroadcast + "," + DiscoverScan + "," + DiscoverSeed
+	// comma separated networks for scan and probe, e.g. 10.0.5.0/24
+	DiscoverScanCIDRs string
+	// comma separated printer addresses for seed and probe
+	DiscoverSeeds string
+
+	errDiscoverOptions = fmt.Errorf("%w: discovery", errUsage)
+)
+
 /* Discover discovers printers on the network. It returns a slice of
  * pointers to Printer objects. If no printers are found, it returns
  * an empty slice. If an error occurs, it returns nil.
+ *
+ * The strategies of -discover run at the same time: the broadcast on every
+ * interface, directed discover messages to every address of -scan and to the
+ * -seeds, which also get past VLANs, client isolation and VPNs, and TCP
+ * probes of the SACP and HTTP ports of the same addresses, for printers that
+ * don't answer discover messages at all, and an mDNS browse whose hosts get
+ * the discover message too. A printer found more than once is kept once,
+ * with what its discovery reply says.
  */
 func Discover(timeout time.Duration) ([]*Printer, error) {
+	strategies, err := parseDiscoverStrategies(DiscoverStrategies)
+	if err != nil {
+		return []*Printer{}, err
+	}
+	var scanHosts, seedHosts []string
+	if strategies[DiscoverScan] || strategies[DiscoverProbe] {
+		if scanHosts, err = expandCIDRs(DiscoverScanCIDRs); err != nil {
+			return []*Printer{}, err
+		}
+	}
+	if strategies[DiscoverSeed] || strategies[DiscoverProbe] {
+		seedHosts = resolveSeeds(DiscoverSeeds)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = map[string][]*Printer{}
+	)
+	run := func(strategy string, find func() []*Printer) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found := find()
+			if Debug {
+				log.Printf("-- Discover %s found %d printers", strategy, len(found))
+			}
+			mu.Lock()
+			results[strategy] = found
+			mu.Unlock()
+		}()
+	}
+
+	if strategies[DiscoverBroadcast] {
+		run(DiscoverBroadcast, func() []*Printer {
+			found, err := discoverBroadcast(timeout)
+			if err != nil {
+				log.Printf("Error discovering: %v", err)
+			}
+			return found
+		})
+	}
+	if strategies[DiscoverScan] && len(scanHosts) > 0 {
+		run(DiscoverScan, func() []*Printer {
+			found, err := discoverHosts(scanHosts, timeout)
+			if err != nil {
+				log.Printf("Error scanning %s: %v", DiscoverScanCIDRs, err)
+			}
+			return found
+		})
+	}
+	if strategies[DiscoverSeed] && len(seedHosts) > 0 {
+		run(DiscoverSeed, func() []*Printer {
+			found, err := discoverHosts(seedHosts, timeout)
+			if err != nil {
+				log.Printf("Error discovering %s: %v", DiscoverSeeds, err)
+			}
+			return found
+		})
+	}
+	if strategies[DiscoverMDNS] {
+		run(DiscoverMDNS, func() []*Printer {
+			found, err := discoverMDNS(timeout)
+			if err != nil {
+				log.Printf("Error discovering over mDNS: %v", err)
+			}
+			return found
+		})
+	}
+	if probeHosts := append(append([]string{}, seedHosts...), scanHosts...); strategies[DiscoverProbe] && len(probeHosts) > 0 {
+		run(DiscoverProbe, func() []*Printer {
+			return probePrinters(probeHosts, timeout)
+		})
+	}
+	wg.Wait()
+
+	// the discovery replies first, they know the id and model
+	merged := []*Printer{}
+	for _, strategy := range []string{DiscoverBroadcast, DiscoverSeed, DiscoverMDNS, DiscoverScan, DiscoverProbe} {
+		merged = mergePrinters(merged, results[strategy])
+	}
+	return merged, nil
+}
+
+// discoverBroadcast sends the discover message to the broadcast address of
+// every interface
+func discoverBroadcast(timeout time.Duration) ([]*Printer, error) {
 	var (
 		mu = sync.Mutex{}
 		// Create a slice to hold the printers
@@ -25,80 +147,210 @@ func Discover(timeout time.Duration) ([]*Printer, error) {
 		return printers, err
 	}
 
-	discoverPrinter := func(addr string) error {
-		// Create a new UDP broadcast address
-		broadcastAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", addr, 20054))
-		if err != nil {
-			return err
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			found, err := discoverOn(net.JoinHostPort(addr, strconv.Itoa(DiscoverPort)), timeout)
+			if err != nil {
+				log.Printf("Error discovering on %s: %v", addr, err)
+			}
+			// Add the printers to the slice
+			mu.Lock()
+			printers = append(printers, found...)
+			mu.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	// Return the slice of printers
+	return printers, nil
+}
+
+// parseDiscoverStrategies reads the comma separated -discover value
+func parseDiscoverStrategies(s string) (map[string]bool, error) {
+	strategies := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		switch name = strings.ToLower(strings.TrimSpace(name)); name {
+		case "":
+		case DiscoverBroadcast, DiscoverScan, DiscoverSeed, DiscoverProbe, DiscoverMDNS:
+			strategies[name] = true
+		default:
+			return nil, fmt.Errorf("%w: unknown strategy %q, use %s, %s, %s, %s or %s", errDiscoverOptions, name,
+				DiscoverBroadcast, DiscoverScan, DiscoverSeed, DiscoverProbe, DiscoverMDNS)
+		}
+	}
+	return strategies, nil
+}
+
+/*
+expandCIDRs lists the host addresses of comma separated IPv4 networks, without
+the network and broadcast address of networks bigger than a /31. A plain
+address is a network of one.
+*/
+func expandCIDRs(s string) ([]string, error) {
+	hosts := []string{}
+	seen := map[string]bool{}
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
 		}
+		if !strings.Contains(cidr, "/") {
+			cidr += "/32"
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil || n.IP.To4() == nil {
+			return nil, fmt.Errorf("%w: %q is not an IPv4 network", errDiscoverOptions, cidr)
+		}
+		ones, bits := n.Mask.Size()
+		size := uint64(1) << uint(bits-ones)
+		if size > maxScanHosts || uint64(len(hosts))+size > maxScanHosts {
+			return nil, fmt.Errorf("%w: %s has more than %d addresses", errDiscoverOptions, cidr, maxScanHosts)
+		}
+		first, last := binary.BigEndian.Uint32(n.IP.To4()), binary.BigEndian.Uint32(n.IP.To4())+uint32(size-1)
+		if size > 2 {
+			first, last = first+1, last-1
+		}
+		for a := uint64(first); a <= uint64(last); a++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, uint32(a))
+			if s := ip.String(); !seen[s] {
+				seen[s] = true
+				hosts = append(hosts, s)
+			}
+		}
+	}
+	return hosts, nil
+}
 
-		// Create a new UDP connection
-		conn, err := net.ListenUDP("udp4", nil)
+// resolveSeeds looks up the comma separated -seeds, an address that does not
+// resolve is left out
+func resolveSeeds(s string) []string {
+	hosts := []string{}
+	for _, seed := range strings.Split(s, ",") {
+		if seed = strings.TrimSpace(seed); seed == "" {
+			continue
+		}
+		if ip := net.ParseIP(seed); ip != nil {
+			hosts = append(hosts, seed)
+			continue
+		}
+		addrs, err := net.LookupIP(seed)
 		if err != nil {
-			return err
+			log.Printf("Seed %s: %v", seed, err)
+			continue
 		}
-		defer conn.Close()
+		for _, ip := range addrs {
+			if ip.To4() != nil {
+				hosts = append(hosts, ip.String())
+				break
+			}
+		}
+	}
+	return hosts
+}
 
-		if Debug {
-			log.Printf("-- Discovering on %s", broadcastAddr)
+// mergePrinters adds the printers at addresses that are not in printers yet,
+// or that are there without an id
+func mergePrinters(printers, found []*Printer) []*Printer {
+	for _, p := range found {
+		i := 0
+		for i < len(printers) && printers[i].IP != p.IP {
+			i++
+		}
+		switch {
+		case i == len(printers):
+			printers = append(printers, p)
+		case printers[i].ID == "" && p.ID != "":
+			printers[i] = p
 		}
+	}
+	return printers
+}
 
-		// Set a timeout for the connection
-		conn.SetDeadline(time.Now().Add(timeout))
+// discoverOn sends the discover message to a single address, which may be a
+// broadcast address, and collects the replies until the timeout.
+func discoverOn(addr string, timeout time.Duration) ([]*Printer, error) {
+	// Create a new UDP broadcast address
+	broadcastAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return []*Printer{}, err
+	}
+	return discoverTo([]*net.UDPAddr{broadcastAddr}, timeout)
+}
 
-		// Send the discover message
-		_, err = conn.WriteTo([]byte("discover"), broadcastAddr)
-		if err != nil {
-			return err
+// discoverHosts sends the discover message to every host directly
+func discoverHosts(hosts []string, timeout time.Duration) ([]*Printer, error) {
+	addrs := make([]*net.UDPAddr, 0, len(hosts))
+	for _, host := range hosts {
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			addrs = append(addrs, &net.UDPAddr{IP: ip, Port: DiscoverPort})
 		}
+	}
+	return discoverTo(addrs, timeout)
+}
 
-		// Create a buffer to hold the response
-		buf := make([]byte, 1500)
-
-		// Loop until the timeout is reached
-		for {
-			// Read the response
-			n, _, err := conn.ReadFromUDP(buf)
-			if err != nil {
-				// If the error is a timeout, break out of the loop
-				if err, ok := err.(net.Error); ok && err.Timeout() {
-					break
-				}
-				return err
-			}
+// discoverTo sends the discover message to the addresses from one socket and
+// collects the replies until the timeout
+func discoverTo(addrs []*net.UDPAddr, timeout time.Duration) ([]*Printer, error) {
+	printers := []*Printer{}
 
-			if Debug {
-				log.Printf("-- Discover got %d bytes %s", n, buf[:n])
-			}
+	// Create a new UDP connection
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return printers, err
+	}
+	defer conn.Close()
 
-			// Parse the response into a Printer object
-			printer, err := NewPrinter(buf[:n])
-			if err != nil {
-				continue
-			}
+	// Set a timeout for the connection
+	conn.SetDeadline(time.Now().Add(timeout))
 
-			// Add the printer to the slice
-			mu.Lock()
-			printers = append(printers, printer)
-			mu.Unlock()
+	// Send the discover message, a scan is paced a little so that the
+	// replies don't overflow the socket buffer
+	for i, addr := range addrs {
+		if Debug && len(addrs) == 1 {
+			log.Printf("-- Discovering on %s", addr)
+		}
+		if _, err = conn.WriteTo([]byte("discover"), addr); err != nil && len(addrs) == 1 {
+			return printers, err
 		}
-		return nil
+		if i%64 == 63 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if Debug && len(addrs) > 1 {
+		log.Printf("-- Discovering on %d addresses", len(addrs))
 	}
 
-	var wg sync.WaitGroup
-	for _, addr := range addrs {
-		wg.Add(1)
-		go func(addr string) {
-			defer wg.Done()
-			err := discoverPrinter(addr)
-			if err != nil {
-				log.Printf("Error discovering on %s: %v", addr, err)
+	// Create a buffer to hold the response
+	buf := make([]byte, 1500)
+
+	// Loop until the timeout is reached
+	for {
+		// Read the response
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// If the error is a timeout, break out of the loop
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				break
 			}
-		}(addr)
-	}
-	wg.Wait()
+			return printers, err
+		}
 
-	// Return the slice of printers
+		if Debug {
+			log.Printf("-- Discover got %d bytes %s", n, buf[:n])
+		}
+
+		// Parse the response into a Printer object
+		printer, err := NewPrinter(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		// Add the printer to the slice
+		printers = mergePrinters(printers, []*Printer{printer})
+	}
 	return printers, nil
 }
 
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+var (
+	// comma separated DNS-SD service types the mdns strategy browses for
+	DiscoverMDNSServices = "_http._tcp"
+
+	// where the browse queries go, the mDNS group but in tests
+	mdnsBrowseAddr = mdnsGroup
+)
+
+/*
+discoverMDNS finds printers through mDNS, which reflectors carry between
+networks the discover broadcast does not reach. It asks for the services of
+-mdns-services from a port of its own, so the responders answer it directly
+(RFC 6762 6.7), and sends the discover message to every host that answered:
+only the printers among them reply. Half the timeout goes to each step.
+*/
+func discoverMDNS(timeout time.Duration) ([]*Printer, error) {
+	hosts, err := mdnsBrowse(DiscoverMDNSServices, timeout/2)
+	if err != nil || len(hosts) == 0 {
+		return []*Printer{}, err
+	}
+	if Debug {
+		log.Printf("-- mDNS found hosts %s", strings.Join(hosts, ", "))
+	}
+	return discoverHosts(hosts, timeout/2)
+}
+
+// mdnsBrowse asks for PTR records of the services on every multicast
+// interface and returns the addresses of the hosts that answer
+func mdnsBrowse(services string, timeout time.Duration) ([]string, error) {
+	msg := dnsmessage.Message{}
+	for _, s := range strings.Split(services, ",") {
+		if s = strings.Trim(strings.TrimSpace(s), "."); s == "" {
+			continue
+		}
+		name, err := dnsmessage.NewName(s + ".local.")
+		if err != nil {
+			return nil, err
+		}
+		msg.Questions = append(msg.Questions, dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET})
+	}
+	if len(msg.Questions) == 0 {
+		return nil, nil
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	pc := ipv4.NewPacketConn(conn)
+	ifaces := mdnsInterfaces()
+	if len(ifaces) == 0 {
+		conn.WriteTo(query, mdnsBrowseAddr)
+	}
+	for _, iface := range ifaces {
+		iface := iface
+		if err := pc.SetMulticastInterface(&iface); err != nil {
+			continue
+		}
+		if _, err := pc.WriteTo(query, nil, mdnsBrowseAddr); err != nil && Debug {
+			log.Printf("-- mDNS browse on %s: %v", iface.Name, err)
+		}
+	}
+
+	hosts := []string{}
+	seen := map[string]bool{}
+	add := func(ip net.IP) {
+		if ip = ip.To4(); ip != nil && !seen[ip.String()] {
+			seen[ip.String()] = true
+			hosts = append(hosts, ip.String())
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// the deadline ends the browse
+			return hosts, nil
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(buf[:n]); err != nil || !resp.Response || !mdnsAnswers(&resp, msg.Questions) {
+			continue
+		}
+		// the addresses the answer carries, the responder's own without them
+		found := false
+		for _, r := range append(resp.Answers, resp.Additionals...) {
+			if a, ok := r.Body.(*dnsmessage.AResource); ok {
+				add(net.IP(a.A[:]))
+				found = true
+			}
+		}
+		if !found {
+			add(src.IP)
+		}
+	}
+}
+
+// mdnsAnswers tells whether resp has a PTR record for one of the questions
+func mdnsAnswers(resp *dnsmessage.Message, questions []dnsmessage.Question) bool {
+	for _, r := range resp.Answers {
+		if r.Header.Type != dnsmessage.TypePTR {
+			continue
+		}
+		for _, q := range questions {
+			if strings.EqualFold(r.Header.Name.String(), q.Name.String()) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how many addresses are probed at the same time
+	probeWorkers = 256
+	// how long a probe waits for a port to open
+	probeDialTimeout = time.Second
+)
+
+/*
+probePrinters knocks on the SACP and HTTP ports of the hosts and returns the
+ones that answer like a Snapmaker: a SACP hello on 8888, or the HTTP API on
+8080. They are only known by address and protocol, the id and model come
+with the first connection. Probing stops at the timeout.
+*/
+func probePrinters(hosts []string, timeout time.Duration) []*Printer {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		printers = []*Printer{}
+		queue    = make(chan string)
+	)
+	workers := probeWorkers
+	if len(hosts) < workers {
+		workers = len(hosts)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range queue {
+				if p := probePrinter(ctx, host); p != nil {
+					if Debug {
+						log.Printf("-- Probe found a printer at %s, SACP %v", host, p.Sacp)
+					}
+					mu.Lock()
+					printers = append(printers, p)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+feed:
+	for _, host := range hosts {
+		select {
+		case queue <- host:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return printers
+}
+
+// probePrinter tells which protocol the printer at host talks, nil when it
+// is not a printer
+func probePrinter(ctx context.Context, host string) *Printer {
+	if portOpen(ctx, host, SACPPort) {
+		if client, err := SACP_connect(host, probeDialTimeout); err == nil {
+			SACP_disconnect(client, probeDialTimeout)
+			client.Close()
+			return &Printer{IP: host, Sacp: true}
+		}
+	}
+	if portOpen(ctx, host, HTTPPort) && probeHTTP(ctx, host) {
+		return &Printer{IP: host}
+	}
+	return nil
+}
+
+func portOpen(ctx context.Context, host, port string) bool {
+	d := net.Dialer{Timeout: probeDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp4", net.JoinHostPort(host, port))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+/*
+probeHTTP asks for the status without a token. The printer answers with its
+status JSON when it still knows the client, or says 401 without a
+WWW-Authenticate challenge: the token is a query parameter, not an HTTP
+login. A 401 only counts when a path the API does not have is not one too,
+which sorts out servers that want a login for everything. /connect is left
+alone, it asks for approval on the touchscreen.
+*/
+func probeHTTP(ctx context.Context, host string) bool {
+	ctx, cancel := context.WithTimeout(ctx, probeDialTimeout)
+	defer cancel()
+	base := "http://" + net.JoinHostPort(host, HTTPPort) + "/api/v1/"
+	resp, err := probeGet(ctx, base+"status")
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		if resp.Header.Get("WWW-Authenticate") != "" {
+			return false
+		}
+		other, err := probeGet(ctx, base+"sm2uploader-probe")
+		if err != nil {
+			return false
+		}
+		other.Body.Close()
+		return other.StatusCode != http.StatusUnauthorized
+	case http.StatusOK:
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			return false
+		}
+		var st httpStatus
+		err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&st)
+		return err == nil && st.Status != ""
+	}
+	return false
+}
+
+func probeGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
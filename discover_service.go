@@ -0,0 +1,261 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// the events of the discovery service
+	PrinterAppeared    = "appeared"
+	PrinterDisappeared = "disappeared"
+	PrinterMoved       = "moved"
+
+	// a printer is gone after missing this many rounds, one lost broadcast
+	// reply is not enough
+	disappearAfter = 2
+	// a printer that does not answer is looked for again at most this often
+	resolveInterval = 30 * time.Second
+)
+
+var (
+	// how often the long running modes discover the printers again, 0 never
+	RediscoverInterval time.Duration
+
+	// the running discovery service, the connector asks it when a printer
+	// does not answer
+	activeDiscovery   *discoveryService
+	activeDiscoveryMu sync.Mutex
+)
+
+// PrinterChange is what a discovery round found different
+type PrinterChange struct {
+	Kind    string
+	Printer *Printer
+	// the address the printer had before it moved or disappeared
+	From string
+}
+
+/*
+discoveryService runs Discover every interval while the OctoPrint server,
+the watch folders or the queue run, so that a printer that got a new DHCP
+lease keeps getting uploads. The printers of the known hosts are updated in
+place, which also updates the printers the running mode holds, and saved.
+*/
+type discoveryService struct {
+	ls       *LocalStorage
+	interval time.Duration
+	discover func(time.Duration) ([]*Printer, error)
+	report   func(PrinterChange)
+
+	mu sync.Mutex
+	// ids seen in the last rounds, and how many rounds they missed since
+	present map[string]int
+	first   bool
+
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newDiscoveryService(ls *LocalStorage, interval time.Duration) *discoveryService {
+	return &discoveryService{
+		ls:       ls,
+		interval: interval,
+		discover: Discover,
+		report:   reportPrinterChange,
+		present:  map[string]int{},
+		first:    true,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// startDiscoveryService discovers the printers of ls every interval until
+// Close, nil when interval is 0
+func startDiscoveryService(ls *LocalStorage, interval time.Duration) *discoveryService {
+	if interval <= 0 {
+		return nil
+	}
+	d := newDiscoveryService(ls, interval)
+	activeDiscoveryMu.Lock()
+	activeDiscovery = d
+	activeDiscoveryMu.Unlock()
+	onInterrupt(d.Close)
+
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			d.round()
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	log.Printf("Discovering printers again every %s", interval)
+	return d
+}
+
+// Close stops the rounds and waits for the running one
+func (d *discoveryService) Close() {
+	if d == nil {
+		return
+	}
+	d.closeOnce.Do(func() {
+		activeDiscoveryMu.Lock()
+		if activeDiscovery == d {
+			activeDiscovery = nil
+		}
+		activeDiscoveryMu.Unlock()
+		close(d.stop)
+		<-d.done
+	})
+}
+
+// round discovers once, updates the known hosts and reports the changes
+func (d *discoveryService) round() []*Printer {
+	found, err := d.discover(DiscoverTimeout)
+	if err != nil {
+		log.Printf("Discover: %v", err)
+		return nil
+	}
+
+	d.mu.Lock()
+	changes := d.update(found)
+	if len(changes) > 0 {
+		if err := d.ls.Save(); err != nil {
+			log.Printf("Discover: %v", err)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, c := range changes {
+		d.report(c)
+	}
+	return found
+}
+
+/*
+update adds what a round found to the known hosts and tells what changed.
+The first round only knows what was there; printers that come later appeared.
+*/
+func (d *discoveryService) update(found []*Printer) []PrinterChange {
+	changes := []PrinterChange{}
+	seen := map[string]bool{}
+	for _, p := range found {
+		if p.ID == "" || seen[p.ID] {
+			continue
+		}
+		seen[p.ID] = true
+		if known := d.ls.Find(p.ID); known != nil && known.Addr() != p.IP {
+			changes = append(changes, PrinterChange{Kind: PrinterMoved, Printer: known, From: known.Addr()})
+		} else if _, ok := d.present[p.ID]; !ok && !d.first {
+			changes = append(changes, PrinterChange{Kind: PrinterAppeared, Printer: p})
+		}
+		d.present[p.ID] = 0
+	}
+	d.ls.Add(found...)
+	d.first = false
+
+	missing := []string{}
+	for id := range d.present {
+		if !seen[id] {
+			missing = append(missing, id)
+		}
+	}
+	sort.Strings(missing)
+	for _, id := range missing {
+		if d.present[id]++; d.present[id] < disappearAfter {
+			continue
+		}
+		delete(d.present, id)
+		p := d.ls.Find(id)
+		if p == nil {
+			p = &Printer{ID: id}
+		}
+		changes = append(changes, PrinterChange{Kind: PrinterDisappeared, Printer: p, From: p.Addr()})
+	}
+
+	// the printers that moved are updated by now
+	for i, c := range changes {
+		if c.Kind != PrinterDisappeared {
+			changes[i].Printer = d.ls.Find(c.Printer.ID)
+		}
+	}
+	return changes
+}
+
+func reportPrinterChange(c PrinterChange) {
+	switch c.Kind {
+	case PrinterAppeared:
+		log.Printf("Printer %s appeared at %s", c.Printer.Name(), c.Printer.Addr())
+	case PrinterDisappeared:
+		log.Printf("Printer %s disappeared from %s", c.Printer.Name(), c.From)
+	case PrinterMoved:
+		log.Printf("Printer %s moved from %s to %s", c.Printer.Name(), c.From, c.Printer.Addr())
+	}
+	emit(Event{Event: c.Kind, Printer: c.Printer, From: c.From})
+}
+
+var (
+	resolveMu   sync.Mutex
+	lastResolve = map[string]time.Time{}
+)
+
+/*
+resolvePrinter looks for a printer that does not answer at its address by
+its id, through the discovery service when it runs, and moves it to where it
+is now. It tells whether the address changed. A printer is looked for at most
+every resolveInterval, a printer that is off does not hold every upload up.
+*/
+func resolvePrinter(printer *Printer) bool {
+	if printer.ID == "" {
+		return false
+	}
+	resolveMu.Lock()
+	if last, ok := lastResolve[printer.ID]; ok && time.Since(last) < resolveInterval {
+		resolveMu.Unlock()
+		return false
+	}
+	lastResolve[printer.ID] = time.Now()
+	resolveMu.Unlock()
+
+	from := printer.Addr()
+	log.Printf("%s does not answer at %s, looking for it ...", printer.Name(), from)
+	activeDiscoveryMu.Lock()
+	d := activeDiscovery
+	activeDiscoveryMu.Unlock()
+
+	var found []*Printer
+	if d != nil {
+		// updates the known hosts, which may be this very printer
+		found = d.round()
+	} else {
+		var err error
+		if found, err = Discover(DiscoverTimeout); err != nil {
+			log.Printf("Discover: %v", err)
+		}
+	}
+	for _, p := range found {
+		if p.ID != printer.ID || p.IP == from {
+			continue
+		}
+		printersMu.Lock()
+		moved := printer.IP == from
+		if moved {
+			printer.IP = p.IP
+		}
+		printersMu.Unlock()
+		if moved {
+			reportPrinterChange(PrinterChange{Kind: PrinterMoved, Printer: printer, From: from})
+		}
+		return true
+	}
+	return false
+}
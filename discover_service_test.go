@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryServiceChanges(t *testing.T) {
+	ls := NewLocalStorage(filepath.Join(t.TempDir(), "hosts.yaml"))
+	ls.Add(&Printer{ID: "J1A", IP: "10.0.5.20"}, &Printer{ID: "J1B", IP: "10.0.5.21"})
+	held := ls.Find("J1A")
+
+	d := newDiscoveryService(ls, time.Minute)
+	rounds := [][]*Printer{
+		{{ID: "J1A", IP: "10.0.5.30"}},
+		{},
+		{{ID: "J1C", IP: "10.0.5.22"}},
+		{{ID: "J1C", IP: "10.0.5.22"}, {ID: "J1A", IP: "10.0.5.30"}},
+	}
+	want := []string{
+		"moved J1A 10.0.5.20 -> 10.0.5.30",
+		"",
+		"appeared J1C 10.0.5.22; disappeared J1A 10.0.5.30 -> 10.0.5.30",
+		"appeared J1A 10.0.5.30",
+	}
+	for i, found := range rounds {
+		got := ""
+		for _, c := range d.update(found) {
+			if got != "" {
+				got += "; "
+			}
+			if c.From != "" {
+				got += fmt.Sprintf("%s %s %s -> %s", c.Kind, c.Printer.ID, c.From, c.Printer.IP)
+			} else {
+				got += fmt.Sprintf("%s %s %s", c.Kind, c.Printer.ID, c.Printer.IP)
+			}
+		}
+		if got != want[i] {
+			t.Errorf("round %d: %q, want %q", i+1, got, want[i])
+		}
+	}
+	// the printer a running mode holds moved along
+	if held.IP != "10.0.5.30" {
+		t.Errorf("held printer is at %s", held.IP)
+	}
+}
+
+func TestConnectorResolvesMovedPrinter(t *testing.T) {
+	fp := NewFakePrinter("MOVED1", "Snapmaker J1", true)
+	addr, err := fp.ListenSACP("127.0.0.2:0")
+	if err != nil {
+		t.Skipf("no 127.0.0.2: %v", err)
+	}
+	defer fp.Close()
+	origSACP := SACPPort
+	SACPPort = strconv.Itoa(addr.(*net.TCPAddr).Port)
+	defer func() { SACPPort = origSACP }()
+
+	printer := &Printer{ID: "MOVED1", IP: "127.0.0.3", Sacp: true}
+	ls := NewLocalStorage(filepath.Join(t.TempDir(), "hosts.yaml"))
+	ls.Add(printer)
+	d := newDiscoveryService(ls, time.Minute)
+	d.discover = func(time.Duration) ([]*Printer, error) {
+		return []*Printer{{ID: "MOVED1", IP: "127.0.0.2", Model: "Snapmaker J1", Sacp: true}}, nil
+	}
+	changes := []PrinterChange{}
+	d.report = func(c PrinterChange) { changes = append(changes, c) }
+	activeDiscoveryMu.Lock()
+	activeDiscovery = d
+	activeDiscoveryMu.Unlock()
+	defer func() {
+		activeDiscoveryMu.Lock()
+		activeDiscovery = nil
+		activeDiscoveryMu.Unlock()
+	}()
+
+	if _, err := Connector.Status(printer); err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if printer.IP != "127.0.0.2" || len(changes) != 1 || changes[0].Kind != PrinterMoved || changes[0].From != "127.0.0.3" {
+		t.Errorf("printer at %s, changes %+v", printer.IP, changes)
+	}
+	if saved := NewLocalStorage(ls.savePath).Find("MOVED1"); saved == nil || saved.IP != "127.0.0.2" {
+		t.Errorf("known hosts have %+v", saved)
+	}
+
+	// a printer that is not found again fails at once the next time
+	gone := &Printer{ID: "GONE1", IP: "127.0.0.3", Sacp: true}
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := Connector.Status(gone); err == nil {
+			t.Fatal("status of a printer that is gone")
+		}
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("took %s", time.Since(start))
+	}
+}
+
+// run with -race: the rounds move a printer the OctoPrint server is using,
+// and save the known hosts while the HTTP connector changes the token
+func TestDiscoveryServiceWhileServing(t *testing.T) {
+	origOutput, origOut := Output, eventOut
+	Output, eventOut = OutputJSON, io.Discard
+	defer func() { Output, eventOut = origOutput, origOut }()
+
+	for _, sacp := range []bool{true, false} {
+		fp, fake := startFakePrinter(t, sacp)
+		ls := NewLocalStorage(filepath.Join(t.TempDir(), "hosts.yaml"))
+		ls.Add(fake, &Printer{ID: "J1B", IP: "192.0.2.2"})
+		rt := newOctoPrintRouter([]*Printer{ls.Find("FAKE1"), ls.Find("J1B")})
+
+		d := newDiscoveryService(ls, time.Minute)
+		n := 0
+		d.discover = func(time.Duration) ([]*Printer, error) {
+			n++
+			return []*Printer{
+				{ID: "FAKE1", IP: "127.0.0.1", Model: "Snapmaker J1", Sacp: sacp, Status: StateIdle, Fields: map[string]string{"status": StateIdle}},
+				{ID: "J1B", IP: fmt.Sprintf("192.0.2.%d", 2+n%2), Model: "Snapmaker J1", Status: StateRunning, Fields: map[string]string{"status": StateRunning}},
+			}, nil
+		}
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					d.round()
+				}
+			}
+		}()
+
+		for i := 0; i < 5; i++ {
+			for _, path := range []string{"/", "/printer/J1B/", "/printer/192.0.2.3/"} {
+				rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+			}
+			body := &bytes.Buffer{}
+			mw := multipart.NewWriter(body)
+			fw, _ := mw.CreateFormFile("file", "race.gcode")
+			fw.Write([]byte("G28\nG1 X1\n"))
+			mw.Close()
+			r := httptest.NewRequest(http.MethodPost, "/printer/FAKE1/api/files/local", body)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			rec := httptest.NewRecorder()
+			rt.ServeHTTP(rec, r)
+			if rec.Code != http.StatusOK {
+				t.Errorf("sacp %v: upload = %d %s", sacp, rec.Code, rec.Body)
+			}
+		}
+		close(stop)
+		<-done
+		if _, ok := fp.File("race.gcode"); !ok {
+			t.Errorf("sacp %v: the printer did not get the uploads", sacp)
+		}
+	}
+}
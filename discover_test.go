@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandCIDRs(t *testing.T) {
+	hosts, err := expandCIDRs("10.0.5.0/30, 10.0.6.7,10.0.5.1/32,10.0.7.0/31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(hosts, " "); got != "10.0.5.1 10.0.5.2 10.0.6.7 10.0.7.0 10.0.7.1" {
+		t.Errorf("hosts = %s", got)
+	}
+	for _, bad := range []string{"10.0.0.0/8", "printer", "fe80::/64"} {
+		if _, err := expandCIDRs(bad); !errors.Is(err, errUsage) {
+			t.Errorf("expandCIDRs(%q) = %v", bad, err)
+		}
+	}
+	if _, err := parseDiscoverStrategies("broadcast,bonjour"); !errors.Is(err, errUsage) {
+		t.Errorf("unknown strategy: %v", err)
+	}
+}
+
+func TestMergePrinters(t *testing.T) {
+	probed := &Printer{IP: "10.0.5.20", Sacp: true}
+	replied := &Printer{IP: "10.0.5.20", ID: "J1V19", Model: "Snapmaker J1", Sacp: true}
+	other := &Printer{IP: "10.0.5.21"}
+	merged := mergePrinters(mergePrinters(nil, []*Printer{probed, other}), []*Printer{replied, probed})
+	if len(merged) != 2 || merged[0] != replied || merged[1] != other {
+		t.Errorf("merged = %v", merged)
+	}
+}
+
+// withDiscoverOptions sets the discovery options for one test
+func withDiscoverOptions(t *testing.T, strategies, scan, seeds string) {
+	orig := []string{DiscoverStrategies, DiscoverScanCIDRs, DiscoverSeeds}
+	origPorts := []string{SACPPort, HTTPPort}
+	origDiscover := DiscoverPort
+	DiscoverStrategies, DiscoverScanCIDRs, DiscoverSeeds = strategies, scan, seeds
+	t.Cleanup(func() {
+		DiscoverStrategies, DiscoverScanCIDRs, DiscoverSeeds = orig[0], orig[1], orig[2]
+		SACPPort, HTTPPort = origPorts[0], origPorts[1]
+		DiscoverPort = origDiscover
+	})
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
+
+func TestDiscoverSeedAndScan(t *testing.T) {
+	fp := NewFakePrinter("FAKE1", "Snapmaker J1", true)
+	addr, err := fp.ListenDiscovery("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	for _, opts := range [][3]string{
+		{DiscoverSeed, "", "localhost"},
+		{DiscoverScan, "127.0.0.1/32", ""},
+	} {
+		withDiscoverOptions(t, opts[0], opts[1], opts[2])
+		DiscoverPort, _ = strconv.Atoi(portOf(addr))
+		printers, err := Discover(200 * time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(printers) != 1 || printers[0].ID != "FAKE1" || printers[0].IP != "127.0.0.1" {
+			t.Errorf("%s found %v", opts[0], printers)
+		}
+	}
+}
+
+func TestDiscoverProbe(t *testing.T) {
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := portOf(closed.Addr())
+	closed.Close()
+
+	for _, sacp := range []bool{true, false} {
+		fp := NewFakePrinter("FAKE1", "Snapmaker 2 Model A350", sacp)
+		var (
+			addr net.Addr
+			err  error
+		)
+		withDiscoverOptions(t, DiscoverProbe, "", "127.0.0.1")
+		SACPPort, HTTPPort = closedPort, closedPort
+		if sacp {
+			addr, err = fp.ListenSACP("127.0.0.1:0")
+			SACPPort = portOf(addr)
+		} else {
+			addr, err = fp.ListenHTTP("127.0.0.1:0")
+			HTTPPort = portOf(addr)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		printers, err := Discover(time.Second)
+		fp.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(printers) != 1 || printers[0].IP != "127.0.0.1" || printers[0].Sacp != sacp {
+			t.Errorf("sacp %v: probe found %v", sacp, printers)
+		}
+	}
+}
+
+func TestProbeHTTPNeedsSnapmaker(t *testing.T) {
+	origPort := HTTPPort
+	defer func() { HTTPPort = origPort }()
+	for name, handler := range map[string]http.HandlerFunc{
+		"basic auth": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="router"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		},
+		"login wall": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		},
+		"other json": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"version":"1.0"}`))
+		},
+	} {
+		srv := httptest.NewServer(handler)
+		HTTPPort = portOf(srv.Listener.Addr())
+		if probeHTTP(context.Background(), "127.0.0.1") {
+			t.Errorf("%s taken for a printer", name)
+		}
+		srv.Close()
+	}
+}
+
+func TestDiscoverMDNS(t *testing.T) {
+	fp := NewFakePrinter("FAKE1", "Snapmaker J1", true)
+	addr, err := fp.ListenDiscovery("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	// a responder that has a service on the printer's address
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := newMDNSResponder([]*mdnsService{{Instance: "FAKE1", Port: 80}}, nil)
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if resp, _ := m.reply(buf[:n], src, []net.IP{net.IPv4(127, 0, 0, 1)}); resp != nil {
+				conn.WriteToUDP(resp, src)
+			}
+		}
+	}()
+
+	withDiscoverOptions(t, DiscoverMDNS, "", "")
+	origServices, origAddr := DiscoverMDNSServices, mdnsBrowseAddr
+	DiscoverMDNSServices, mdnsBrowseAddr = mdnsServiceType, conn.LocalAddr().(*net.UDPAddr)
+	defer func() { DiscoverMDNSServices, mdnsBrowseAddr = origServices, origAddr }()
+	DiscoverPort, _ = strconv.Atoi(portOf(addr))
+
+	printers, err := Discover(400 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(printers) != 1 || printers[0].ID != "FAKE1" || printers[0].IP != "127.0.0.1" {
+		t.Errorf("mdns found %v", printers)
+	}
+}
@@ -13,13 +13,26 @@ var (
 
 func flag_usage() {
 	ex, _ := os.Executable()
-	usage := `%s [options] file1.gcode file2.nc ...
+	usage := `%s [global options] <command> [options] [args]
+%s [options] file1.gcode file2.nc ...
 
 %s <https://github.com/macdylan/sm2uploader>
 
-Options:
+%s
+
+Commands:
 `
-	fmt.Printf(usage, filepath.Base(ex), Version)
+	name := filepath.Base(ex)
+	fmt.Printf(usage, name, name, Version, fixDefaultsUsage())
+	for _, c := range commands {
+		fmt.Printf("  %-10s%s\n", c.Name, c.Help)
+	}
+	fmt.Printf(`
+Global options: -host, -knownhosts, -timeout, -debug, -output
+Run '%s help <command>' for the options of a command.
+
+Options of the form without a command:
+`, name)
 	flag.PrintDefaults()
 	os.Exit(1)
 }
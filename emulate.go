@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+type emulatedModel struct {
+	Model string
+	Sacp  bool
+}
+
+// models that -emulate knows, as they answer discovery
+var emulatedModels = map[string]emulatedModel{
+	"J1":      {"Snapmaker J1", true},
+	"ARTISAN": {"Snapmaker Artisan", true},
+	"A150":    {"Snapmaker 2 Model A150", false},
+	"A250":    {"Snapmaker 2 Model A250", false},
+	"A350":    {"Snapmaker 2 Model A350", false},
+}
+
+// EmulatorOptions configure a virtual printer
+type EmulatorOptions struct {
+	Name     string // one of emulatedModels
+	ID       string
+	Model    string // overrides the model: of the preset
+	Protocol string // "sacp" or "http", overrides the preset
+	Dir      string
+	Speed    float64 // lines per second of a simulated job
+}
+
+// NewEmulator builds a FakePrinter that looks like the requested model
+func NewEmulator(opts EmulatorOptions) (*FakePrinter, error) {
+	preset, ok := emulatedModels[strings.ToUpper(opts.Name)]
+	if !ok {
+		if opts.Model == "" {
+			names := make([]string, 0, len(emulatedModels))
+			for name := range emulatedModels {
+				names = append(names, name)
+			}
+			return nil, fmt.Errorf("unknown printer %q, use -emulate-model or one of %s", opts.Name, strings.Join(names, ", "))
+		}
+		preset = emulatedModel{Sacp: true}
+	}
+	if opts.Model != "" {
+		preset.Model = opts.Model
+	}
+	switch strings.ToLower(opts.Protocol) {
+	case "":
+	case "sacp":
+		preset.Sacp = true
+	case "http":
+		preset.Sacp = false
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", opts.Protocol)
+	}
+
+	id := opts.ID
+	if id == "" {
+		id = strings.ToUpper(opts.Name) + "-EMU"
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	fp := NewFakePrinter(id, preset.Model, preset.Sacp)
+	fp.Dir = opts.Dir
+	fp.LinesPerSecond = opts.Speed
+	return fp, nil
+}
+
+// startEmulator runs a virtual printer on all interfaces until it is
+// interrupted.
+func startEmulator(opts EmulatorOptions) error {
+	fp, err := NewEmulator(opts)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	var addr net.Addr
+	if fp.Sacp {
+		addr, err = fp.ListenSACP(":" + SACPPort)
+	} else {
+		addr, err = fp.ListenHTTP(":" + HTTPPort)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := fp.ListenDiscovery(fmt.Sprintf(":%d", DiscoverPort)); err != nil {
+		return err
+	}
+
+	protocol := "HTTP"
+	if fp.Sacp {
+		protocol = "SACP"
+	}
+	log.Printf("Emulating %s (%s) as %s on %s, files go to %s", fp.Model, protocol, fp.ID, addr, fp.Dir)
+
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	sig := <-sc
+	log.Printf("Received signal: %s", sig)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewEmulator(t *testing.T) {
+	tests := []struct {
+		opts    EmulatorOptions
+		model   string
+		sacp    bool
+		wantErr bool
+	}{
+		{EmulatorOptions{Name: "j1"}, "Snapmaker J1", true, false},
+		{EmulatorOptions{Name: "A350"}, "Snapmaker 2 Model A350", false, false},
+		{EmulatorOptions{Name: "A350", Protocol: "sacp"}, "Snapmaker 2 Model A350", true, false},
+		{EmulatorOptions{Name: "custom", Model: "My Printer"}, "My Printer", true, false},
+		{EmulatorOptions{Name: "custom"}, "", false, true},
+		{EmulatorOptions{Name: "J1", Protocol: "usb"}, "", false, true},
+	}
+	for _, tt := range tests {
+		tt.opts.Dir = t.TempDir()
+		fp, err := NewEmulator(tt.opts)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%+v: expected error", tt.opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: %v", tt.opts, err)
+		}
+		if fp.Model != tt.model || fp.Sacp != tt.sacp {
+			t.Errorf("%+v: got %s sacp=%v", tt.opts, fp.Model, fp.Sacp)
+		}
+	}
+}
+
+func TestEmulatorSimulatesJob(t *testing.T) {
+	dir := t.TempDir()
+	fp, err := NewEmulator(EmulatorOptions{Name: "J1", Dir: dir, Speed: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte("G1 X1\n"), 100)
+	if err := fp.storeFile("../job.gcode", content); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "job.gcode")); err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("file not stored in %s: %v", dir, err)
+	}
+
+	fp.setTarget(0, 30)
+	if !fp.startJob("job.gcode") {
+		t.Fatal("job didn't start")
+	}
+	if st := fp.Status(); st.State != StateRunning || st.File != "job.gcode" {
+		t.Fatalf("status = %+v", st)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	st := fp.Status()
+	if st.State != StateCompleted || st.Progress != 1 {
+		t.Fatalf("status after the job = %+v", st)
+	}
+	if st.Nozzles[0].Current <= fakeAmbient {
+		t.Fatalf("nozzle didn't heat up: %+v", st.Nozzles[0])
+	}
+}
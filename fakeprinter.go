@@ -0,0 +1,937 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+FakePrinter is an in-process Snapmaker. It speaks the printer side of SACP,
+the HTTP API and the discovery reply, so that the connectors can be exercised
+without a real machine. Each protocol listens on its own address.
+*/
+type FakePrinter struct {
+	ID    string
+	Model string
+	Sacp  bool
+	// IP reported in the discovery reply, the address facing the asker if empty
+	IP string
+	// Dir keeps the received files on disk instead of in memory
+	Dir string
+	// LinesPerSecond is how fast a job runs, jobs never finish when it is 0
+	LinesPerSecond float64
+
+	mu      sync.Mutex
+	faults  FakeFaults
+	files   map[string][]byte
+	state   string
+	nozzles []Temperature
+	bed     Temperature
+	job     *fakeJob
+	updated time.Time
+	// unfinished uploads by MD5, a new handshake for the same file resumes them
+	partial  map[string]*fakeUpload
+	received int
+
+	token   string
+	closers map[io.Closer]empty
+	wg      sync.WaitGroup
+}
+
+// FakeFaults are the failures a FakePrinter can be told to produce
+type FakeFaults struct {
+	// chunks to throw away after receiving them, the printer asks for them again
+	DropChunks int
+	// report a checksum mismatch at the end of every SACP upload
+	BadMD5 bool
+	// answer HTTP connections as if No was tapped on the touchscreen
+	DenyAuth bool
+	// drop the SACP connection once this many chunks arrived
+	DisconnectAfterChunks int
+}
+
+type fakeJob struct {
+	name     string
+	lines    uint32
+	start    time.Time // zero until the job is started
+	paused   time.Duration
+	pausedAt time.Time
+}
+
+func (j *fakeJob) elapsed(now time.Time) time.Duration {
+	if j.start.IsZero() {
+		return 0
+	}
+	if !j.pausedAt.IsZero() {
+		now = j.pausedAt
+	}
+	return now.Sub(j.start) - j.paused
+}
+
+const (
+	fakeAmbient     = 25.0 // °C
+	fakeHeatingRate = 5.0  // °C per second
+)
+
+func NewFakePrinter(id, model string, sacp bool) *FakePrinter {
+	return &FakePrinter{
+		ID:      id,
+		Model:   model,
+		Sacp:    sacp,
+		files:   map[string][]byte{},
+		closers: map[io.Closer]empty{},
+		partial: map[string]*fakeUpload{},
+		state:   StateIdle,
+		nozzles: []Temperature{{Current: fakeAmbient}, {Current: fakeAmbient}},
+		bed:     Temperature{Current: fakeAmbient},
+		updated: time.Now(),
+	}
+}
+
+func (f *FakePrinter) SetFaults(faults FakeFaults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = faults
+}
+
+func (f *FakePrinter) Faults() FakeFaults {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.faults
+}
+
+// fakeFileName keeps received files inside Dir
+func fakeFileName(name string) string {
+	return filepath.Base(normalizedFilename(name))
+}
+
+// File returns a file the printer received
+func (f *FakePrinter) File(name string) ([]byte, bool) {
+	name = fakeFileName(name)
+	if f.Dir != "" {
+		b, err := os.ReadFile(filepath.Join(f.Dir, name))
+		return b, err == nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.files[name]
+	return b, ok
+}
+
+// Files returns the names of all files the printer received
+func (f *FakePrinter) Files() []string {
+	names := []string{}
+	if f.Dir != "" {
+		entries, _ := os.ReadDir(f.Dir)
+		for _, e := range entries {
+			if !e.IsDir() {
+				names = append(names, e.Name())
+			}
+		}
+		return names
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name := range f.files {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (f *FakePrinter) storeFile(name string, content []byte) error {
+	name = fakeFileName(name)
+	if f.Dir != "" {
+		return os.WriteFile(filepath.Join(f.Dir, name), content, 0644)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[name] = content
+	return nil
+}
+
+// ChunksReceived counts the SACP chunks that arrived, dropped ones included
+func (f *FakePrinter) ChunksReceived() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.received
+}
+
+// resumeUpload returns the unfinished upload of the same file, or starts one
+func (f *FakePrinter) resumeUpload(u *fakeUpload) *fakeUpload {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.partial[u.md5hex]; ok && p.size == u.size && p.count == u.count {
+		p.name = u.name
+		return p
+	}
+	f.partial[u.md5hex] = u
+	return u
+}
+
+// addChunk keeps a chunk, unless the faults say to drop it, and tells
+// whether the connection should be dropped now.
+func (f *FakePrinter) addChunk(u *fakeUpload, index uint16, chunk []byte) (disconnect bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.received++
+	if f.faults.DropChunks > 0 {
+		f.faults.DropChunks--
+	} else {
+		u.chunks[index] = chunk
+	}
+	if f.faults.DisconnectAfterChunks > 0 {
+		f.faults.DisconnectAfterChunks--
+		return f.faults.DisconnectAfterChunks == 0
+	}
+	return false
+}
+
+// missingChunk returns the first chunk the upload still needs, or -1 when
+// it is complete.
+func (f *FakePrinter) missingChunk(u *fakeUpload) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := uint16(0); i < u.count; i++ {
+		if _, ok := u.chunks[i]; !ok {
+			return int(i)
+		}
+	}
+	delete(f.partial, u.md5hex)
+	return -1
+}
+
+func (f *FakePrinter) update(now time.Time) {
+	step := now.Sub(f.updated).Seconds() * fakeHeatingRate
+	f.updated = now
+
+	heat := func(t *Temperature) {
+		target := t.Target
+		if target == 0 {
+			target = fakeAmbient
+		}
+		switch {
+		case t.Current < target:
+			t.Current = math.Min(t.Current+step, target)
+		case t.Current > target:
+			t.Current = math.Max(t.Current-step, target)
+		}
+	}
+	for i := range f.nozzles {
+		heat(&f.nozzles[i])
+	}
+	heat(&f.bed)
+
+	if f.state == StateRunning && f.LinesPerSecond > 0 && f.currentLine(now) >= f.job.lines {
+		f.state = StateCompleted
+		f.job.pausedAt = now
+	}
+}
+
+// currentLine is the line the job is at, f.mu must be held
+func (f *FakePrinter) currentLine(now time.Time) uint32 {
+	if f.job == nil {
+		return 0
+	}
+	line := f.job.elapsed(now).Seconds() * f.LinesPerSecond
+	if line > float64(f.job.lines) {
+		return f.job.lines
+	}
+	return uint32(line)
+}
+
+// estimated is the time the whole job takes, f.mu must be held
+func (f *FakePrinter) estimated() time.Duration {
+	if f.job == nil || f.LinesPerSecond <= 0 {
+		return 0
+	}
+	return time.Duration(float64(f.job.lines) / f.LinesPerSecond * float64(time.Second))
+}
+
+// Status returns what the printer is doing
+func (f *FakePrinter) Status() *PrinterStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.update(now)
+
+	st := &PrinterStatus{
+		State:   f.state,
+		Nozzles: append([]Temperature{}, f.nozzles...),
+		Bed:     f.bed,
+	}
+	if f.job != nil {
+		st.File = f.job.name
+		if f.job.lines > 0 {
+			st.Progress = float64(f.currentLine(now)) / float64(f.job.lines)
+		}
+		st.Elapsed = f.job.elapsed(now).Truncate(time.Second)
+		if est := f.estimated(); est > st.Elapsed {
+			st.Remaining = (est - st.Elapsed).Truncate(time.Second)
+		}
+	}
+	return st
+}
+
+// prepareJob selects the file of the next job
+func (f *FakePrinter) prepareJob(name string) bool {
+	content, ok := f.File(name)
+	if !ok {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.update(time.Now())
+	if f.state == StateRunning || f.state == StatePaused {
+		return false
+	}
+	f.job = &fakeJob{
+		name:  fakeFileName(name),
+		lines: uint32(bytes.Count(content, []byte("\n"))),
+	}
+	return true
+}
+
+// startJob starts printing a stored file, or the prepared one if name is empty
+func (f *FakePrinter) startJob(name string) bool {
+	if name != "" && !f.prepareJob(name) {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.job == nil || !f.job.start.IsZero() {
+		return false
+	}
+	f.job.start = time.Now()
+	f.state = StateRunning
+	return true
+}
+
+func (f *FakePrinter) pauseJob() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	f.update(now)
+	if f.state != StateRunning {
+		return false
+	}
+	f.state = StatePaused
+	f.job.pausedAt = now
+	return true
+}
+
+func (f *FakePrinter) resumeJob() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	f.update(now)
+	if f.state != StatePaused {
+		return false
+	}
+	f.state = StateRunning
+	f.job.paused += now.Sub(f.job.pausedAt)
+	f.job.pausedAt = time.Time{}
+	return true
+}
+
+func (f *FakePrinter) stopJob() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	f.update(now)
+	if f.state != StateRunning && f.state != StatePaused {
+		return false
+	}
+	if f.state == StateRunning {
+		f.job.pausedAt = now
+	}
+	f.state = StateStopped
+	return true
+}
+
+func (f *FakePrinter) setTarget(nozzle int, temperature float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.update(time.Now())
+	if nozzle < 0 {
+		f.bed.Target = temperature
+	} else if nozzle < len(f.nozzles) {
+		f.nozzles[nozzle].Target = temperature
+	}
+}
+
+func (f *FakePrinter) track(c io.Closer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closers[c] = empty{}
+}
+
+func (f *FakePrinter) untrack(c io.Closer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.closers, c)
+}
+
+// Close stops every listener and connection of the printer
+func (f *FakePrinter) Close() error {
+	f.mu.Lock()
+	closers := f.closers
+	f.closers = map[io.Closer]empty{}
+	f.mu.Unlock()
+	for c := range closers {
+		c.Close()
+	}
+	f.wg.Wait()
+	return nil
+}
+
+// DiscoveryReply is the answer to a "discover" broadcast
+func (f *FakePrinter) DiscoveryReply(ip string) string {
+	reply := fmt.Sprintf("%s@%s|model:%s|status:%s", f.ID, ip, f.Model, f.Status().State)
+	if f.Sacp {
+		reply += "|SACP:1"
+	}
+	return reply
+}
+
+// ListenDiscovery answers discovery broadcasts on a UDP address
+func (f *FakePrinter) ListenDiscovery(addr string) (net.Addr, error) {
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	f.track(conn)
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) != "discover" {
+				continue
+			}
+			ip := f.IP
+			if ip == "" {
+				ip = localIPFor(from)
+			}
+			conn.WriteTo([]byte(f.DiscoveryReply(ip)), from)
+		}
+	}()
+	return conn.LocalAddr(), nil
+}
+
+// localIPFor returns the local address that faces remote
+func localIPFor(remote net.Addr) string {
+	conn, err := net.Dial("udp4", remote.String())
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// ListenSACP accepts SACP connections on a TCP address
+func (f *FakePrinter) ListenSACP(addr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	f.track(l)
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.track(conn)
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				defer f.untrack(conn)
+				s := &fakeSACPSession{
+					f:    f,
+					conn: conn,
+					subs: map[sacpTopic]bool{},
+					done: make(chan empty),
+				}
+				s.serve()
+			}()
+		}
+	}()
+	return l.Addr(), nil
+}
+
+type fakeSACPSession struct {
+	f    *FakePrinter
+	conn net.Conn
+
+	wmu sync.Mutex
+	seq uint16
+
+	mu     sync.Mutex
+	subs   map[sacpTopic]bool
+	upload *fakeUpload
+	done   chan empty
+}
+
+type fakeUpload struct {
+	name   string
+	size   uint32
+	count  uint16
+	md5hex string
+	chunks map[uint16][]byte
+}
+
+func (s *fakeSACPSession) send(p SACP_pack) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	_, err := s.conn.Write(p.Encode())
+	return err
+}
+
+func (s *fakeSACPSession) reply(req *SACP_pack, data []byte) error {
+	return s.send(SACP_pack{
+		ReceiverID: req.SenderID,
+		SenderID:   req.ReceiverID,
+		Attribute:  1,
+		Sequence:   req.Sequence,
+		CommandSet: req.CommandSet,
+		CommandID:  req.CommandID,
+		Data:       data,
+	})
+}
+
+// push sends a packet that isn't a reply, like a report or a chunk request
+func (s *fakeSACPSession) push(sender byte, command_set byte, command_id byte, data []byte) error {
+	s.wmu.Lock()
+	s.seq++
+	seq := s.seq
+	s.wmu.Unlock()
+	return s.send(SACP_pack{
+		ReceiverID: 0,
+		SenderID:   sender,
+		Attribute:  0,
+		Sequence:   seq,
+		CommandSet: command_set,
+		CommandID:  command_id,
+		Data:       data,
+	})
+}
+
+func (s *fakeSACPSession) serve() {
+	defer close(s.done)
+	defer s.conn.Close()
+	go s.report()
+
+	dec := NewSACPDecoder(s.conn)
+	for {
+		p := &SACP_pack{}
+		if err := dec.Decode(p); err != nil {
+			if isSACPDecodeError(err) {
+				continue
+			}
+			return
+		}
+		if !s.handle(p) {
+			return
+		}
+	}
+}
+
+// report pushes the subscribed topics until the session ends
+func (s *fakeSACPSession) report() {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			topics := make([]sacpTopic, 0, len(s.subs))
+			for t := range s.subs {
+				topics = append(topics, t)
+			}
+			s.mu.Unlock()
+			for _, t := range topics {
+				s.push(1, t.CommandSet, t.CommandID, s.f.sacpReport(t))
+			}
+		}
+	}
+}
+
+// sacpResult is the result byte that leads every reply
+func sacpResult(success bool) []byte {
+	if success {
+		return []byte{0}
+	}
+	return []byte{1}
+}
+
+// handle answers a packet, and returns false when the session is over
+func (s *fakeSACPSession) handle(p *SACP_pack) bool {
+	r := bytes.NewReader(p.Data)
+
+	switch (sacpTopic{p.CommandSet, p.CommandID}) {
+	case sacpTopic{0x01, 0x05}: // hello
+		s.reply(p, sacpResult(true))
+
+	case sacpTopic{0x01, 0x06}: // disconnect
+		return false
+
+	case sacpTopic{0x01, 0x00}, sacpTopic{0x01, 0x01}: // (un)subscribe
+		var t sacpTopic
+		if err := readLE(r, &t); err != nil {
+			s.reply(p, sacpResult(false))
+			break
+		}
+		subscribe := p.CommandID == 0x00
+		s.mu.Lock()
+		if subscribe {
+			s.subs[t] = true
+		} else {
+			delete(s.subs, t)
+		}
+		s.mu.Unlock()
+		s.reply(p, sacpResult(true))
+		if subscribe {
+			// the first report doesn't wait for the interval
+			s.push(1, t.CommandSet, t.CommandID, s.f.sacpReport(t))
+		}
+
+	case sacpTopic{0x10, 0x02}, sacpTopic{0x14, 0x02}: // tool or bed temperature
+		var req struct {
+			Key         uint8
+			Tool        uint8
+			Temperature uint16
+		}
+		if err := readLE(r, &req); err != nil {
+			s.reply(p, sacpResult(false))
+			break
+		}
+		tool := int(req.Tool)
+		if p.CommandSet == 0x14 {
+			tool = -1
+		}
+		s.f.setTarget(tool, float64(req.Temperature))
+		s.reply(p, sacpResult(true))
+
+	case sacpTopic{0x01, 0x35}: // home
+		s.reply(p, sacpResult(true))
+
+	case sacpTopic{0xb0, 0x08}: // start print
+		var head uint8
+		readLE(r, &head)
+		name, err := readSACPstring(r)
+		s.reply(p, sacpResult(err == nil && name != "" && s.f.startJob(name)))
+
+	case sacpTopic{0xac, 0x04}:
+		s.reply(p, sacpResult(s.f.pauseJob()))
+	case sacpTopic{0xac, 0x05}:
+		s.reply(p, sacpResult(s.f.resumeJob()))
+	case sacpTopic{0xac, 0x06}:
+		s.reply(p, sacpResult(s.f.stopJob()))
+
+	case sacpJobInfo:
+		s.reply(p, s.f.sacpJobInfo())
+
+	case sacpTopic{0xb0, 0x00}: // upload begins
+		s.beginUpload(p, r)
+
+	case sacpTopic{0xb0, 0x01}: // a chunk we asked for
+		if p.Attribute == 1 {
+			s.receiveChunk(r)
+		}
+
+	default:
+		if p.Attribute == 0 {
+			s.reply(p, sacpResult(false))
+		}
+	}
+	return true
+}
+
+func (s *fakeSACPSession) beginUpload(p *SACP_pack, r io.Reader) {
+	u := &fakeUpload{chunks: map[uint16][]byte{}}
+	var err error
+	if u.name, err = readSACPstring(r); err == nil {
+		if err = readLE(r, &u.size); err == nil {
+			if err = readLE(r, &u.count); err == nil {
+				u.md5hex, err = readSACPstring(r)
+			}
+		}
+	}
+	if err != nil {
+		s.reply(p, sacpResult(false))
+		return
+	}
+	s.reply(p, sacpResult(true))
+
+	u = s.f.resumeUpload(u)
+	s.mu.Lock()
+	s.upload = u
+	s.mu.Unlock()
+
+	// a resumed upload carries on where the last connection dropped
+	if next := s.f.missingChunk(u); next >= 0 {
+		s.requestChunk(u, uint16(next))
+	}
+}
+
+func (s *fakeSACPSession) requestChunk(u *fakeUpload, index uint16) {
+	data := bytes.Buffer{}
+	writeSACPstring(&data, u.md5hex)
+	writeLE(&data, index)
+	s.push(2, 0xb0, 0x01, data.Bytes())
+}
+
+func (s *fakeSACPSession) receiveChunk(r io.Reader) {
+	s.mu.Lock()
+	u := s.upload
+	s.mu.Unlock()
+	if u == nil {
+		return
+	}
+
+	var (
+		res   uint8
+		index uint16
+	)
+	if readLE(r, &res) != nil || res != 0 {
+		return
+	}
+	if _, err := readSACPstring(r); err != nil {
+		return
+	}
+	if readLE(r, &index) != nil {
+		return
+	}
+	chunk, err := readSACPbytes(r)
+	if err != nil {
+		return
+	}
+
+	if s.f.addChunk(u, index, chunk) {
+		s.conn.Close()
+		return
+	}
+
+	if next := s.f.missingChunk(u); next >= 0 {
+		s.requestChunk(u, uint16(next))
+		return
+	}
+
+	// got everything
+	content := make([]byte, 0, u.size)
+	for i := uint16(0); i < u.count; i++ {
+		content = append(content, u.chunks[i]...)
+	}
+	sum := md5.Sum(content)
+	valid := hex.EncodeToString(sum[:]) == u.md5hex && len(content) == int(u.size) && !s.f.Faults().BadMD5
+	if valid {
+		valid = s.f.storeFile(u.name, content) == nil
+	}
+
+	s.mu.Lock()
+	s.upload = nil
+	s.mu.Unlock()
+	s.push(2, 0xb0, 0x02, sacpResult(valid))
+}
+
+// sacpReport encodes a status topic the way parseSACPStatus reads it
+func (f *FakePrinter) sacpReport(t sacpTopic) []byte {
+	st := f.Status()
+	data := bytes.Buffer{}
+	data.WriteByte(0)
+
+	switch t {
+	case sacpTopicHeartbeat:
+		state := 0
+		for i, s := range sacpStates {
+			if s == st.State {
+				state = i
+			}
+		}
+		data.WriteByte(byte(state))
+
+	case sacpTopicExtruder:
+		data.Write([]byte{0, 0, 0, byte(len(st.Nozzles))})
+		for i, n := range st.Nozzles {
+			data.Write([]byte{byte(i), 0, 1, 1})
+			writeLE(&data, int32(n.Current*1000))
+			writeLE(&data, int32(n.Target*1000))
+		}
+
+	case sacpTopicBed:
+		data.Write([]byte{0, 1, 0})
+		writeLE(&data, int32(st.Bed.Current*1000))
+		writeLE(&data, int32(st.Bed.Target*1000))
+
+	case sacpTopicLine:
+		f.mu.Lock()
+		line := f.currentLine(time.Now())
+		f.mu.Unlock()
+		writeLE(&data, line)
+
+	case sacpTopicTime:
+		writeLE(&data, uint32(st.Elapsed/time.Second))
+	}
+	return data.Bytes()
+}
+
+func (f *FakePrinter) sacpJobInfo() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.job == nil {
+		return sacpResult(false)
+	}
+	data := bytes.Buffer{}
+	data.WriteByte(0)
+	writeSACPstring(&data, f.job.name)
+	writeLE(&data, f.job.lines)
+	writeLE(&data, uint32(f.estimated()/time.Second))
+	return data.Bytes()
+}
+
+// ListenHTTP serves the /api/v1 HTTP API on a TCP address
+func (f *FakePrinter) ListenHTTP(addr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: f.httpHandler()}
+	f.track(srv)
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		srv.Serve(l)
+	}()
+	return l.Addr(), nil
+}
+
+func (f *FakePrinter) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v1/connect", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		if f.token == "" || r.FormValue("token") != f.token {
+			b := make([]byte, 8)
+			rand.Read(b)
+			f.token = hex.EncodeToString(b)
+		}
+		token := f.token
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+	})
+
+	mux.HandleFunc("/api/v1/disconnect", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// everything below needs an approved token
+	authorized := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			f.mu.Lock()
+			valid := f.token != "" && r.FormValue("token") == f.token && !f.faults.DenyAuth
+			f.mu.Unlock()
+			if !valid {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+		}
+	}
+
+	mux.HandleFunc("/api/v1/status", authorized(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newHTTPStatus(f.Status()))
+	}))
+
+	upload := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		file, fh, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return "", false
+		}
+		defer file.Close()
+		content, err := io.ReadAll(file)
+		if err == nil {
+			err = f.storeFile(fh.Filename, content)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return "", false
+		}
+		return fh.Filename, true
+	}
+
+	mux.HandleFunc("/api/v1/upload", authorized(func(w http.ResponseWriter, r *http.Request) {
+		upload(w, r)
+	}))
+
+	mux.HandleFunc("/api/v1/prepare_print", authorized(func(w http.ResponseWriter, r *http.Request) {
+		if name, ok := upload(w, r); ok && !f.prepareJob(name) {
+			w.WriteHeader(http.StatusConflict)
+		}
+	}))
+
+	command := func(fn func() bool) http.HandlerFunc {
+		return authorized(func(w http.ResponseWriter, r *http.Request) {
+			if !fn() {
+				w.WriteHeader(http.StatusConflict)
+			}
+		})
+	}
+	mux.HandleFunc("/api/v1/start_print", command(func() bool { return f.startJob("") }))
+	mux.HandleFunc("/api/v1/pause_print", command(f.pauseJob))
+	mux.HandleFunc("/api/v1/resume_print", command(f.resumeJob))
+	mux.HandleFunc("/api/v1/stop_print", command(f.stopJob))
+
+	return mux
+}
+
+// newHTTPStatus is the reverse of httpStatus.PrinterStatus
+func newHTTPStatus(st *PrinterStatus) *httpStatus {
+	s := &httpStatus{
+		Status:                     st.State,
+		HeatedBedTemperature:       st.Bed.Current,
+		HeatedBedTargetTemperature: st.Bed.Target,
+		FileName:                   st.File,
+		Progress:                   st.Progress,
+		ElapsedTime:                int64(st.Elapsed / time.Millisecond),
+		RemainingTime:              int64(st.Remaining / time.Millisecond),
+	}
+	if len(st.Nozzles) > 0 {
+		s.NozzleTemperature = st.Nozzles[0].Current
+		s.NozzleTargetTemperature = st.Nozzles[0].Target
+	}
+	if len(st.Nozzles) > 1 {
+		s.NozzleTemperature1, s.NozzleTargetTemperature1 = st.Nozzles[0].Current, st.Nozzles[0].Target
+		s.NozzleTemperature2, s.NozzleTargetTemperature2 = st.Nozzles[1].Current, st.Nozzles[1].Target
+	}
+	return s
+}
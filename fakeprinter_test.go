@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gosuri/uilive"
+)
+
+// startFakePrinter runs a FakePrinter on loopback and points the connectors at it
+func startFakePrinter(t *testing.T, sacp bool) (*FakePrinter, *Printer) {
+	t.Helper()
+	fp := NewFakePrinter("FAKE1", "Snapmaker J1", sacp)
+
+	var (
+		addr net.Addr
+		err  error
+	)
+	if sacp {
+		addr, err = fp.ListenSACP("127.0.0.1:0")
+	} else {
+		addr, err = fp.ListenHTTP("127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { fp.Close() })
+
+	port := strconv.Itoa(addr.(*net.TCPAddr).Port)
+	origSACP, origHTTP, origNoFix, origOut := SACPPort, HTTPPort, NoFix, uilive.Out
+	SACPPort, HTTPPort, NoFix, uilive.Out = port, port, true, &bytes.Buffer{}
+	t.Cleanup(func() {
+		SACPPort, HTTPPort, NoFix, uilive.Out = origSACP, origHTTP, origNoFix, origOut
+	})
+
+	return fp, &Printer{IP: "127.0.0.1", ID: fp.ID, Sacp: sacp}
+}
+
+func TestFakePrinterSACPUpload(t *testing.T) {
+	content := bytes.Repeat([]byte("G1 X1 Y1\n"), SACP_data_len*3/9+100)
+
+	tests := []struct {
+		name    string
+		faults  FakeFaults
+		wantErr error
+	}{
+		{"clean", FakeFaults{}, nil},
+		{"dropped chunks", FakeFaults{DropChunks: 3}, nil},
+		{"bad md5", FakeFaults{BadMD5: true}, errUploadRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp, printer := startFakePrinter(t, true)
+			fp.SetFaults(tt.faults)
+
+			payload := NewPayload(bytes.NewReader(content), "part.gcode", int64(len(content)), false)
+			err := Connector.Upload(printer, payload)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Upload error = %v, want %v", err, tt.wantErr)
+			}
+
+			got, ok := fp.File("part.gcode")
+			if tt.wantErr != nil {
+				if ok {
+					t.Fatal("printer kept a rejected file")
+				}
+				return
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("printer got %d bytes, want %d", len(got), len(content))
+			}
+		})
+	}
+}
+
+func TestFakePrinterSACPResume(t *testing.T) {
+	content := bytes.Repeat([]byte("G1 X1 Y1\n"), SACP_data_len*5/9)
+	count := (len(content) + SACP_data_len - 1) / SACP_data_len
+
+	origDelay, origRetries := sacpReconnectDelay, UploadRetries
+	sacpReconnectDelay = 10 * time.Millisecond
+	t.Cleanup(func() { sacpReconnectDelay, UploadRetries = origDelay, origRetries })
+
+	t.Run("resumes", func(t *testing.T) {
+		UploadRetries = 2
+		fp, printer := startFakePrinter(t, true)
+		fp.SetFaults(FakeFaults{DisconnectAfterChunks: 3})
+
+		payload := NewPayload(bytes.NewReader(content), "part.gcode", int64(len(content)), false)
+		if err := Connector.Upload(printer, payload); err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		if got, _ := fp.File("part.gcode"); !bytes.Equal(got, content) {
+			t.Fatalf("printer got %d bytes, want %d", len(got), len(content))
+		}
+		// every chunk crossed the wire once, nothing was sent again
+		if got := fp.ChunksReceived(); got != count {
+			t.Fatalf("printer received %d chunks, want %d", got, count)
+		}
+	})
+
+	t.Run("no retries", func(t *testing.T) {
+		UploadRetries = 0
+		fp, printer := startFakePrinter(t, true)
+		fp.SetFaults(FakeFaults{DisconnectAfterChunks: 3})
+
+		payload := NewPayload(bytes.NewReader(content), "part.gcode", int64(len(content)), false)
+		if err := Connector.Upload(printer, payload); err == nil {
+			t.Fatal("Upload succeeded without reconnecting")
+		}
+		if _, ok := fp.File("part.gcode"); ok {
+			t.Fatal("printer kept an incomplete file")
+		}
+	})
+}
+
+func TestFakePrinterSACPJobControl(t *testing.T) {
+	fp, printer := startFakePrinter(t, true)
+	content := []byte("G28\nG1 X10\n")
+
+	payload := NewPayload(bytes.NewReader(content), "job.gcode", int64(len(content)), true)
+	if err := Connector.Upload(printer, payload); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if st := fp.Status(); st.State != StateRunning || st.File != "job.gcode" {
+		t.Fatalf("after print: %+v", st)
+	}
+
+	if err := Connector.PreHeatCommands(printer, 200, 0, 60, true); err != nil {
+		t.Fatalf("PreHeatCommands: %v", err)
+	}
+
+	st, err := Connector.Status(printer)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if st.State != StateRunning || st.File != "job.gcode" || st.Nozzles[0].Target != 200 || st.Bed.Target != 60 {
+		t.Fatalf("status = %+v", st)
+	}
+
+	steps := []struct {
+		fn   func(*Printer) error
+		want string
+	}{
+		{Connector.PausePrint, StatePaused},
+		{Connector.ResumePrint, StateRunning},
+		{Connector.StopPrint, StateStopped},
+	}
+	for _, s := range steps {
+		if err := s.fn(printer); err != nil {
+			t.Fatalf("going to %s: %v", s.want, err)
+		}
+		if got := fp.Status().State; got != s.want {
+			t.Fatalf("state = %s, want %s", got, s.want)
+		}
+	}
+
+	// nothing to pause anymore
+	if err := Connector.PausePrint(printer); !errors.Is(err, errCommandFailed) {
+		t.Fatalf("pause of a stopped job: %v", err)
+	}
+}
+
+func TestFakePrinterHTTP(t *testing.T) {
+	fp, printer := startFakePrinter(t, false)
+	content := []byte("G28\nG1 X10\n")
+
+	payload := NewPayload(bytes.NewReader(content), "part.gcode", int64(len(content)), true)
+	if err := Connector.Upload(printer, payload); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got, _ := fp.File("part.gcode"); !bytes.Equal(got, content) {
+		t.Fatalf("printer got %q", got)
+	}
+
+	st, err := Connector.Status(printer)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if st.State != StateRunning || st.File != "part.gcode" {
+		t.Fatalf("status = %+v", st)
+	}
+	if printer.Token == "" {
+		t.Fatal("printer token wasn't stored")
+	}
+
+	fp.SetFaults(FakeFaults{DenyAuth: true})
+	if err := Connector.StopPrint(printer); err == nil {
+		t.Fatal("expected access denied")
+	}
+}
+
+func TestFakePrinterDiscovery(t *testing.T) {
+	fp := NewFakePrinter("FAKE1", "Snapmaker J1", true)
+	addr, err := fp.ListenDiscovery("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer fp.Close()
+
+	printers, err := discoverOn(addr.String(), 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	if len(printers) != 1 {
+		t.Fatalf("found %d printers", len(printers))
+	}
+	if p := printers[0]; p.ID != "FAKE1" || p.IP != "127.0.0.1" || p.Model != "Snapmaker J1" || !p.Sacp {
+		t.Fatalf("printer = %+v", p)
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/imroc/req/v3 v3.11.0
 	github.com/macdylan/SMFix/fix v0.0.0-20240823141528-a02aee6e72f0
 	github.com/manifoldco/promptui v0.9.0
+	golang.org/x/net v0.11.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -16,7 +17,6 @@ require (
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	golang.org/x/net v0.11.0 // indirect
 	golang.org/x/sys v0.10.0 // indirect
 	golang.org/x/text v0.10.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	HistoryOK     = "ok"
+	HistoryFailed = "failed"
+)
+
+var (
+	// HistoryFile is where every upload is recorded, empty keeps no history
+	HistoryFile string
+
+	historyMu sync.Mutex
+)
+
+// HistoryEntry is one upload, whether it went through or not
+type HistoryEntry struct {
+	Time      time.Time `json:"time"`
+	Printer   string    `json:"printer"`
+	IP        string    `json:"ip"`
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`       // of the original file
+	FixedSize int64     `json:"fixed_size"` // of what was sent, after SMFix
+	MD5       string    `json:"md5,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Duration  float64   `json:"duration"` // seconds
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// newHistoryEntry records the upload of p that started with size bytes,
+// protocol is empty when no printer answered
+func newHistoryEntry(printer *Printer, p *Payload, protocol string, size int64, start time.Time, err error) *HistoryEntry {
+	e := &HistoryEntry{
+		Time:      start,
+		Printer:   printer.Name(),
+		IP:        printer.Addr(),
+		File:      p.Name,
+		Size:      size,
+		FixedSize: p.Size,
+		MD5:       p.MD5,
+		Protocol:  protocol,
+		Duration:  time.Since(start).Seconds(),
+		Status:    HistoryOK,
+	}
+	if err != nil {
+		e.Status, e.Error = HistoryFailed, err.Error()
+	}
+	return e
+}
+
+// recordUpload appends the upload to the history, a history that cannot be
+// written is logged and does not fail the upload
+func recordUpload(e *HistoryEntry) {
+	if HistoryFile == "" {
+		return
+	}
+	if err := appendHistory(HistoryFile, e); err != nil {
+		log.Printf("Upload history: %s", err)
+	}
+}
+
+/*
+appendHistory adds the entry as one line of json. Each line goes out in a
+single write to a file opened for appending, so several sm2uploader running
+at the same time do not mix up their lines.
+*/
+func appendHistory(path string, e *HistoryEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// HistoryFilter picks entries, the zero values match everything
+type HistoryFilter struct {
+	Printers []string // ids or ips
+	Since    time.Time
+	Until    time.Time // exclusive
+	Status   string
+}
+
+func (f *HistoryFilter) Match(e *HistoryEntry) bool {
+	if len(f.Printers) > 0 {
+		found := false
+		for _, p := range f.Printers {
+			if strings.EqualFold(p, e.Printer) || p == e.IP {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return f.Status == "" || f.Status == e.Status
+}
+
+// readHistory returns the entries that match, oldest first. A missing
+// history is empty, lines that cannot be read are skipped.
+func readHistory(path string, filter *HistoryFilter) ([]*HistoryEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []*HistoryEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []*HistoryEntry{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		e := &HistoryEntry{}
+		if err := json.Unmarshal(sc.Bytes(), e); err != nil {
+			if Debug {
+				log.Printf("-- %s:%d: %s", path, n, err)
+			}
+			continue
+		}
+		if filter.Match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, sc.Err()
+}
+
+/*
+parseHistoryTime reads the time of -since and -until: a duration back from
+now ("24h"), a day ("2023-07-01"), a day and time ("2023-07-01 15:04") or
+RFC 3339. A day alone is the start of the day, endOfDay moves it to the
+start of the next one so that -until includes the day.
+*/
+func parseHistoryTime(s string, now time.Time, endOfDay bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: %q is neither a date nor a duration", errUsage, s)
+}
+
+var historyColumns = []string{"time", "printer", "ip", "file", "size", "fixed_size", "md5", "protocol", "duration", "status", "error"}
+
+func (e *HistoryEntry) record() []string {
+	return []string{
+		e.Time.Format(time.RFC3339),
+		e.Printer,
+		e.IP,
+		e.File,
+		strconv.FormatInt(e.Size, 10),
+		strconv.FormatInt(e.FixedSize, 10),
+		e.MD5,
+		e.Protocol,
+		strconv.FormatFloat(e.Duration, 'f', 3, 64),
+		e.Status,
+		e.Error,
+	}
+}
+
+func writeHistoryCSV(w io.Writer, entries []*HistoryEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write(historyColumns)
+	for _, e := range entries {
+		cw.Write(e.record())
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeHistoryJSON(w io.Writer, entries []*HistoryEntry) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+func printHistory(w io.Writer, entries []*HistoryEntry) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tPRINTER\tFILE\tSIZE\tPROTOCOL\tDURATION\tSTATUS")
+	for _, e := range entries {
+		status := e.Status
+		if e.Error != "" {
+			status += ": " + e.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Format("2006-01-02 15:04:05"), e.Printer, e.File, humanReadableSize(e.FixedSize),
+			e.Protocol, time.Duration(e.Duration*float64(time.Second)).Round(time.Millisecond), status)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadHistory(t *testing.T) {
+	fp, printer := startFakePrinter(t, true)
+	fp.SetFaults(FakeFaults{BadMD5: true})
+
+	origHistory := HistoryFile
+	HistoryFile = filepath.Join(t.TempDir(), "history.jsonl")
+	t.Cleanup(func() { HistoryFile = origHistory })
+
+	content := []byte("G28\nG1 X1 Y1\n")
+	Connector.Upload(printer, NewPayload(bytes.NewReader(content), "bad.gcode", int64(len(content)), false))
+	fp.SetFaults(FakeFaults{})
+	if err := Connector.Upload(printer, NewPayload(bytes.NewReader(content), "good.gcode", int64(len(content)), false)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readHistory(HistoryFile, &HistoryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	bad, good := entries[0], entries[1]
+	if bad.File != "bad.gcode" || bad.Status != HistoryFailed || bad.Error == "" {
+		t.Errorf("failed upload recorded as %+v", bad)
+	}
+	if good.File != "good.gcode" || good.Status != HistoryOK || good.Printer != "FAKE1" || good.Protocol != "SACP" ||
+		good.Size != int64(len(content)) || good.FixedSize != good.Size || good.MD5 == "" {
+		t.Errorf("upload recorded as %+v", good)
+	}
+
+	ok, err := readHistory(HistoryFile, &HistoryFilter{Status: HistoryOK, Printers: []string{"fake1"}})
+	if err != nil || len(ok) != 1 || ok[0].File != "good.gcode" {
+		t.Errorf("filtered history = %v, %v", ok, err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeHistoryCSV(buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ",") != strings.Join(historyColumns, ",") || records[2][3] != "good.gcode" {
+		t.Errorf("csv = %v", records)
+	}
+}
+
+func TestHistoryFilter(t *testing.T) {
+	day := time.Date(2023, 7, 1, 12, 0, 0, 0, time.Local)
+	e := &HistoryEntry{Time: day, Printer: "J1A", IP: "10.0.0.5", Status: HistoryOK}
+	tests := []struct {
+		f    HistoryFilter
+		want bool
+	}{
+		{HistoryFilter{}, true},
+		{HistoryFilter{Printers: []string{"J1B", "j1a"}}, true},
+		{HistoryFilter{Printers: []string{"10.0.0.5"}}, true},
+		{HistoryFilter{Printers: []string{"J1B"}}, false},
+		{HistoryFilter{Since: day}, true},
+		{HistoryFilter{Since: day.Add(time.Second)}, false},
+		{HistoryFilter{Until: day}, false},
+		{HistoryFilter{Status: HistoryFailed}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.f.Match(e); got != tt.want {
+			t.Errorf("%+v.Match = %v, want %v", tt.f, got, tt.want)
+		}
+	}
+}
+
+func TestParseHistoryTime(t *testing.T) {
+	now := time.Date(2023, 7, 2, 10, 0, 0, 0, time.Local)
+	tests := []struct {
+		s        string
+		endOfDay bool
+		want     time.Time
+	}{
+		{"", false, time.Time{}},
+		{"24h", false, now.Add(-24 * time.Hour)},
+		{"2023-07-01", false, time.Date(2023, 7, 1, 0, 0, 0, 0, time.Local)},
+		{"2023-07-01", true, time.Date(2023, 7, 2, 0, 0, 0, 0, time.Local)},
+		{"2023-07-01 15:04", true, time.Date(2023, 7, 1, 15, 4, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		got, err := parseHistoryTime(tt.s, now, tt.endOfDay)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseHistoryTime(%q) = %v, %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+	if _, err := parseHistoryTime("yesterday", now, false); err == nil {
+		t.Error("parsed yesterday")
+	}
+}
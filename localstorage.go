@@ -2,12 +2,15 @@ package main
 
 import (
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
 type LocalStorage struct {
 	Printers []*Printer `yaml:"printers"`
+	// named lists of printers, e.g. "farm: [J1A, J1B]"
+	Groups   map[string][]string `yaml:"groups,omitempty"`
 	savePath string
 }
 
@@ -26,6 +29,8 @@ func NewLocalStorage(savePath string) *LocalStorage {
 
 // Add stores new printers in LocalStorage.
 func (ls *LocalStorage) Add(printers ...*Printer) {
+	printersMu.Lock()
+	defer printersMu.Unlock()
 	// Iterate over each printer
 	for _, p := range printers {
 		// Skip if printer ID is empty
@@ -42,6 +47,10 @@ func (ls *LocalStorage) Add(printers ...*Printer) {
 				if p.Token != "" && x.Token != p.Token {
 					ls.Printers[idx].Token = p.Token
 				}
+				if p.Fields != nil {
+					// the latest discovery reply
+					ls.Printers[idx].Status, ls.Printers[idx].Firmware, ls.Printers[idx].Fields = p.Status, p.Firmware, p.Fields
+				}
 				// Go to exists label
 				goto exists
 			}
@@ -54,13 +63,39 @@ func (ls *LocalStorage) Add(printers ...*Printer) {
 }
 
 func (ls *LocalStorage) Save() (err error) {
-	if b, err := yaml.Marshal(ls); err == nil {
+	printersMu.RLock()
+	b, err := yaml.Marshal(ls)
+	printersMu.RUnlock()
+	if err == nil {
 		return os.WriteFile(ls.savePath, b, 0644)
 	}
 	return
 }
 
+// Expand splits a comma separated list of hosts and replaces the names of
+// groups by their printers.
+func (ls *LocalStorage) Expand(hosts string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, h := range strings.Split(hosts, ",") {
+		h = strings.TrimSpace(h)
+		members, ok := ls.Groups[h]
+		if !ok {
+			members = []string{h}
+		}
+		for _, m := range members {
+			if m != "" && !seen[m] {
+				seen[m] = true
+				out = append(out, m)
+			}
+		}
+	}
+	return out
+}
+
 func (ls *LocalStorage) Find(host string) *Printer {
+	printersMu.RLock()
+	defer printersMu.RUnlock()
 	for _, p := range ls.Printers {
 		if p.ID == host || p.IP == host {
 			return p
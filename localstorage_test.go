@@ -3,6 +3,7 @@ package main
 import (
 	"gopkg.in/yaml.v3"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -39,3 +40,23 @@ func TestLocalStorageLoad(t *testing.T) {
 		}
 	}
 }
+
+func TestLocalStorageExpand(t *testing.T) {
+	ls := &LocalStorage{Groups: map[string][]string{"farm": {"J1A", "J1B"}}}
+	tests := []struct {
+		hosts string
+		want  []string
+	}{
+		{"", []string{}},
+		{"J1A", []string{"J1A"}},
+		{"farm", []string{"J1A", "J1B"}},
+		{"farm, J1C,J1A", []string{"J1A", "J1B", "J1C"}},
+		{"192.168.1.20,", []string{"192.168.1.20"}},
+	}
+	for _, tt := range tests {
+		got := ls.Expand(tt.hosts)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Expand(%q) = %v, want %v", tt.hosts, got, tt.want)
+		}
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/gosuri/uilive"
 	"github.com/manifoldco/promptui"
 )
 
@@ -16,52 +22,198 @@ var (
 	Host                string
 	KnownHosts          string
 	DiscoverTimeout     time.Duration
+	Emulate             EmulatorOptions
+	StatusRefresh       time.Duration
 	OctoPrintListenAddr string
 	Tool1Temperature    int
 	Tool2Temperature    int
 	BedTemperature      int
 	Home                bool
+	StartPrint          bool
+	PausePrint          bool
+	ResumePrint         bool
+	StopPrint           bool
 	NoFix               bool
+	FixOnly             bool
+	FixOutput           string
+	QueueDir            string
 	Debug               bool
 
-	_Payloads       []*Payload
 	SmFixExtensions = map[string]bool{
 		".gcode": true,
 		".nc":    false,
 		".cnc":   false,
 		".bin":   false,
 	}
-)
 
-func main() {
-	defer func() {
-		if r := recover(); r != nil {
-			os.Exit(2)
-		}
-	}()
+	errUsage         = errors.New("invalid usage")
+	errNoInputFiles  = fmt.Errorf("%w: no input files", errUsage)
+	errSinglePrinter = fmt.Errorf("%w: this command takes a single printer", errUsage)
+)
 
+/*
+loadEnv sets the options from the environment. The flags are registered with
+the values that are set by then as their defaults, so the same flag can be
+registered on several flag sets without losing what was already parsed.
+*/
+func loadEnv() {
 	// 获取程序所在目录 - Get the directory where the program is located
 	ex, _ := os.Executable()
 	dir, err := filepath.Abs(filepath.Dir(ex))
 	if err != nil {
 		log.Panicln(err)
 	}
-	defaultKnownHosts := filepath.Join(dir, "hosts.yaml")
+	KnownHosts = filepath.Join(dir, "hosts.yaml")
 	if envKnownhosts := os.Getenv("KNOWN_HOSTS"); envKnownhosts != "" {
-		defaultKnownHosts = envKnownhosts
+		KnownHosts = envKnownhosts
+	}
+
+	Host = os.Getenv("HOST")
+	OctoPrintListenAddr = os.Getenv("OCTOPRINT")
+	OctoPrintAPIKeys = os.Getenv("OCTOPRINT_API_KEYS")
+	OctoPrintAPIKeyFile = os.Getenv("OCTOPRINT_API_KEY_FILE")
+	PrusaLinkListenAddr = os.Getenv("PRUSALINK")
+	if v := os.Getenv("PRUSALINK_USER"); v != "" {
+		PrusaLinkUser = v
+	}
+	PrusaLinkPassword = os.Getenv("PRUSALINK_PASSWORD")
+	Tool1Temperature = parseIntEnv("TOOL1", 0)
+	Tool2Temperature = parseIntEnv("TOOL2", 0)
+	BedTemperature = parseIntEnv("BED", 0)
+	Home = parseBoolEnv("HOME", false)
+	StartPrint = parseBoolEnv("PRINT", false)
+	UploadRetries = parseIntEnv("RETRIES", UploadRetries)
+	DiscoverTimeout = parseDurationEnv("TIMEOUT", 4*time.Second)
+	if v := os.Getenv("DISCOVER"); v != "" {
+		DiscoverStrategies = v
+	}
+	DiscoverScanCIDRs = os.Getenv("SCAN")
+	RediscoverInterval = parseDurationEnv("REDISCOVER", 5*time.Minute)
+	DiscoverSeeds = os.Getenv("SEEDS")
+	if v := os.Getenv("MDNS_SERVICES"); v != "" {
+		DiscoverMDNSServices = v
 	}
+	NoFix = parseBoolEnv("NOFIX", false)
+	NoMDNS = parseBoolEnv("NOMDNS", false)
+	Debug = parseBoolEnv("DEBUG", false)
+	Output = OutputText
+	if v := os.Getenv("OUTPUT"); v != "" {
+		Output = v
+	}
+	FixOutput = "-"
+	QueueDir = filepath.Join(dir, "queue")
+	if v := os.Getenv("QUEUE_DIR"); v != "" {
+		QueueDir = v
+	}
+	HistoryFile = filepath.Join(dir, "history.jsonl")
+	if v, ok := os.LookupEnv("HISTORY"); ok {
+		HistoryFile = v
+	}
+	Emulate = EmulatorOptions{
+		Name:     os.Getenv("EMULATE"),
+		ID:       os.Getenv("EMULATE_ID"),
+		Model:    os.Getenv("EMULATE_MODEL"),
+		Protocol: os.Getenv("EMULATE_PROTOCOL"),
+		Dir:      filepath.Join(dir, "emulated"),
+		Speed:    100,
+	}
+	loadFixEnv()
+}
+
+// options every subcommand takes
+func globalFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Host, "host", Host, "upload to host(id/ip/hostname), not required. Uploads take several hosts and groups of the known hosts, e.g. J1A,J1B or farm")
+	fs.StringVar(&KnownHosts, "knownhosts", KnownHosts, "known hosts")
+	fs.DurationVar(&DiscoverTimeout, "timeout", DiscoverTimeout, "printer discovery timeout")
+	fs.StringVar(&DiscoverStrategies, "discover", DiscoverStrategies, "comma separated discovery strategies: broadcast, scan (discover messages to -scan), seed (to -seeds), probe (TCP probes of -scan and -seeds), mdns (discover messages to the hosts of -mdns-services)")
+	fs.StringVar(&DiscoverScanCIDRs, "scan", DiscoverScanCIDRs, "comma separated networks to discover printers in, e.g. '-scan 10.0.5.0/24'")
+	fs.StringVar(&DiscoverSeeds, "seeds", DiscoverSeeds, "comma separated addresses of printers to discover, e.g. across a VPN")
+	fs.StringVar(&DiscoverMDNSServices, "mdns-services", DiscoverMDNSServices, "comma separated DNS-SD service types '-discover mdns' browses for")
+	fs.BoolVar(&Debug, "debug", Debug, "debug mode")
+	fs.StringVar(&HistoryFile, "history", HistoryFile, "file of the upload history, empty to keep none")
+	fs.StringVar(&Output, "output", Output, "output format: text, or json for events on stdout and the logs on stderr")
+}
+
+func uploadFlags(fs *flag.FlagSet) {
+	fs.IntVar(&UploadRetries, "retries", UploadRetries, "reconnect this many times when an upload over SACP is interrupted")
+	fixFlags(fs)
+}
+
+func fixFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&NoFix, "nofix", NoFix, "disable SMFix(built-in)")
+	registerFixFlags(fs)
+}
 
-	flag.StringVar(&Host, "host", os.Getenv("HOST"), "upload to host(id/ip/hostname), not required.")
-	flag.StringVar(&KnownHosts, "knownhosts", defaultKnownHosts, "known hosts")
-	flag.StringVar(&OctoPrintListenAddr, "octoprint", os.Getenv("OCTOPRINT"), "octoprint listen address, e.g. '-octoprint :8844' then you can upload files to printer by http://localhost:8844")
-	flag.IntVar(&Tool1Temperature, "tool1", parseIntEnv("TOOL1", 0), "set the temperature (preheat) of tool 1")
-	flag.IntVar(&Tool2Temperature, "tool2", parseIntEnv("TOOL2", 0), "set the temperature (preheat) of tool 2")
-	flag.IntVar(&BedTemperature, "bed", parseIntEnv("BED", 0), "set the temperature (preheat) of bed")
-	flag.BoolVar(&Home, "home", parseBoolEnv("HOME", false), "home the printer")
-	flag.DurationVar(&DiscoverTimeout, "timeout", parseDurationEnv("TIMEOUT", 4*time.Second), "printer discovery timeout")
-	flag.BoolVar(&NoFix, "nofix", parseBoolEnv("NOFIX", false), "disable SMFix(built-in)")
-	flag.BoolVar(&Debug, "debug", parseBoolEnv("DEBUG", false), "debug mode")
+func octoPrintAuthFlags(fs *flag.FlagSet) {
+	fs.StringVar(&OctoPrintAPIKeys, "api-keys", OctoPrintAPIKeys, "comma separated API keys the OctoPrint server accepts, none accepts every request")
+	fs.StringVar(&OctoPrintAPIKeyFile, "api-key-file", OctoPrintAPIKeyFile, "file with API keys for the OctoPrint server, one per line")
+}
+
+func prusaLinkFlags(fs *flag.FlagSet) {
+	fs.StringVar(&PrusaLinkListenAddr, "prusalink", PrusaLinkListenAddr, "also serve the printers as PrusaLink on this address, e.g. ':8846'")
+	fs.StringVar(&PrusaLinkUser, "prusalink-user", PrusaLinkUser, "Digest user of PrusaLink")
+	fs.StringVar(&PrusaLinkPassword, "prusalink-password", PrusaLinkPassword, "Digest password of PrusaLink, none turns Digest off; the API keys work too")
+}
+
+func mdnsFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&NoMDNS, "nomdns", NoMDNS, "don't advertise the OctoPrint server over mDNS")
+}
+
+// the long running modes: serve, watch and queue run
+func rediscoverFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&RediscoverInterval, "rediscover", RediscoverInterval, "discover the printers again this often to follow new addresses, 0 never")
+}
+
+func preheatFlags(fs *flag.FlagSet) {
+	fs.IntVar(&Tool1Temperature, "tool1", Tool1Temperature, "set the temperature (preheat) of tool 1")
+	fs.IntVar(&Tool2Temperature, "tool2", Tool2Temperature, "set the temperature (preheat) of tool 2")
+	fs.IntVar(&BedTemperature, "bed", BedTemperature, "set the temperature (preheat) of bed")
+	fs.BoolVar(&Home, "home", Home, "home the printer")
+}
+
+func statusFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&StatusRefresh, "refresh", StatusRefresh, "refresh interval of the status mode, e.g. '-refresh 2s', 0 prints it once")
+}
 
+// legacyFlags are the options of the single flag set sm2uploader had before
+// subcommands, they all still work in front of the files.
+func legacyFlags(fs *flag.FlagSet) {
+	globalFlags(fs)
+	uploadFlags(fs)
+	preheatFlags(fs)
+	statusFlags(fs)
+	fs.StringVar(&OctoPrintListenAddr, "octoprint", OctoPrintListenAddr, "octoprint listen address, e.g. '-octoprint :8844' then you can upload files to printer by http://localhost:8844")
+	octoPrintAuthFlags(fs)
+	prusaLinkFlags(fs)
+	mdnsFlags(fs)
+	rediscoverFlags(fs)
+	fs.BoolVar(&StartPrint, "print", StartPrint, "start printing the uploaded file")
+	fs.BoolVar(&PausePrint, "pause", PausePrint, "pause the active print job")
+	fs.BoolVar(&ResumePrint, "resume", ResumePrint, "resume the paused print job")
+	fs.BoolVar(&StopPrint, "stop", StopPrint, "stop the active print job")
+	fs.BoolVar(&FixOnly, "fix-only", FixOnly, "run SMFix on the files and write the result to -fix-output instead of uploading")
+	fs.StringVar(&FixOutput, "fix-output", FixOutput, "file or directory for -fix-only, '-' is stdout")
+	fs.StringVar(&Emulate.Name, "emulate", Emulate.Name, "run a virtual printer (J1, Artisan, A150, A250, A350) instead of uploading")
+	fs.StringVar(&Emulate.ID, "emulate-id", Emulate.ID, "printer id of the virtual printer")
+	fs.StringVar(&Emulate.Model, "emulate-model", Emulate.Model, "model: the virtual printer reports in discovery")
+	fs.StringVar(&Emulate.Protocol, "emulate-protocol", Emulate.Protocol, "protocol of the virtual printer (sacp/http), defaults to the model's")
+	fs.StringVar(&Emulate.Dir, "emulate-dir", Emulate.Dir, "directory for files uploaded to the virtual printer")
+	fs.Float64Var(&Emulate.Speed, "emulate-speed", Emulate.Speed, "gcode lines per second of simulated prints")
+}
+
+func main() {
+	defer func() {
+		if r := recover(); r != nil {
+			exitWithPanic(r)
+		}
+	}()
+
+	// the progress of uploads is a human log too, log lines go above it
+	uilive.Out = os.Stderr
+	log.SetOutput(board)
+
+	loadEnv()
+	legacyFlags(flag.CommandLine)
 	flag.Usage = flag_usage
 	flag.Parse()
 
@@ -69,146 +221,460 @@ func main() {
 		log.Printf("-- CNS Debug mode: %s", Version)
 	}
 
+	// sm2uploader [global options] <command> [options] [args]
+	if cmd := findCommand(flag.Arg(0)); cmd != nil {
+		if err := cmd.run(flag.Args()[1:]); err != nil {
+			exitWithError(err)
+		}
+		return
+	}
+
+	if err := checkOutput(); err != nil {
+		exitWithError(err)
+	}
+	if err := runLegacy(flag.Args()); err != nil {
+		exitWithError(err)
+	}
+}
+
+func checkOutput() error {
+	if Output != OutputText && Output != OutputJSON {
+		return fmt.Errorf("%w: -output %s, want text or json", errUsage, Output)
+	}
+	return nil
+}
+
+// runLegacy does what the flags ask for, the way sm2uploader worked before it
+// had subcommands.
+func runLegacy(files []string) error {
+	if Emulate.Name != "" {
+		return startEmulator(Emulate)
+	}
+
 	if NoFix {
 		log.Println("smfix disabled")
 	}
 
-	var printer *Printer
-	ls := NewLocalStorage(KnownHosts)
-	defer func() {
-		if printer != nil {
-			// update printer's token
-			ls.Add(printer)
-			if Debug {
-				log.Printf("-- Updated printer: %s", printer.String())
-			}
+	if FixOnly {
+		return fixFiles(files, FixOutput, fixOptionsFor(Host))
+	}
+
+	return withKnownPrinters(func(ls *LocalStorage, printers []*Printer) error {
+		preheating := Tool1Temperature != 0 || Tool2Temperature != 0 || BedTemperature != 0 || Home
+		jobControl := PausePrint || ResumePrint || StopPrint
+		if OctoPrintListenAddr != "" {
+			// listen for octoprint uploads
+			defer startDiscoveryService(ls, RediscoverInterval).Close()
+			return startOctoPrintServer(OctoPrintListenAddr, printers)
 		}
-		if err := ls.Save(); err == nil && Debug {
-			log.Printf("-- Saved known hosts: %s", KnownHosts)
+		if len(printers) > 1 && (preheating || jobControl) {
+			return errSinglePrinter
 		}
-	}()
+		printer := printers[0]
 
-	// Check if host is specified
-	printer = ls.Find(Host)
-	if printer != nil {
-		log.Println("Found printer in " + KnownHosts)
-	}
+		if preheating {
+			if err := preheat(printer); err != nil {
+				return err
+			}
+		}
 
-	// Discover printers
-	if printer == nil {
-		log.Println("Discovering ...")
-		if printers, err := Discover(DiscoverTimeout); err == nil {
-			if Debug {
-				log.Printf("-- Discovered %d printers", len(printers))
+		if jobControl {
+			var err error
+			switch {
+			case PausePrint:
+				err = jobCommand(printer, "pause")
+			case ResumePrint:
+				err = jobCommand(printer, "resume")
+			case StopPrint:
+				err = jobCommand(printer, "stop")
+			}
+			if err != nil {
+				return err
 			}
-			ls.Add(printers...)
-		} else if Debug {
-			log.Printf("-- Discover error: %s", err.Error())
 		}
-		printer = ls.Find(Host)
-		if printer != nil {
-			log.Printf("Found printer: %s", printer.String())
+
+		// 检查是否有传入的文件 - Check if a file has been passed in
+		if len(files) == 0 && (preheating || jobControl) {
+			return nil
 		}
+		return uploadFiles(printers, files, StartPrint)
+	})
+}
+
+// fixOptionsFor returns the SMFix options an upload to host would use
+func fixOptionsFor(host string) FixOptions {
+	if p := NewLocalStorage(KnownHosts).Find(host); host != "" && p != nil {
+		return p.Fix.Merge(FixDefaults)
 	}
+	return FixDefaults
+}
 
-	if printer == nil {
-		if Host == "" {
-			// Prompt user to select a printer
-			printers := ls.Printers
-			if len(printers) == 0 {
-				log.Panicln("No printers found")
-			}
-			if len(printers) > 1 {
-				prompt := promptui.Select{
-					Label: "Select a printer",
-					Items: printers,
-				}
-				idx, _, err := prompt.Run()
-				if err != nil {
-					log.Panicln(err)
-				}
-				printer = printers[idx]
-			} else {
-				printer = printers[0]
+// withPrinter runs fn with the single printer given by -host, see withPrinters
+func withPrinter(fn func(*Printer) error) error {
+	return withPrinters(func(printers []*Printer) error {
+		if len(printers) > 1 {
+			return errSinglePrinter
+		}
+		return fn(printers[0])
+	})
+}
+
+var (
+	interruptMu    sync.Mutex
+	interruptHooks []func()
+)
+
+// onInterrupt runs f when the program is interrupted, before it exits
+func onInterrupt(f func()) {
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+	interruptHooks = append(interruptHooks, f)
+}
+
+/*
+withPrinters finds the printers given by -host, in the known hosts, by
+discovery or by asking, and runs fn with them. -host takes several printers
+and groups from the known hosts, separated by commas. The printers and the
+tokens they handed out are remembered in the known hosts afterwards, also
+when the program is interrupted.
+*/
+func withPrinters(fn func([]*Printer) error) error {
+	return withKnownPrinters(func(_ *LocalStorage, printers []*Printer) error {
+		return fn(printers)
+	})
+}
+
+// withKnownPrinters is withPrinters that also hands the known hosts to fn
+func withKnownPrinters(fn func(*LocalStorage, []*Printer) error) error {
+	var printers []*Printer
+	ls := NewLocalStorage(KnownHosts)
+	save := func() {
+		// update printer's token
+		ls.Add(printers...)
+		if Debug {
+			for _, printer := range printers {
+				log.Printf("-- Updated printer: %s", printer.String())
 			}
-		} else {
-			// directly to printer using ip/hostname
-			printer = &Printer{IP: Host}
+		}
+		if err := ls.Save(); err == nil && Debug {
+			log.Printf("-- Saved known hosts: %s", KnownHosts)
 		}
 	}
+	defer save()
 
-	log.Println("Printer IP:", printer.IP)
-	if printer.Model != "" {
-		log.Println("Printer Model:", printer.Model)
+	printers, err := findPrinters(ls, ls.Expand(Host))
+	if err != nil {
+		return err
+	}
+
+	for _, printer := range printers {
+		log.Println("Printer IP:", printer.Addr())
+		if printer.Model != "" {
+			log.Println("Printer Model:", printer.Model)
+		}
+		emit(Event{Event: "printer", Printer: printer})
 	}
 
 	// Create a channel to listen for signals
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer signal.Stop(sc)
 	go func() {
 		sig := <-sc
 		log.Printf("Received signal: %s", sig)
-		// update printer's token
-		if printer != nil {
-			ls.Add(printer)
-			if Debug {
-				log.Printf("-- Updated printer: %s", printer.String())
-			}
-		}
-		if err := ls.Save(); err == nil && Debug {
-			log.Printf("-- Saved known hosts: %s", KnownHosts)
+		interruptMu.Lock()
+		for _, f := range interruptHooks {
+			f()
 		}
+		interruptMu.Unlock()
+		save()
 		os.Exit(0)
 	}()
 
-	if OctoPrintListenAddr != "" {
-		// listen for octoprint uploads
-		if err := startOctoPrintServer(OctoPrintListenAddr, printer); err != nil {
-			log.Panic(err)
+	return fn(ls, printers)
+}
+
+// findPrinters looks up every host, discovering the network at most once
+func findPrinters(ls *LocalStorage, hosts []string) ([]*Printer, error) {
+	if len(hosts) == 0 {
+		printer, err := findPrinter(ls, "")
+		if err != nil {
+			return nil, err
 		}
-		return
+		return []*Printer{printer}, nil
 	}
 
-	preheating := Tool1Temperature != 0 || Tool2Temperature != 0 || BedTemperature != 0 || Home
-	if preheating {
-		log.Println("Preheating...")
-		if err := Connector.PreHeatCommands(printer, Tool1Temperature, Tool2Temperature, BedTemperature, Home); err != nil {
-			log.Panic(err)
+	for _, host := range hosts {
+		if ls.Find(host) == nil {
+			discoverInto(ls)
+			break
 		}
 	}
 
-	// 检查文件参数是否存在 - Check if the file parameter exists
-	for _, file := range flag.Args() {
-		if st, err := os.Stat(file); os.IsNotExist(err) {
-			log.Panicf("File %s does not exist\n", file)
-		} else {
-			f, _ := os.Open(file)
-			_Payloads = append(_Payloads, NewPayload(f, st.Name(), st.Size(), false))
+	printers := []*Printer{}
+	for _, host := range hosts {
+		printer := ls.Find(host)
+		if printer == nil {
+			// directly to printer using ip/hostname
+			printer = &Printer{IP: host}
+		}
+		printers = append(printers, printer)
+	}
+	return printers, nil
+}
+
+// findPrinter looks for host in the known hosts, then by discovery, and
+// asks which printer to use when host is empty.
+func findPrinter(ls *LocalStorage, host string) (*Printer, error) {
+	// Check if host is specified
+	printer := ls.Find(host)
+	if printer != nil {
+		log.Println("Found printer in " + KnownHosts)
+		return printer, nil
+	}
+
+	unknown := discoverInto(ls)
+	printer = ls.Find(host)
+	if printer != nil {
+		log.Printf("Found printer: %s", printer.String())
+		return printer, nil
+	}
+
+	if host != "" {
+		// directly to printer using ip/hostname
+		return &Printer{IP: host}, nil
+	}
+
+	// Prompt user to select a printer
+	printers := append(append([]*Printer{}, ls.Printers...), unknown...)
+	if len(printers) == 0 {
+		return nil, fmt.Errorf("%w: no printers found", errPrinterNotFound)
+	}
+	if len(printers) == 1 {
+		return printers[0], nil
+	}
+	if jsonOutput() {
+		// nobody to answer the prompt
+		return nil, fmt.Errorf("%w: %d printers found, choose one with -host", errPrinterNotFound, len(printers))
+	}
+	prompt := promptui.Select{
+		Label:     "Select a printer",
+		Items:     printers,
+		Templates: printerSelectTemplates,
+	}
+	// start on the first printer that is not busy
+	for i, p := range printers {
+		if !p.IsBusy() {
+			prompt.CursorPos = i
+			break
 		}
 	}
+	idx, _, err := prompt.Run()
+	if err != nil {
+		return nil, err
+	}
+	return printers[idx], nil
+}
 
+// the state of a printer is red when it is busy, green when it is not
+const printerSelectItem = `{{ .ID }}@{{ .IP }} - {{ .Model }}` +
+	`{{ if .Status }} ({{ if .IsBusy }}{{ .Status | red }}{{ else }}{{ .Status | green }}{{ end }}){{ end }}`
+
+var printerSelectTemplates = &promptui.SelectTemplates{
+	Label:    "{{ . }}?",
+	Active:   "{{ \"▸\" | cyan }} " + printerSelectItem,
+	Inactive: "  " + printerSelectItem,
+	Selected: "{{ \"✔\" | green }} {{ .String }}",
+}
+
+// discoverInto adds the printers on the network to the known hosts, and
+// returns the ones only a probe found, which have no id to be kept by
+func discoverInto(ls *LocalStorage) (unknown []*Printer) {
+	log.Println("Discovering ...")
+	if printers, err := Discover(DiscoverTimeout); err == nil {
+		if Debug {
+			log.Printf("-- Discovered %d printers", len(printers))
+		}
+		ls.Add(printers...)
+		for _, p := range printers {
+			if p.ID == "" {
+				unknown = append(unknown, p)
+			}
+		}
+	} else if errors.Is(err, errUsage) {
+		log.Printf("Discover: %v", err)
+	} else if Debug {
+		log.Printf("-- Discover error: %s", err.Error())
+	}
+	return unknown
+}
+
+func preheat(printer *Printer) error {
+	log.Println("Preheating...")
+	if err := Connector.PreHeatCommands(printer, Tool1Temperature, Tool2Temperature, BedTemperature, Home); err != nil {
+		return err
+	}
+	emit(Event{Event: "preheat", Printer: printer})
+	return nil
+}
+
+// jobCommand pauses, resumes or stops the active job
+func jobCommand(printer *Printer, action string) (err error) {
+	switch action {
+	case "pause":
+		log.Println("Pausing print job...")
+		err = Connector.PausePrint(printer)
+	case "resume":
+		log.Println("Resuming print job...")
+		err = Connector.ResumePrint(printer)
+	case "stop":
+		log.Println("Stopping print job...")
+		err = Connector.StopPrint(printer)
+	default:
+		return fmt.Errorf("%w: unknown job command %s", errUsage, action)
+	}
+	if err == nil {
+		emit(Event{Event: "job", Printer: printer, Action: action})
+	}
+	return err
+}
+
+/*
+uploadFiles uploads the files to every printer. The printers get them at the
+same time, each one file after the other, and a summary of all uploads is
+printed when there is more than one printer.
+*/
+func uploadFiles(printers []*Printer, files []string, print bool) error {
 	// 检查是否有传入的文件 - Check if a file has been passed in
-	if len(_Payloads) == 0 {
-		if !preheating {
-			log.Panicln("No input files")
+	if len(files) == 0 {
+		return errNoInputFiles
+	}
+	if print && len(files) > 1 {
+		return fmt.Errorf("%w: -print accepts only one file", errUsage)
+	}
+	// 检查文件参数是否存在 - Check if the file parameter exists
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("%w: %s", errFileInvalid, err)
 		}
 	}
 
+	results := make([][]uploadResult, len(printers))
+	wg := sync.WaitGroup{}
+	for i, printer := range printers {
+		wg.Add(1)
+		go func(i int, printer *Printer) {
+			defer wg.Done()
+			results[i] = uploadTo(printer, files, print)
+		}(i, printer)
+	}
+	wg.Wait()
+
+	if len(printers) == 1 {
+		for _, r := range results[0] {
+			if r.Err != nil {
+				return r.Err
+			}
+		}
+		return nil
+	}
+
+	all := []uploadResult{}
+	for _, rs := range results {
+		all = append(all, rs...)
+	}
+	if !jsonOutput() {
+		printUploadSummary(os.Stdout, all)
+	}
+	failed := 0
+	for _, r := range all {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d uploads", errUploadFailed, failed, len(all))
+	}
+	return nil
+}
+
+type uploadResult struct {
+	Printer  *Printer
+	File     string
+	Size     int64
+	Duration time.Duration
+	Err      error
+}
+
+// uploadTo uploads the files to one printer, it stops at the first failure
+func uploadTo(printer *Printer, files []string, print bool) []uploadResult {
 	// 从 slic3r 环境变量中获取文件名
 	envFilename := os.Getenv("SLIC3R_PP_OUTPUT_NAME")
 
-	// Upload files to host
-	for _, p := range _Payloads {
-		if envFilename != "" {
-			p.SetName(filepath.Base(envFilename))
+	results := []uploadResult{}
+	for i, file := range files {
+		if i > 0 {
+			<-time.After(time.Second * 1) // HMI needs some time to refresh
 		}
+		r := uploadResult{Printer: printer, File: filepath.Base(file)}
+		start := time.Now()
+		r.Err = func() error {
+			f, err := os.Open(file)
+			if err != nil {
+				return fmt.Errorf("%w: %s", errFileInvalid, err)
+			}
+			defer f.Close()
+			st, err := f.Stat()
+			if err != nil {
+				return fmt.Errorf("%w: %s", errFileInvalid, err)
+			}
+			p := NewPayload(f, st.Name(), st.Size(), print)
+			if envFilename != "" {
+				p.SetName(filepath.Base(envFilename))
+			}
+			r.File, r.Size = p.Name, p.Size
+			return uploadPayload(printer, p)
+		}()
+		r.Duration = time.Since(start)
+		results = append(results, r)
+		if r.Err != nil {
+			code, _ := errorCode(r.Err)
+			emit(Event{Event: "failed", Printer: printer, File: r.File, Code: code, Error: r.Err.Error()})
+			break
+		}
+	}
+	return results
+}
 
-		log.Printf("Uploading file '%s' [%s]...", p.Name, p.ReadableSize())
-		if err := Connector.Upload(printer, p); err != nil {
-			log.Panicln(err)
-		} else {
-			log.Println("Upload finished.")
-			<-time.After(time.Second * 1) // HMI needs some time to refresh
+func printUploadSummary(w io.Writer, results []uploadResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PRINTER\tFILE\tSIZE\tTIME\tRESULT")
+	for _, r := range results {
+		result := "ok"
+		if r.Err != nil {
+			result = r.Err.Error()
 		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Printer.Name(), r.File, humanReadableSize(r.Size), r.Duration.Round(time.Millisecond), result)
+	}
+	tw.Flush()
+}
+
+// uploadPayload sends one file to the printer and reports the result
+func uploadPayload(printer *Printer, p *Payload) error {
+	log.Printf("Uploading file '%s' [%s]...", p.Name, p.ReadableSize())
+	start := time.Now()
+	if err := Connector.Upload(printer, p); err != nil {
+		return fmt.Errorf("%w: %s: %w", errUploadFailed, p.Name, err)
 	}
+	log.Println("Upload finished.")
+	emit(Event{
+		Event:    "uploaded",
+		Printer:  printer,
+		File:     p.Name,
+		Bytes:    p.Size,
+		MD5:      p.MD5,
+		Duration: time.Since(start).Seconds(),
+		Print:    p.Print,
+	})
+	return nil
 }
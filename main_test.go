@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gosuri/uilive"
+)
+
+func TestUploadFilesToSeveralPrinters(t *testing.T) {
+	// two printers on loopback addresses that share the SACP port
+	fps := []*FakePrinter{}
+	printers := []*Printer{}
+	port := "0"
+	for i, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		fp := NewFakePrinter("FARM"+strconv.Itoa(i+1), "Snapmaker J1", true)
+		addr, err := fp.ListenSACP(net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Skipf("listen on %s: %v", ip, err)
+		}
+		t.Cleanup(func() { fp.Close() })
+		port = strconv.Itoa(addr.(*net.TCPAddr).Port)
+		fps = append(fps, fp)
+		printers = append(printers, &Printer{IP: ip, ID: fp.ID, Sacp: true})
+	}
+	origSACP, origNoFix, origOut := SACPPort, NoFix, uilive.Out
+	SACPPort, NoFix, uilive.Out = port, true, &bytes.Buffer{}
+	t.Cleanup(func() { SACPPort, NoFix, uilive.Out = origSACP, origNoFix, origOut })
+
+	content := bytes.Repeat([]byte("G1 X1 Y1\n"), SACP_data_len/9*2)
+	file := filepath.Join(t.TempDir(), "part.gcode")
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := uploadFiles(printers, []string{file}, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, fp := range fps {
+		if got, ok := fp.File("part.gcode"); !ok || !bytes.Equal(got, content) {
+			t.Errorf("%s got %d bytes, want %d", fp.ID, len(got), len(content))
+		}
+	}
+
+	// one printer goes away, the other still gets the file
+	fps[1].Close()
+	if err := uploadFiles(printers, []string{file}, false); err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("error = %v", err)
+	}
+
+	summary := &bytes.Buffer{}
+	printUploadSummary(summary, []uploadResult{
+		{Printer: printers[0], File: "part.gcode", Size: 2048},
+		{Printer: printers[1], File: "part.gcode", Err: errAccessDenied},
+	})
+	lines := strings.Split(strings.TrimSpace(summary.String()), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[1], "ok") || !strings.HasSuffix(lines[2], "access denied") {
+		t.Errorf("summary:\n%s", summary.String())
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	mdnsPort        = 5353
+	mdnsServiceType = "_octoprint._tcp"
+	mdnsServices    = "_services._dns-sd._udp.local."
+	// RFC 6762: 120s for records with a host name, 75 minutes for the rest
+	mdnsHostTTL  = 120
+	mdnsOtherTTL = 4500
+	// the top bit of the class asks for a unicast answer in a question, and
+	// flushes the caches in an answer
+	mdnsUnicastBit = 1 << 15
+)
+
+var (
+	mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+	// don't advertise the OctoPrint server over mDNS
+	NoMDNS bool
+)
+
+// mdnsService is one DNS-SD instance, an OctoPrint printer
+type mdnsService struct {
+	Instance string
+	Port     uint16
+	TXT      []string
+}
+
+// octoPrintService advertises a printer that is served on port under path
+func octoPrintService(printer *Printer, port int, path string) *mdnsService {
+	return &mdnsService{
+		// a dot would split the label
+		Instance: strings.ReplaceAll(printer.Name(), ".", "-") + " (sm2uploader)",
+		Port:     uint16(port),
+		TXT: []string{
+			"path=" + path,
+			"version=1.2.3",
+			"api=0.1",
+			"id=" + printer.ID,
+			"model=" + printer.Model,
+			"vendor=Snapmaker",
+		},
+	}
+}
+
+func (s *mdnsService) name() string {
+	return s.Instance + "." + mdnsServiceType + ".local."
+}
+
+/*
+mdnsResponder answers mDNS queries (RFC 6762) for the DNS-SD services (RFC
+6763) of the OctoPrint server, so slicers find the printers without Avahi or
+Bonjour. It only knows its own records and does no probing: the instance
+names carry the printer names, which are unique on the network anyway.
+*/
+type mdnsResponder struct {
+	services []*mdnsService
+	host     string
+	// the address the server listens on, nil for every address
+	ip net.IP
+
+	conn *net.UDPConn
+	pc   *ipv4.PacketConn
+	// ifaces that joined the group
+	ifaces    []net.Interface
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func mdnsHostname() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "sm2uploader"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	return host + ".local."
+}
+
+func newMDNSResponder(services []*mdnsService, ip net.IP) *mdnsResponder {
+	if ip != nil && ip.IsUnspecified() {
+		ip = nil
+	}
+	return &mdnsResponder{
+		services: services,
+		host:     mdnsHostname(),
+		ip:       ip,
+		done:     make(chan struct{}),
+	}
+}
+
+// startMDNS joins the mDNS group on every multicast interface, announces the
+// services and answers queries until Close
+func startMDNS(services []*mdnsService, ip net.IP) (*mdnsResponder, error) {
+	m := newMDNSResponder(services, ip)
+	ifaces := mdnsInterfaces()
+	// listening joins the group on the first interface, joining it there
+	// again fails
+	var first *net.Interface
+	if len(ifaces) > 0 {
+		first = &ifaces[0]
+	}
+	conn, err := net.ListenMulticastUDP("udp4", first, mdnsGroup)
+	if err != nil {
+		return nil, err
+	}
+	m.conn = conn
+	m.pc = ipv4.NewPacketConn(conn)
+	// not on every system, the answers then carry every address
+	m.pc.SetControlMessage(ipv4.FlagInterface, true)
+	m.pc.SetMulticastLoopback(true)
+
+	for i, iface := range ifaces {
+		iface := iface
+		if i == 0 {
+			m.ifaces = append(m.ifaces, iface)
+		} else if err := m.pc.JoinGroup(&iface, mdnsGroup); err == nil {
+			m.ifaces = append(m.ifaces, iface)
+		} else if Debug {
+			log.Printf("-- mDNS join on %s: %v", iface.Name, err)
+		}
+	}
+
+	go m.serve()
+	go func() {
+		// announce twice, a second apart (RFC 6762 8.3)
+		for i := 0; i < 2; i++ {
+			m.announce(mdnsHostTTL, mdnsOtherTTL)
+			select {
+			case <-m.done:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	return m, nil
+}
+
+// mdnsInterfaces are the interfaces that are up, do multicast and have an
+// IPv4 address
+func mdnsInterfaces() []net.Interface {
+	ifaces, _ := net.Interfaces()
+	found := []net.Interface{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+				found = append(found, iface)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// Close says goodbye, so the services leave the caches, and stops answering
+func (m *mdnsResponder) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.announce(0, 0)
+		err = m.conn.Close()
+	})
+	return err
+}
+
+// announce sends every record on every interface, with a ttl of 0 to say goodbye
+func (m *mdnsResponder) announce(hostTTL, otherTTL uint32) {
+	for _, iface := range m.ifaces {
+		iface := iface
+		ips := m.addrs(&iface)
+		if len(ips) == 0 {
+			continue
+		}
+		msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+		for _, s := range m.services {
+			msg.Answers = append(msg.Answers, m.serviceRecords(s, nil, hostTTL, otherTTL)...)
+		}
+		msg.Answers = append(msg.Answers, m.hostRecords(ips, hostTTL)...)
+		b, err := msg.Pack()
+		if err != nil {
+			log.Printf("mDNS: %v", err)
+			return
+		}
+		if err := m.pc.SetMulticastInterface(&iface); err != nil {
+			continue
+		}
+		if _, err := m.pc.WriteTo(b, nil, mdnsGroup); err != nil && Debug {
+			log.Printf("-- mDNS announce on %s: %v", iface.Name, err)
+		}
+	}
+}
+
+func (m *mdnsResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, cm, src, err := m.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			log.Printf("mDNS: %v", err)
+			return
+		}
+		var iface *net.Interface
+		if cm != nil && cm.IfIndex > 0 {
+			iface, _ = net.InterfaceByIndex(cm.IfIndex)
+		}
+		resp, unicast := m.reply(buf[:n], src, m.addrs(iface))
+		if resp == nil {
+			continue
+		}
+		var dst net.Addr = mdnsGroup
+		if unicast {
+			dst = src
+		}
+		var wcm *ipv4.ControlMessage
+		if iface != nil {
+			wcm = &ipv4.ControlMessage{IfIndex: iface.Index}
+		}
+		if _, err := m.pc.WriteTo(resp, wcm, dst); err != nil && Debug {
+			log.Printf("-- mDNS reply to %s: %v", src, err)
+		}
+	}
+}
+
+/*
+reply answers the query in packet from src with the addresses in ips, nil
+when there is nothing to say. Queries from a port other than 5353 (legacy
+unicast, RFC 6762 6.7) and questions with the unicast bit get a unicast reply.
+*/
+func (m *mdnsResponder) reply(packet []byte, src net.Addr, ips []net.IP) (resp []byte, unicast bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(packet)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return nil, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false
+	}
+	legacy := false
+	if u, ok := src.(*net.UDPAddr); ok && u.Port != mdnsPort {
+		legacy = true
+	}
+
+	msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	unicast = legacy
+	for _, q := range questions {
+		answers, additionals := m.answer(q, ips)
+		if len(answers) == 0 {
+			continue
+		}
+		if q.Class&mdnsUnicastBit != 0 {
+			unicast = true
+		}
+		msg.Answers = append(msg.Answers, answers...)
+		msg.Additionals = append(msg.Additionals, additionals...)
+	}
+	if len(msg.Answers) == 0 {
+		return nil, false
+	}
+	if legacy {
+		// a plain DNS resolver wants its question back, and no cache flush bits
+		msg.ID = h.ID
+		msg.Questions = questions
+		for i := range msg.Answers {
+			msg.Answers[i].Header.Class &^= mdnsUnicastBit
+			if msg.Answers[i].Header.TTL > 10 {
+				msg.Answers[i].Header.TTL = 10
+			}
+		}
+		for i := range msg.Additionals {
+			msg.Additionals[i].Header.Class &^= mdnsUnicastBit
+		}
+	}
+	msg.Additionals = dedupRecords(msg.Answers, msg.Additionals)
+	resp, err = msg.Pack()
+	if err != nil {
+		log.Printf("mDNS: %v", err)
+		return nil, false
+	}
+	return resp, unicast
+}
+
+// answer returns the records for one question, and the ones that save the
+// asker another query
+func (m *mdnsResponder) answer(q dnsmessage.Question, ips []net.IP) (answers, additionals []dnsmessage.Resource) {
+	name := strings.ToLower(q.Name.String())
+	all := q.Type == dnsmessage.TypeALL
+	typeName := strings.ToLower(mdnsServiceType + ".local.")
+
+	switch {
+	case name == mdnsServices && (all || q.Type == dnsmessage.TypePTR):
+		if len(m.services) > 0 {
+			answers = append(answers, ptrRecord(mdnsServices, mdnsServiceType+".local.", mdnsOtherTTL))
+		}
+	case name == typeName && (all || q.Type == dnsmessage.TypePTR):
+		for _, s := range m.services {
+			answers = append(answers, ptrRecord(mdnsServiceType+".local.", s.name(), mdnsOtherTTL))
+			additionals = append(additionals, m.serviceRecords(s, nil, mdnsHostTTL, mdnsOtherTTL)[1:]...)
+		}
+		if len(answers) > 0 {
+			additionals = append(additionals, m.hostRecords(ips, mdnsHostTTL)...)
+		}
+	case name == strings.ToLower(m.host) && (all || q.Type == dnsmessage.TypeA):
+		answers = m.hostRecords(ips, mdnsHostTTL)
+	default:
+		for _, s := range m.services {
+			if name != strings.ToLower(s.name()) {
+				continue
+			}
+			records := m.serviceRecords(s, nil, mdnsHostTTL, mdnsOtherTTL)
+			srv, txt := records[1], records[2]
+			switch q.Type {
+			case dnsmessage.TypeSRV:
+				answers = append(answers, srv)
+				additionals = append(additionals, m.hostRecords(ips, mdnsHostTTL)...)
+			case dnsmessage.TypeTXT:
+				answers = append(answers, txt)
+			case dnsmessage.TypeALL:
+				answers = append(answers, srv, txt)
+				additionals = append(additionals, m.hostRecords(ips, mdnsHostTTL)...)
+			}
+		}
+	}
+	return answers, additionals
+}
+
+// serviceRecords are the PTR, SRV and TXT records of s, and the host's A
+// records when ips are given
+func (m *mdnsResponder) serviceRecords(s *mdnsService, ips []net.IP, hostTTL, otherTTL uint32) []dnsmessage.Resource {
+	name := mustName(s.name())
+	records := []dnsmessage.Resource{
+		ptrRecord(mdnsServiceType+".local.", s.name(), otherTTL),
+		{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET | mdnsUnicastBit, TTL: hostTTL},
+			Body:   &dnsmessage.SRVResource{Target: mustName(m.host), Port: s.Port},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET | mdnsUnicastBit, TTL: otherTTL},
+			Body:   &dnsmessage.TXTResource{TXT: s.TXT},
+		},
+	}
+	if len(ips) > 0 {
+		records = append(records, m.hostRecords(ips, hostTTL)...)
+	}
+	return records
+}
+
+func (m *mdnsResponder) hostRecords(ips []net.IP, ttl uint32) []dnsmessage.Resource {
+	records := []dnsmessage.Resource{}
+	for _, ip := range ips {
+		a := dnsmessage.AResource{}
+		copy(a.A[:], ip.To4())
+		records = append(records, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: mustName(m.host), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET | mdnsUnicastBit, TTL: ttl},
+			Body:   &a,
+		})
+	}
+	return records
+}
+
+/*
+addrs are the IPv4 addresses to answer with on iface: the one the server
+listens on, or every address of the interface. Without an interface, every
+address of the machine, the loopback one only when there is nothing else.
+*/
+func (m *mdnsResponder) addrs(iface *net.Interface) []net.IP {
+	if m.ip != nil {
+		return []net.IP{m.ip}
+	}
+	var addrs []net.Addr
+	if iface != nil {
+		addrs, _ = iface.Addrs()
+	} else {
+		addrs, _ = net.InterfaceAddrs()
+	}
+	ips, loopback := []net.IP{}, []net.IP{}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		if ipnet.IP.IsLoopback() {
+			loopback = append(loopback, ipnet.IP.To4())
+		} else {
+			ips = append(ips, ipnet.IP.To4())
+		}
+	}
+	if len(ips) == 0 {
+		return loopback
+	}
+	return ips
+}
+
+func ptrRecord(name, target string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: mustName(name), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.PTRResource{PTR: mustName(target)},
+	}
+}
+
+// mustName makes a dnsmessage name, too long ones are cut at 255 bytes
+func mustName(s string) dnsmessage.Name {
+	if len(s) > 254 {
+		s = s[:254]
+		if !strings.HasSuffix(s, ".") {
+			s += "."
+		}
+	}
+	return dnsmessage.MustNewName(s)
+}
+
+// dedupRecords drops the additionals that are already answers, or twice there
+func dedupRecords(answers, additionals []dnsmessage.Resource) []dnsmessage.Resource {
+	seen := map[string]bool{}
+	for _, r := range answers {
+		seen[r.GoString()] = true
+	}
+	out := additionals[:0]
+	for _, r := range additionals {
+		if k := r.GoString(); !seen[k] {
+			seen[k] = true
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+/*
+octoPrintServices are the mDNS services of the OctoPrint server on listener:
+the only printer at its root, or every printer under its /printer/<id>/
+prefix. Printers with a listen: address of their own are advertised there.
+*/
+func octoPrintServices(router *octoPrintRouter, listener net.Listener, printerListeners map[*Printer]net.Listener) []*mdnsService {
+	services := []*mdnsService{}
+	port := listenerPort(listener)
+	for _, p := range router.printers {
+		if l, ok := printerListeners[p.printer]; ok {
+			services = append(services, octoPrintService(p.printer, listenerPort(l), "/"))
+			continue
+		}
+		path := "/"
+		if len(router.printers) > 1 {
+			path = octoPrintPrinterPrefix + p.printer.Name() + "/"
+		}
+		services = append(services, octoPrintService(p.printer, port, path))
+	}
+	return services
+}
+
+func listenerPort(l net.Listener) int {
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// advertiseOctoPrint starts the mDNS responder of the OctoPrint server, a
+// failure only costs the discovery
+func advertiseOctoPrint(services []*mdnsService, listener net.Listener) *mdnsResponder {
+	if NoMDNS || len(services) == 0 {
+		return nil
+	}
+	var ip net.IP
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		if addr.IP.To4() == nil && !addr.IP.IsUnspecified() {
+			// an IPv6 only server, there are no A records for it
+			return nil
+		}
+		ip = addr.IP.To4()
+	}
+	m, err := startMDNS(services, ip)
+	if err != nil {
+		log.Printf("mDNS is off: %v", err)
+		return nil
+	}
+	names := []string{}
+	for _, s := range services {
+		names = append(names, fmt.Sprintf("%s:%d", s.Instance, s.Port))
+	}
+	log.Printf("Advertising %s over mDNS as %s", strings.Join(names, ", "), mdnsServiceType)
+	return m
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func mdnsQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type, class dnsmessage.Class) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: class}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMDNSResponder(t *testing.T) {
+	printers := []*Printer{
+		{ID: "J1V19", Model: "Snapmaker J1", IP: "192.168.1.20"},
+		{ID: "A350.X", Model: "Snapmaker 2 Model A350", IP: "192.168.1.21"},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	services := octoPrintServices(newOctoPrintRouter(printers), l, nil)
+	m := newMDNSResponder(services, nil)
+	m.host = "workshop.local."
+	ips := []net.IP{net.IPv4(192, 168, 1, 5)}
+	mdnsSrc := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 9), Port: mdnsPort}
+
+	resp, unicast := m.reply(mdnsQuery(t, 0, "_octoprint._tcp.local.", dnsmessage.TypePTR, dnsmessage.ClassINET), mdnsSrc, ips)
+	if resp == nil || unicast {
+		t.Fatalf("PTR reply %v, unicast %v", resp, unicast)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Response || len(msg.Answers) != 2 {
+		t.Fatalf("answers = %v", msg.Answers)
+	}
+	if ptr := msg.Answers[1].Body.(*dnsmessage.PTRResource).PTR.String(); ptr != "A350-X (sm2uploader)._octoprint._tcp.local." {
+		t.Errorf("PTR = %q", ptr)
+	}
+	var srv *dnsmessage.SRVResource
+	var txt []string
+	a := 0
+	for _, r := range msg.Additionals {
+		switch body := r.Body.(type) {
+		case *dnsmessage.SRVResource:
+			if r.Header.Name.String() == services[0].name() {
+				srv = body
+			}
+		case *dnsmessage.TXTResource:
+			if r.Header.Name.String() == services[0].name() {
+				txt = body.TXT
+			}
+		case *dnsmessage.AResource:
+			a++
+			if net.IP(body.A[:]).String() != "192.168.1.5" {
+				t.Errorf("A = %v", body.A)
+			}
+		}
+	}
+	if srv == nil || srv.Port != uint16(listenerPort(l)) || srv.Target.String() != "workshop.local." {
+		t.Errorf("SRV = %+v", srv)
+	}
+	if want := "path=/printer/J1V19/ version=1.2.3 api=0.1 id=J1V19 model=Snapmaker J1 vendor=Snapmaker"; strings.Join(txt, " ") != want {
+		t.Errorf("TXT = %q", txt)
+	}
+	if a != 1 {
+		t.Errorf("%d A records, want one", a)
+	}
+
+	// a legacy resolver asks from another port and gets its question back
+	resp, unicast = m.reply(mdnsQuery(t, 42, "workshop.local.", dnsmessage.TypeA, dnsmessage.ClassINET), &net.UDPAddr{IP: mdnsSrc.IP, Port: 40000}, ips)
+	msg = dnsmessage.Message{}
+	if err := msg.Unpack(resp); err != nil || !unicast {
+		t.Fatalf("A reply: %v, unicast %v", err, unicast)
+	}
+	if msg.ID != 42 || len(msg.Questions) != 1 || len(msg.Answers) != 1 || msg.Answers[0].Header.Class != dnsmessage.ClassINET {
+		t.Errorf("legacy reply = %+v", msg)
+	}
+
+	// the QU bit asks for a unicast answer
+	if _, unicast := m.reply(mdnsQuery(t, 0, services[1].name(), dnsmessage.TypeTXT, dnsmessage.ClassINET|mdnsUnicastBit), mdnsSrc, ips); !unicast {
+		t.Error("QU question answered over multicast")
+	}
+	// other names are someone else's
+	if resp, _ := m.reply(mdnsQuery(t, 0, "_ipp._tcp.local.", dnsmessage.TypePTR, dnsmessage.ClassINET), mdnsSrc, ips); resp != nil {
+		t.Error("answered a question for another service")
+	}
+}
+
+func TestMDNSJoinsEveryInterface(t *testing.T) {
+	want := mdnsInterfaces()
+	if len(want) == 0 {
+		t.Skip("no multicast interface")
+	}
+	m, err := startMDNS(nil, nil)
+	if err != nil {
+		t.Skipf("mDNS port: %v", err)
+	}
+	defer m.Close()
+	// listening joined the first interface, it answers there too
+	if len(m.ifaces) == 0 || m.ifaces[0].Index != want[0].Index {
+		t.Errorf("joined %v, want %v", m.ifaces, want)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what the Moonraker front end reports as its version
+const moonrakerVersion = "v0.8.0-sm2uploader"
+
+func moonrakerResult(w http.ResponseWriter, status int, result interface{}) {
+	writeJSON(w, status, map[string]interface{}{"result": result})
+}
+
+func moonrakerError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": message, "traceback": ""},
+	})
+}
+
+// moonrakerPrintState turns the printer state into the state of print_stats
+func moonrakerPrintState(st *PrinterStatus) string {
+	switch st.State {
+	case StatePausing, StatePaused:
+		return "paused"
+	case StateCompleted:
+		return "complete"
+	case StateStopping, StateStopped:
+		return "cancelled"
+	case StateIdle, StateUnknown:
+		return "standby"
+	}
+	return "printing"
+}
+
+// moonrakerObjects returns the Klipper objects the printer status fills in
+func moonrakerObjects(st *PrinterStatus) map[string]map[string]interface{} {
+	heater := func(t Temperature) map[string]interface{} {
+		return map[string]interface{}{"temperature": t.Current, "target": t.Target, "power": 0}
+	}
+	state := moonrakerPrintState(st)
+	objects := map[string]map[string]interface{}{
+		"heater_bed": heater(st.Bed),
+		"print_stats": {
+			"filename":       st.File,
+			"total_duration": st.Elapsed.Seconds(),
+			"print_duration": st.Elapsed.Seconds(),
+			"filament_used":  0,
+			"state":          state,
+			"message":        "",
+		},
+		"virtual_sdcard": {
+			"file_path": st.File,
+			"progress":  st.Progress,
+			"is_active": state == "printing",
+		},
+		"display_status": {
+			"progress": st.Progress,
+			"message":  "",
+		},
+		"webhooks": {
+			"state":         "ready",
+			"state_message": "Printer is ready",
+		},
+	}
+	for i, n := range st.Nozzles {
+		name := "extruder"
+		if i > 0 {
+			name += strconv.Itoa(i)
+		}
+		objects[name] = heater(n)
+	}
+	return objects
+}
+
+/*
+moonrakerHandlers serves the part of the Moonraker API that slicers with the
+Moonraker host type use. Uploads go the same way as the OctoPrint ones, the
+status comes from the same cache.
+*/
+func moonrakerHandlers(mux *http.ServeMux, printer *Printer, status *printerStatusCache, _stats *stats) {
+	mux.HandleFunc("/server/info", func(w http.ResponseWriter, r *http.Request) {
+		_, err := status.Get()
+		state := "ready"
+		if err != nil {
+			state = "shutdown"
+		}
+		moonrakerResult(w, http.StatusOK, map[string]interface{}{
+			"klippy_connected":       err == nil,
+			"klippy_state":           state,
+			"components":             []string{"file_manager", "machine"},
+			"failed_components":      []string{},
+			"registered_directories": []string{"gcodes"},
+			"warnings":               []string{},
+			"websocket_count":        0,
+			"moonraker_version":      moonrakerVersion,
+			"api_version":            []int{1, 0, 0},
+			"api_version_string":     "1.0.0",
+		})
+	})
+
+	mux.HandleFunc("/printer/info", func(w http.ResponseWriter, r *http.Request) {
+		hostname, _ := os.Hostname()
+		moonrakerResult(w, http.StatusOK, map[string]interface{}{
+			"state":            "ready",
+			"state_message":    "Printer is ready",
+			"hostname":         hostname,
+			"software_version": "sm2uploader " + Version,
+			"cpu_info":         printer.Model,
+		})
+	})
+
+	mux.HandleFunc("/server/files/upload", func(w http.ResponseWriter, r *http.Request) {
+		payload, ok := readUpload(w, r)
+		if !ok {
+			return
+		}
+		defer payload.File.(io.Closer).Close()
+
+		if root := r.FormValue("root"); root != "" && root != "gcodes" {
+			moonrakerError(w, http.StatusBadRequest, "Root "+root+" is not available for uploads")
+			return
+		}
+		if err := serverUpload(printer, payload, _stats); err != nil {
+			moonrakerError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		moonrakerResult(w, http.StatusCreated, map[string]interface{}{
+			"item": map[string]interface{}{
+				"path":        payload.Name,
+				"root":        "gcodes",
+				"modified":    float64(time.Now().UnixNano()) / 1e9,
+				"size":        payload.Size,
+				"permissions": "rw",
+			},
+			"print_started": payload.Print,
+			"print_queued":  false,
+			"action":        "create_file",
+		})
+	})
+
+	mux.HandleFunc("/printer/objects/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			methodNotAllowedResponse(w, r.Method)
+			return
+		}
+		st, err := status.Get()
+		if err != nil {
+			moonrakerError(w, http.StatusServiceUnavailable, "Klippy Disconnected")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			moonrakerError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// ?extruder&print_stats=state,filename asks for all of extruder and
+		// two fields of print_stats
+		objects := moonrakerObjects(st)
+		result := map[string]map[string]interface{}{}
+		for name, values := range r.Form {
+			object, ok := objects[name]
+			if !ok {
+				continue
+			}
+			fields := splitList(strings.Join(values, ","))
+			if len(fields) == 0 {
+				result[name] = object
+				continue
+			}
+			result[name] = map[string]interface{}{}
+			for _, f := range fields {
+				if v, ok := object[f]; ok {
+					result[name][f] = v
+				}
+			}
+		}
+		moonrakerResult(w, http.StatusOK, map[string]interface{}{
+			"eventtime": float64(time.Now().UnixNano()) / 1e9,
+			"status":    result,
+		})
+	})
+
+	mux.HandleFunc("/printer/objects/list", func(w http.ResponseWriter, r *http.Request) {
+		st, err := status.Get()
+		if err != nil {
+			moonrakerError(w, http.StatusServiceUnavailable, "Klippy Disconnected")
+			return
+		}
+		names := []string{}
+		for name := range moonrakerObjects(st) {
+			names = append(names, name)
+		}
+		moonrakerResult(w, http.StatusOK, map[string]interface{}{"objects": names})
+	})
+
+	mux.HandleFunc("/machine/system_info", func(w http.ResponseWriter, r *http.Request) {
+		hostname, _ := os.Hostname()
+		moonrakerResult(w, http.StatusOK, map[string]interface{}{
+			"system_info": map[string]interface{}{
+				"cpu_info": map[string]interface{}{
+					"cpu_count":     runtime.NumCPU(),
+					"bits":          strconv.Itoa(strconv.IntSize) + "bit",
+					"processor":     runtime.GOARCH,
+					"cpu_desc":      "",
+					"serial_number": printer.ID,
+					"hardware_desc": printer.Model,
+					"model":         printer.Model,
+					"total_memory":  0,
+					"memory_units":  "kB",
+				},
+				"sd_info": map[string]interface{}{},
+				"distribution": map[string]interface{}{
+					"name":    "sm2uploader " + Version,
+					"id":      runtime.GOOS,
+					"version": Version,
+				},
+				"available_services": []string{},
+				"service_state":      map[string]interface{}{},
+				"virtualization":     map[string]string{"virt_type": "none", "virt_identifier": "none"},
+				"network":            map[string]interface{}{},
+				"hostname":           hostname,
+			},
+		})
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func moonrakerGet(t *testing.T, h http.Handler, path string) map[string]interface{} {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d %s", path, rec.Code, rec.Body)
+	}
+	resp := struct {
+		Result map[string]interface{} `json:"result"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Result == nil {
+		t.Fatalf("GET %s: %v %s", path, err, rec.Body)
+	}
+	return resp.Result
+}
+
+func TestMoonraker(t *testing.T) {
+	fp, printer := startFakePrinter(t, true)
+	h := octoPrintHandler(printer, newStats())
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "klipper.gcode")
+	fw.Write([]byte("G28\nG1 X1\n"))
+	mw.WriteField("root", "gcodes")
+	mw.WriteField("print", "true")
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/server/files/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload = %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fp.File("klipper.gcode"); !ok {
+		t.Fatal("the printer did not get the upload")
+	}
+	fp.setTarget(0, 205)
+
+	if info := moonrakerGet(t, h, "/server/info"); info["klippy_state"] != "ready" {
+		t.Errorf("/server/info = %v", info)
+	}
+	if info := moonrakerGet(t, h, "/machine/system_info"); info["system_info"] == nil {
+		t.Errorf("/machine/system_info = %v", info)
+	}
+
+	query := moonrakerGet(t, h, "/printer/objects/query?extruder=target&heater_bed&print_stats=state,filename&nope")
+	status := query["status"].(map[string]interface{})
+	extruder := status["extruder"].(map[string]interface{})
+	stats := status["print_stats"].(map[string]interface{})
+	if len(status) != 3 || len(extruder) != 1 || extruder["target"] != 205.0 || status["heater_bed"].(map[string]interface{})["temperature"] == nil {
+		t.Errorf("query status = %v", status)
+	}
+	if len(stats) != 2 || stats["state"] != "printing" || stats["filename"] != "klipper.gcode" {
+		t.Errorf("print_stats = %v", stats)
+	}
+}
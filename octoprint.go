@@ -2,28 +2,26 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	maxMemory = 128 << 20 // 128MB
-)
-
-var (
-	noTrim    = false
-	noShutoff = false
-	// noPreheat        = false
-	// noReinforceTower = false
-	noReplaceTool = false
+	// room for the multipart headers around the file
+	maxFormOverhead = 1 << 20
 )
 
 type stats struct {
+	mu          sync.Mutex
 	start       time.Time
 	memory      uint64
 	success     uint
@@ -38,7 +36,54 @@ type last struct {
 	time     time.Time
 }
 
+func newStats() *stats {
+	return &stats{
+		start:       time.Now(),
+		lastSuccess: &last{time: time.Now()},
+		lastFailure: &last{time: time.Now()},
+	}
+}
+
+// seed takes the last uploads of the printer from the history, the counts
+// start from zero with every start of the server
+func (s *stats) seed(printer *Printer) {
+	if HistoryFile == "" {
+		return
+	}
+	entries, err := readHistory(HistoryFile, &HistoryFilter{Printers: []string{printer.Name()}})
+	if err != nil {
+		log.Printf("Upload history: %s", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		l := &last{filename: e.File, size: e.FixedSize, time: e.Time}
+		if e.Status == HistoryOK {
+			s.lastSuccess = l
+		} else {
+			s.lastFailure = l
+		}
+	}
+}
+
+// lastUpload returns the newest upload, ok or not, nil before the first
+func (s *stats) lastUpload() (l *last, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	success, failure := s.lastSuccess.filename != "", s.lastFailure.filename != ""
+	if success && (!failure || s.lastSuccess.time.After(s.lastFailure.time)) {
+		return s.lastSuccess, true
+	}
+	if failure {
+		return s.lastFailure, false
+	}
+	return nil, false
+}
+
 func (s *stats) addSuccess(filename string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.success++
 	s.lastSuccess = &last{
 		filename: normalizedFilename(filename),
@@ -48,6 +93,8 @@ func (s *stats) addSuccess(filename string, size int64) {
 }
 
 func (s *stats) addFailure(filename string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.failure++
 	s.lastFailure = &last{
 		filename: normalizedFilename(filename),
@@ -59,6 +106,8 @@ func (s *stats) addFailure(filename string, size int64) {
 func (s *stats) String() string {
 	var mem runtime.MemStats
 	runtime.ReadMemStats(&mem)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.memory = mem.Alloc
 
 	buf := bytes.Buffer{}
@@ -80,105 +129,240 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func startOctoPrintServer(listenAddr string, printer *Printer) error {
-	var (
-		_stats *stats
-		mux    = http.NewServeMux()
-	)
+// octoPrintHandler serves the OctoPrint API of a single printer
+func octoPrintHandler(printer *Printer, _stats *stats) http.Handler {
+	return octoPrintMux(printer, _stats, newPrinterStatusCache(printer, octoPrintStatusTTL))
+}
+
+/*
+prusaLinkHandler serves the PrusaLink API of a single printer next to the
+OctoPrint one. It only goes behind the PrusaLink listener: the PUT upload
+prints, and on the OctoPrint port the Digest login would not guard it.
+*/
+func prusaLinkHandler(printer *Printer, _stats *stats, status *printerStatusCache) http.Handler {
+	mux := octoPrintMux(printer, _stats, status)
+	prusaLinkHandlers(mux, printer, status, _stats)
+	return mux
+}
+
+// octoPrintMux has the OctoPrint and Moonraker routes of a printer
+func octoPrintMux(printer *Printer, _stats *stats, status *printerStatusCache) *http.ServeMux {
+	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
 		protocol := "HTTP"
 		if printer.Sacp {
 			protocol = "SACP"
 		}
 		resp := `sm2uploader ` + Version + ` - https://github.com/macdylan/sm2uploader` + "\n\n" +
 			`	printer id: ` + printer.ID + "\n" +
-			`	printer ip: ` + printer.IP + "\n" +
+			`	printer ip: ` + printer.Addr() + "\n" +
 			`	protocol: ` + protocol + "\n\n" +
 			_stats.String()
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		writeResponse(w, http.StatusOK, resp)
 	})
 
-	mux.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
-		respVersion := `{"api": "0.1", "server": "1.2.3", "text": "OctoPrint 1.2.3/Dummy"}`
-		writeResponse(w, http.StatusOK, respVersion)
-	})
+	mux.HandleFunc("/api/version", versionHandler)
+
+	octoPrintStatusHandlers(mux, printer, status)
+	moonrakerHandlers(mux, printer, status, _stats)
 
 	mux.HandleFunc("/api/files/local", func(w http.ResponseWriter, r *http.Request) {
-		// Check if request is a POST request
-		if r.Method != http.MethodPost {
-			methodNotAllowedResponse(w, r.Method)
+		payload, ok := readUpload(w, r)
+		if !ok {
 			return
 		}
+		defer payload.File.(io.Closer).Close()
 
-		err := r.ParseMultipartForm(maxMemory)
-		if err != nil {
+		if err := serverUpload(printer, payload, _stats); err != nil {
 			internalServerErrorResponse(w, err.Error())
 			return
 		}
 
-		// Retrieve the uploaded file
-		file, fd, err := r.FormFile("file")
-		if err != nil {
-			badRequestResponse(w, err.Error())
-			return
-		}
-		defer file.Close()
-
-		// Get print parameter if they upload+print the file
-		startPrint := r.FormValue("print") == "true"
-
-		// read X-Api-Key header
-		apiKey := r.Header.Get("X-Api-Key")
-		if len(apiKey) > 5 {
-			argumentsFromApi(apiKey)
-		}
+		// Return success response
+		writeResponse(w, http.StatusOK, `{"done": true}`)
+	})
 
-		// Send the stream to the printer
-		payload := NewPayload(file, fd.Filename, fd.Size, startPrint)
-		if err := Connector.Upload(printer, payload); err != nil {
-			_stats.addFailure(payload.Name, payload.Size)
-			internalServerErrorResponse(w, err.Error())
-			return
-		}
+	return mux
+}
 
-		_stats.addSuccess(payload.Name, payload.Size)
+// serverUpload sends an upload the server took to the printer
+func serverUpload(printer *Printer, payload *Payload, _stats *stats) error {
+	start := time.Now()
+	if err := Connector.Upload(printer, payload); err != nil {
+		_stats.addFailure(payload.Name, payload.Size)
+		return err
+	}
 
-		log.Printf("Upload finished: %s [%s]", fd.Filename, payload.ReadableSize())
+	_stats.addSuccess(payload.Name, payload.Size)
 
-		// Return success response
-		writeResponse(w, http.StatusOK, `{"done": true}`)
+	log.Printf("Upload finished: %s [%s]", payload.Name, payload.ReadableSize())
+	emit(Event{
+		Event:    "uploaded",
+		Printer:  printer,
+		File:     payload.Name,
+		Bytes:    payload.Size,
+		MD5:      payload.MD5,
+		Duration: time.Since(start).Seconds(),
+		Print:    payload.Print,
 	})
+	return nil
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	respVersion := `{"api": "0.1", "server": "1.2.3", "text": "OctoPrint 1.2.3/Dummy"}`
+	writeResponse(w, http.StatusOK, respVersion)
+}
 
-	handler := LoggingMiddleware(mux)
+/*
+startOctoPrintServer serves the printers on listenAddr, and every printer
+with a listen: address in the known hosts on that address too. With more
+than one printer, a request picks its printer by the /printer/<id>/ path
+prefix or by the api_key: of the printer. The same printers are served as
+PrusaLink on -prusalink.
+*/
+func startOctoPrintServer(listenAddr string, printers []*Printer) error {
+	keys, err := loadOctoPrintAPIKeys()
+	if err != nil {
+		return err
+	}
+	router := newOctoPrintRouter(printers)
 	log.Printf("Starting OctoPrint server on %s ...", listenAddr)
 
-	// Create a listener
+	// Create the listeners first, so that a port in use stops everything
+	type server struct {
+		listener net.Listener
+		handler  http.Handler
+	}
 	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return err
 	}
-
-	_stats = &stats{
-		start:   time.Now(),
-		success: 0,
-		failure: 0,
-		lastSuccess: &last{
-			filename: "",
-			size:     0,
-			time:     time.Now(),
-		},
-		lastFailure: &last{
-			filename: "",
-			size:     0,
-			time:     time.Now(),
-		},
+	allKeys := append(append([]string{}, keys...), router.keys()...)
+	servers := []server{{listener, octoPrintAuth(listenAddr, allKeys, router)}}
+	printerListeners := map[*Printer]net.Listener{}
+	for _, p := range router.printers {
+		if p.printer.Listen == "" {
+			continue
+		}
+		l, err := net.Listen("tcp", p.printer.Listen)
+		if err != nil {
+			for _, s := range servers {
+				s.listener.Close()
+			}
+			return fmt.Errorf("%s: %w", p.printer.Name(), err)
+		}
+		printerKeys := keys
+		if p.printer.APIKey != "" {
+			printerKeys = append(append([]string{}, keys...), p.printer.APIKey)
+		}
+		servers = append(servers, server{l, octoPrintAuth(p.printer.Listen, printerKeys, p.handler)})
+		printerListeners[p.printer] = l
+		log.Printf("%s on http://%s", p.printer.Name(), l.Addr().String())
+	}
+	if PrusaLinkListenAddr != "" {
+		l, err := net.Listen("tcp", PrusaLinkListenAddr)
+		if err != nil {
+			for _, s := range servers {
+				s.listener.Close()
+			}
+			return fmt.Errorf("PrusaLink: %w", err)
+		}
+		servers = append(servers, server{l, prusaLinkAuth(PrusaLinkListenAddr, allKeys, prusaLinkDigest(), prusaLinkVersion(router.prusaLink()))})
+		log.Printf("PrusaLink on http://%s", l.Addr().String())
 	}
 
 	log.Printf("Server started, now you can upload files to http://%s", listener.Addr().String())
-	// Start the server
-	return http.Serve(listener, handler)
+	if m := advertiseOctoPrint(octoPrintServices(router, listener, printerListeners), listener); m != nil {
+		// say goodbye also on Ctrl+C
+		onInterrupt(func() { m.Close() })
+		defer m.Close()
+	}
+	errc := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s server) {
+			// Start the server
+			errc <- http.Serve(s.listener, LoggingMiddleware(s.handler))
+		}(s)
+	}
+	return <-errc
+}
+
+/*
+readUpload reads the file of an OctoPrint upload request into a payload that
+prints when the form asks for it. The SMFix tokens in the API key only
+apply to this upload and win over the command line. When it fails, the error
+response has been sent. The caller closes payload.File.
+*/
+func readUpload(w http.ResponseWriter, r *http.Request) (*Payload, bool) {
+	// Check if request is a POST request
+	if r.Method != http.MethodPost {
+		methodNotAllowedResponse(w, r.Method)
+		return nil, false
+	}
+
+	// refuse oversized uploads before reading them
+	if r.ContentLength > FILE_SIZE_MAX+maxFormOverhead {
+		tooLargeResponse(w)
+		return nil, false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, FILE_SIZE_MAX+maxFormOverhead)
+
+	err := r.ParseMultipartForm(maxMemory)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			tooLargeResponse(w)
+			return nil, false
+		}
+		internalServerErrorResponse(w, err.Error())
+		return nil, false
+	}
+
+	// Retrieve the uploaded file
+	file, fd, err := r.FormFile("file")
+	if err != nil {
+		badRequestResponse(w, err.Error())
+		return nil, false
+	}
+	if fd.Size > FILE_SIZE_MAX {
+		file.Close()
+		tooLargeResponse(w)
+		return nil, false
+	}
+
+	// Get print parameter if they upload+print the file
+	startPrint := r.FormValue("print") == "true"
+
+	payload := NewPayload(file, fd.Filename, fd.Size, startPrint)
+
+	applyAPIKeyFix(r, payload)
+	return payload, true
+}
+
+/*
+applyAPIKeyFix merges the SMFix passes in the API key of the request. After
+the separator even a short list like "trim" counts. A key without it is read
+as passes only on a server without API keys, and when it is longer than a few
+characters: a real key that happens to contain "trim" changes nothing.
+*/
+func applyAPIKeyFix(r *http.Request, payload *Payload) {
+	apiKey := requestAPIKey(r)
+	_, passes := splitAPIKey(apiKey)
+	if !strings.Contains(apiKey, apiKeyFixSeparator) && (hasAPIKeys(r) || len(passes) <= 5) {
+		return
+	}
+	if passes != "" {
+		payload.Fix = payload.Fix.Merge(fixOptionsFromApiKey(passes))
+		if args := payload.Fix.String(); args != "" {
+			log.Printf("SMFix with args: %s", args)
+		}
+	}
 }
 
 func writeResponse(w http.ResponseWriter, status int, body string) {
@@ -201,34 +385,12 @@ func internalServerErrorResponse(w http.ResponseWriter, err string) {
 	http.Error(w, err, http.StatusInternalServerError)
 }
 
+func tooLargeResponse(w http.ResponseWriter) {
+	log.Print("Request entity too large")
+	http.Error(w, errFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+}
+
 func badRequestResponse(w http.ResponseWriter, err string) {
 	log.Print("Bad request: ", err)
 	http.Error(w, err, http.StatusBadRequest)
 }
-
-func argumentsFromApi(str string) {
-	noTrim = strings.Contains(str, "notrim")
-	// noPreheat = strings.Contains(str, "nopreheat")
-	noShutoff = strings.Contains(str, "noshutoff")
-	// noReinforceTower = strings.Contains(str, "noreinforcetower")
-	noReplaceTool = strings.Contains(str, "noreplacetool")
-	msg := []string{}
-	if noTrim {
-		msg = append(msg, "-notrim")
-	}
-	// if noPreheat {
-	// 	msg = append(msg, "-nopreheat")
-	// }
-	if noShutoff {
-		msg = append(msg, "-noshutoff")
-	}
-	// if noReinforceTower {
-	// 	msg = append(msg, "-noreinforcetower")
-	// }
-	if noReplaceTool {
-		msg = append(msg, "-noreplacetool")
-	}
-	if len(msg) > 0 {
-		log.Printf("SMFix with args: %s", strings.Join(msg, " "))
-	}
-}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// comma separated API keys the OctoPrint server accepts
+	OctoPrintAPIKeys string
+	// file with more API keys, one per line
+	OctoPrintAPIKeyFile string
+)
+
+// apiKeyFixSeparator starts the SMFix passes after a real API key,
+// e.g. "0123456789abcdef+preheat-noshutoff"
+const apiKeyFixSeparator = "+"
+
+/*
+loadOctoPrintAPIKeys returns the keys of -api-keys and -api-key-file. In the
+file, empty lines and lines starting with # are skipped. No keys means the
+server takes every request, as it always did.
+*/
+func loadOctoPrintAPIKeys() ([]string, error) {
+	keys := splitList(OctoPrintAPIKeys)
+	if OctoPrintAPIKeyFile == "" {
+		return keys, nil
+	}
+	f, err := os.Open(OctoPrintAPIKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return keys, sc.Err()
+}
+
+// requestAPIKey finds the key where OctoPrint looks for it: the X-Api-Key
+// header, a bearer token or the apikey query parameter
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.URL.Query().Get("apikey")
+}
+
+// splitAPIKey splits "key+passes". Without the separator the whole key is
+// read for SMFix passes too, the way slicers set them before keys existed;
+// applyAPIKeyFix only does that while the server has no keys.
+func splitAPIKey(s string) (key, passes string) {
+	if i := strings.Index(s, apiKeyFixSeparator); i >= 0 {
+		return s[:i], s[i+len(apiKeyFixSeparator):]
+	}
+	return s, s
+}
+
+type apiKeysContextKey struct{}
+
+// withAPIKeys marks a request that came through a server with API keys, its
+// key is a real one and the SMFix passes only follow the separator
+func withAPIKeys(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeysContextKey{}, true))
+}
+
+func hasAPIKeys(r *http.Request) bool {
+	on, _ := r.Context().Value(apiKeysContextKey{}).(bool)
+	return on
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/*
+octoPrintAuth lets only requests with one of the keys through. Like OctoPrint,
+a request without a key gets 401 and one with an unknown key 403, both with a
+json error.
+*/
+func octoPrintAuth(listenAddr string, keys []string, next http.Handler) http.Handler {
+	if len(keys) == 0 {
+		if host, _, err := net.SplitHostPort(listenAddr); err != nil || !isLoopback(host) {
+			log.Printf("No OctoPrint API keys (-api-keys), anyone on the network can upload")
+		}
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _ := splitAPIKey(requestAPIKey(r))
+		if key == "" {
+			log.Printf("Request %s %s without API key", r.Method, r.URL.Path)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "You don't have the permission to access the requested resource. It is either read-protected or not readable by the server."})
+			return
+		}
+		for _, k := range keys {
+			if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+				next.ServeHTTP(w, withAPIKeys(r))
+				return
+			}
+		}
+		log.Printf("Request %s %s with an invalid API key", r.Method, r.URL.Path)
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Invalid API key"})
+	})
+}
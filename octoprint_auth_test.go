@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOctoPrintAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusOK, `{}`)
+	})
+	handler := octoPrintAuth("127.0.0.1:8844", []string{"secret", "other"}, ok)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		query  string
+		want   int
+	}{
+		{"no key", "", "", "", http.StatusUnauthorized},
+		{"wrong key", "X-Api-Key", "nope", "", http.StatusForbidden},
+		{"smfix passes only", "X-Api-Key", "preheat-noshutoff", "", http.StatusForbidden},
+		{"key", "X-Api-Key", "secret", "", http.StatusOK},
+		{"key with passes", "X-Api-Key", "other+preheat", "", http.StatusOK},
+		{"bearer", "Authorization", "Bearer secret", "", http.StatusOK},
+		{"query", "", "", "?apikey=secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/version"+tt.query, nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		if rec.Code != http.StatusOK && !strings.Contains(rec.Body.String(), `"error"`) {
+			t.Errorf("%s: body %s", tt.name, rec.Body)
+		}
+	}
+
+	// without keys everything goes through
+	rec := httptest.NewRecorder()
+	octoPrintAuth("127.0.0.1:8844", nil, ok).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("no keys: status %d", rec.Code)
+	}
+}
+
+func TestSplitAPIKey(t *testing.T) {
+	tests := []struct{ s, key, passes string }{
+		{"secret+preheat-noshutoff", "secret", "preheat-noshutoff"},
+		{"secret+", "secret", ""},
+		{"preheat-noshutoff", "preheat-noshutoff", "preheat-noshutoff"},
+	}
+	for _, tt := range tests {
+		if key, passes := splitAPIKey(tt.s); key != tt.key || passes != tt.passes {
+			t.Errorf("splitAPIKey(%q) = %q, %q", tt.s, key, passes)
+		}
+	}
+}
+
+func TestApplyAPIKeyFix(t *testing.T) {
+	tests := []struct {
+		keys []string
+		key  string
+		want FixOptions
+	}{
+		{nil, "secret+trim", FixOptions{"trim": true}},
+		{nil, "secret+notrim", FixOptions{"trim": false}},
+		{nil, "secret+", FixOptions{}},
+		{nil, "trim", FixOptions{}},
+		{nil, "preheat-noshutoff", FixOptions{"preheat": true, "shutoff": false}},
+		// with keys, a key without the separator is only a key
+		{[]string{"notrim-preheat"}, "notrim-preheat", FixOptions{}},
+		{[]string{"notrim-preheat"}, "notrim-preheat+trim", FixOptions{"trim": true}},
+	}
+	for _, tt := range tests {
+		payload := &Payload{}
+		h := octoPrintAuth("127.0.0.1:8844", tt.keys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			applyAPIKeyFix(r, payload)
+		}))
+		r := httptest.NewRequest(http.MethodPost, "/api/files/local", nil)
+		r.Header.Set("X-Api-Key", tt.key)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if payload.Fix.String() != tt.want.String() {
+			t.Errorf("keys %v, %q: fix = %v, want %v", tt.keys, tt.key, payload.Fix, tt.want)
+		}
+	}
+}
+
+func TestLoadOctoPrintAPIKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(file, []byte("# slicers\nfromfile\n\n  spaced  \n"), 0644)
+	origKeys, origFile := OctoPrintAPIKeys, OctoPrintAPIKeyFile
+	OctoPrintAPIKeys, OctoPrintAPIKeyFile = "a, b", file
+	t.Cleanup(func() { OctoPrintAPIKeys, OctoPrintAPIKeyFile = origKeys, origFile })
+
+	keys, err := loadOctoPrintAPIKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "fromfile", "spaced"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+
+	OctoPrintAPIKeyFile = file + ".missing"
+	if _, err := loadOctoPrintAPIKeys(); err == nil {
+		t.Error("a missing key file was ignored")
+	}
+}
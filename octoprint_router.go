@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const octoPrintPrinterPrefix = "/printer/"
+
+type octoPrintPrinter struct {
+	printer *Printer
+	stats   *stats
+	handler http.Handler
+	// the same with the PrusaLink API
+	prusaLinkHandler http.Handler
+}
+
+/*
+octoPrintRouter sends every request to the OctoPrint and Moonraker API of
+one printer: the one named in a /printer/<id>/ path prefix, the one whose
+api_key: came with the request, or the only one there is. The root page lists
+the printers. The copy prusaLink returns serves the PrusaLink API too.
+*/
+type octoPrintRouter struct {
+	printers  []*octoPrintPrinter
+	start     time.Time
+	withPrusa bool
+}
+
+func newOctoPrintRouter(printers []*Printer) *octoPrintRouter {
+	r := &octoPrintRouter{start: time.Now()}
+	for _, printer := range printers {
+		st := newStats()
+		st.seed(printer)
+		status := newPrinterStatusCache(printer, octoPrintStatusTTL)
+		r.printers = append(r.printers, &octoPrintPrinter{
+			printer:          printer,
+			stats:            st,
+			handler:          octoPrintMux(printer, st, status),
+			prusaLinkHandler: prusaLinkHandler(printer, st, status),
+		})
+	}
+	return r
+}
+
+// prusaLink routes the same printers to their PrusaLink API as well
+func (rt *octoPrintRouter) prusaLink() *octoPrintRouter {
+	return &octoPrintRouter{printers: rt.printers, start: rt.start, withPrusa: true}
+}
+
+func (rt *octoPrintRouter) handler(p *octoPrintPrinter) http.Handler {
+	if rt.withPrusa {
+		return p.prusaLinkHandler
+	}
+	return p.handler
+}
+
+// keys returns the API keys of the printers
+func (rt *octoPrintRouter) keys() []string {
+	keys := []string{}
+	for _, p := range rt.printers {
+		if p.printer.APIKey != "" {
+			keys = append(keys, p.printer.APIKey)
+		}
+	}
+	return keys
+}
+
+func (rt *octoPrintRouter) find(host string) *octoPrintPrinter {
+	for _, p := range rt.printers {
+		if strings.EqualFold(p.printer.ID, host) || p.printer.Addr() == host {
+			return p
+		}
+	}
+	return nil
+}
+
+func (rt *octoPrintRouter) byKey(key string) *octoPrintPrinter {
+	for _, p := range rt.printers {
+		if key != "" && p.printer.APIKey == key {
+			return p
+		}
+	}
+	return nil
+}
+
+func (rt *octoPrintRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, _ := splitAPIKey(requestAPIKey(r))
+	keyed := rt.byKey(key)
+
+	// Moonraker has its own /printer/ paths, those are not printer names
+	host, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, octoPrintPrinterPrefix), "/")
+	if p := rt.find(host); strings.HasPrefix(r.URL.Path, octoPrintPrinterPrefix) && p != nil {
+		if keyed != nil && keyed != p {
+			// the key of one printer does not open another
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "Invalid API key"})
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path, r2.URL.RawPath = "/"+path, ""
+		rt.handler(p).ServeHTTP(w, r2)
+		return
+	}
+
+	switch {
+	case keyed != nil:
+		rt.handler(keyed).ServeHTTP(w, r)
+	case len(rt.printers) == 1:
+		rt.handler(rt.printers[0]).ServeHTTP(w, r)
+	case r.URL.Path == "/":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeResponse(w, http.StatusOK, rt.String())
+	case r.URL.Path == "/api/version":
+		versionHandler(w, r)
+	case r.URL.Path == "/server/info":
+		// slicers test the Moonraker connection with it
+		moonrakerResult(w, http.StatusOK, map[string]interface{}{
+			"klippy_connected":   false,
+			"klippy_state":       "startup",
+			"moonraker_version":  moonrakerVersion,
+			"api_version_string": "1.0.0",
+		})
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{
+			"error": "Choose a printer with " + octoPrintPrinterPrefix + "<id>/ or its API key",
+		})
+	}
+}
+
+// String is the root page, every printer with its protocol and last upload
+func (rt *octoPrintRouter) String() string {
+	buf := bytes.Buffer{}
+	buf.WriteString("sm2uploader " + Version + " - https://github.com/macdylan/sm2uploader\n\n")
+	buf.WriteString("uptime: " + time.Since(rt.start).Round(time.Second).String() + "\n\n")
+
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PRINTER\tIP\tMODEL\tPROTOCOL\tURL\tLAST UPLOAD")
+	for _, p := range rt.printers {
+		protocol := "HTTP"
+		if p.printer.Sacp {
+			protocol = "SACP"
+		}
+		upload := "-"
+		if l, ok := p.stats.lastUpload(); l != nil {
+			result := "ok"
+			if !ok {
+				result = "failed"
+			}
+			upload = fmt.Sprintf("%s %s (%s) %s", l.time.Format(time.RFC3339), l.filename, humanReadableSize(l.size), result)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", p.printer.Name(), p.printer.Addr(), p.printer.Model, protocol,
+			octoPrintPrinterPrefix+p.printer.Name()+"/", upload)
+	}
+	tw.Flush()
+	return buf.String()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOctoPrintRouter(t *testing.T) {
+	fp, fake := startFakePrinter(t, true)
+	fake.APIKey = "fakekey"
+	other := &Printer{ID: "J1B", IP: "192.0.2.2", APIKey: "otherkey"}
+	rt := newOctoPrintRouter([]*Printer{fake, other})
+
+	get := func(path, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if key != "" {
+			r.Header.Set("X-Api-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, r)
+		return rec
+	}
+
+	tests := []struct {
+		path, key string
+		code      int
+		body      string
+	}{
+		{"/", "", http.StatusOK, "/printer/J1B/"},
+		{"/api/version", "", http.StatusOK, "OctoPrint"},
+		{"/printer/j1b/", "", http.StatusOK, "printer id: J1B"},
+		{"/printer/192.0.2.2/", "", http.StatusOK, "printer id: J1B"},
+		{"/", "otherkey", http.StatusOK, "printer id: J1B"},
+		{"/", "fakekey+preheat", http.StatusOK, "printer id: FAKE1"},
+		{"/printer/J1B/", "fakekey", http.StatusForbidden, "Invalid API key"},
+		{"/printer/nope/api/job", "", http.StatusNotFound, "Choose a printer"},
+		{"/api/job", "", http.StatusNotFound, "Choose a printer"},
+	}
+	for _, tt := range tests {
+		rec := get(tt.path, tt.key)
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("GET %s with %q = %d %s", tt.path, tt.key, rec.Code, rec.Body)
+		}
+	}
+
+	// an upload by path prefix goes to that printer and shows on the root page
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "routed.gcode")
+	fw.Write([]byte("G28\nG1 X1\n"))
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/printer/FAKE1/api/files/local", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload = %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fp.File("routed.gcode"); !ok {
+		t.Error("the printer did not get the upload")
+	}
+	if page := get("/", "").Body.String(); !strings.Contains(page, "routed.gcode") {
+		t.Errorf("root page without the last upload:\n%s", page)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// how long a printer status answers the OctoPrint and Moonraker APIs
+	// before it is asked again
+	octoPrintStatusTTL = 2 * time.Second
+	// how long a request waits for the printer before it gets the last
+	// status, or offline
+	octoPrintStatusWait = 2 * time.Second
+
+	errStatusPending = errors.New("the printer has not answered yet")
+)
+
+/*
+printerStatusCache asks the printer for its status at most once per ttl.
+Slicers poll /api/printer and /api/job together every few seconds, and every
+query is a new connection to the printer. Asking an offline printer takes a
+while, and an HTTP printer waits for the touchscreen: one refresh runs in the
+background and requests wait for it at most octoPrintStatusWait.
+*/
+type printerStatusCache struct {
+	printer *Printer
+	ttl     time.Duration
+
+	mu  sync.Mutex
+	st  *PrinterStatus
+	err error
+	at  time.Time
+	// closed when the running refresh is done, nil without one
+	refresh chan struct{}
+}
+
+func newPrinterStatusCache(printer *Printer, ttl time.Duration) *printerStatusCache {
+	return &printerStatusCache{printer: printer, ttl: ttl}
+}
+
+func (c *printerStatusCache) Get() (*PrinterStatus, error) {
+	c.mu.Lock()
+	if !c.at.IsZero() && time.Since(c.at) < c.ttl {
+		defer c.mu.Unlock()
+		return c.st, c.err
+	}
+	if c.refresh != nil && !c.at.IsZero() {
+		// the refresh of an earlier request is still running
+		defer c.mu.Unlock()
+		return c.st, c.err
+	}
+	if c.refresh == nil {
+		c.refresh = make(chan struct{})
+		go c.update(c.refresh)
+	}
+	refresh := c.refresh
+	c.mu.Unlock()
+
+	select {
+	case <-refresh:
+	case <-time.After(octoPrintStatusWait):
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.at.IsZero() {
+		return nil, errStatusPending
+	}
+	return c.st, c.err
+}
+
+func (c *printerStatusCache) update(done chan struct{}) {
+	st, err := Connector.Status(c.printer)
+	c.mu.Lock()
+	c.st, c.err, c.at = st, err, time.Now()
+	c.refresh = nil
+	c.mu.Unlock()
+	close(done)
+}
+
+type octoPrintFlags struct {
+	Operational   bool `json:"operational"`
+	Printing      bool `json:"printing"`
+	Pausing       bool `json:"pausing"`
+	Paused        bool `json:"paused"`
+	Cancelling    bool `json:"cancelling"`
+	SdReady       bool `json:"sdReady"`
+	Error         bool `json:"error"`
+	Ready         bool `json:"ready"`
+	ClosedOrError bool `json:"closedOrError"`
+}
+
+// octoPrintState turns the printer status into the state text and flags of
+// OctoPrint, a printer that cannot be asked is offline
+func octoPrintState(st *PrinterStatus, err error) (string, octoPrintFlags) {
+	if err != nil || st == nil {
+		return "Offline", octoPrintFlags{ClosedOrError: true}
+	}
+	flags := octoPrintFlags{Operational: true}
+	text := "Operational"
+	switch st.State {
+	case StatePausing:
+		text, flags.Pausing = "Pausing", true
+	case StatePaused:
+		text, flags.Paused = "Paused", true
+	case StateStopping:
+		text, flags.Cancelling = "Cancelling", true
+	case StateStarting, StateRunning, StateFinishing, StateRecovering, StateResuming:
+		text, flags.Printing = "Printing", true
+	default:
+		flags.Ready = true
+	}
+	return text, flags
+}
+
+type octoPrintTemperature struct {
+	Actual float64 `json:"actual"`
+	Target float64 `json:"target"`
+	Offset float64 `json:"offset"`
+}
+
+func octoPrintTemperatures(st *PrinterStatus) map[string]octoPrintTemperature {
+	temps := map[string]octoPrintTemperature{
+		"bed": {Actual: st.Bed.Current, Target: st.Bed.Target},
+	}
+	for i, n := range st.Nozzles {
+		temps["tool"+strconv.Itoa(i)] = octoPrintTemperature{Actual: n.Current, Target: n.Target}
+	}
+	return temps
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		internalServerErrorResponse(w, err.Error())
+		return
+	}
+	writeResponse(w, status, string(b))
+}
+
+// octoPrintStatusHandlers serves /api/printer, /api/job and /api/connection
+// from the status of printer
+func octoPrintStatusHandlers(mux *http.ServeMux, printer *Printer, status *printerStatusCache) {
+	mux.HandleFunc("/api/printer", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowedResponse(w, r.Method)
+			return
+		}
+		st, err := status.Get()
+		if err != nil {
+			// what OctoPrint answers when the serial port is closed
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "Printer is not operational"})
+			return
+		}
+		exclude := map[string]bool{}
+		for _, k := range strings.Split(r.URL.Query().Get("exclude"), ",") {
+			exclude[strings.TrimSpace(k)] = true
+		}
+		resp := map[string]interface{}{}
+		if !exclude["temperature"] {
+			resp["temperature"] = octoPrintTemperatures(st)
+		}
+		if !exclude["sd"] {
+			resp["sd"] = map[string]bool{"ready": false}
+		}
+		if !exclude["state"] {
+			text, flags := octoPrintState(st, nil)
+			resp["state"] = map[string]interface{}{"text": text, "flags": flags}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc("/api/job", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowedResponse(w, r.Method)
+			return
+		}
+		st, err := status.Get()
+		text, _ := octoPrintState(st, err)
+
+		// OctoPrint leaves out what it does not know as null
+		var (
+			file                               = map[string]interface{}{"name": nil, "path": nil, "origin": nil, "size": nil, "date": nil}
+			completion, printTime, timeLeft    interface{}
+			estimatedPrintTime, timeLeftOrigin interface{}
+		)
+		if err == nil && st.File != "" {
+			file["name"], file["path"], file["origin"] = st.File, st.File, "local"
+			completion = st.Progress * 100
+			printTime = int(st.Elapsed.Seconds())
+			if st.Remaining > 0 {
+				timeLeft, timeLeftOrigin = int(st.Remaining.Seconds()), "estimate"
+				estimatedPrintTime = int((st.Elapsed + st.Remaining).Seconds())
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"job": map[string]interface{}{
+				"file":               file,
+				"estimatedPrintTime": estimatedPrintTime,
+				"filament":           nil,
+				"user":               nil,
+			},
+			"progress": map[string]interface{}{
+				"completion":          completion,
+				"filepos":             nil,
+				"printTime":           printTime,
+				"printTimeLeft":       timeLeft,
+				"printTimeLeftOrigin": timeLeftOrigin,
+			},
+			"state": text,
+		})
+	})
+
+	mux.HandleFunc("/api/connection", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			// the printer connection is not ours to open or close
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			methodNotAllowedResponse(w, r.Method)
+			return
+		}
+		text, _ := octoPrintState(status.Get())
+		port := printer.Addr()
+		profile := map[string]string{"id": "_default", "name": printer.Model}
+		if profile["name"] == "" {
+			profile["name"] = "Snapmaker"
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"current": map[string]interface{}{
+				"state":          text,
+				"port":           port,
+				"baudrate":       nil,
+				"printerProfile": "_default",
+			},
+			"options": map[string]interface{}{
+				"ports":                    []string{port},
+				"baudrates":                []int{},
+				"printerProfiles":          []map[string]string{profile},
+				"portPreference":           port,
+				"baudratePreference":       nil,
+				"printerProfilePreference": "_default",
+				"autoconnect":              true,
+			},
+		})
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func getOctoPrintJSON(t *testing.T, mux http.Handler, path string, want int) map[string]interface{} {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != want {
+		t.Fatalf("GET %s = %d, want %d: %s", path, rec.Code, want, rec.Body)
+	}
+	resp := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	return resp
+}
+
+func TestOctoPrintStatusEndpoints(t *testing.T) {
+	for _, sacp := range []bool{true, false} {
+		fp, printer := startFakePrinter(t, sacp)
+		content := []byte("G28\nG1 X10\n")
+		if err := Connector.Upload(printer, NewPayload(bytes.NewReader(content), "job.gcode", int64(len(content)), true)); err != nil {
+			t.Fatal(err)
+		}
+		fp.setTarget(0, 210)
+
+		mux := http.NewServeMux()
+		octoPrintStatusHandlers(mux, printer, newPrinterStatusCache(printer, octoPrintStatusTTL))
+
+		p := getOctoPrintJSON(t, mux, "/api/printer", http.StatusOK)
+		tool0 := p["temperature"].(map[string]interface{})["tool0"].(map[string]interface{})
+		state := p["state"].(map[string]interface{})
+		flags := state["flags"].(map[string]interface{})
+		if tool0["target"] != 210.0 || state["text"] != "Printing" || flags["printing"] != true || flags["ready"] != false {
+			t.Errorf("sacp=%v /api/printer = %v", sacp, p)
+		}
+		if p := getOctoPrintJSON(t, mux, "/api/printer?exclude=temperature,sd", http.StatusOK); len(p) != 1 {
+			t.Errorf("sacp=%v excluded /api/printer = %v", sacp, p)
+		}
+
+		job := getOctoPrintJSON(t, mux, "/api/job", http.StatusOK)
+		file := job["job"].(map[string]interface{})["file"].(map[string]interface{})
+		progress := job["progress"].(map[string]interface{})
+		if file["name"] != "job.gcode" || job["state"] != "Printing" || progress["completion"] == nil {
+			t.Errorf("sacp=%v /api/job = %v", sacp, job)
+		}
+
+		conn := getOctoPrintJSON(t, mux, "/api/connection", http.StatusOK)
+		if conn["current"].(map[string]interface{})["state"] != "Printing" {
+			t.Errorf("sacp=%v /api/connection = %v", sacp, conn)
+		}
+	}
+}
+
+func TestOctoPrintStatusOffline(t *testing.T) {
+	// a port nobody listens on anymore
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	origSACP, origHTTP := SACPPort, HTTPPort
+	SACPPort, HTTPPort = port, port
+	t.Cleanup(func() { SACPPort, HTTPPort = origSACP, origHTTP })
+
+	mux := http.NewServeMux()
+	offline := &Printer{IP: "127.0.0.1"}
+	octoPrintStatusHandlers(mux, offline, newPrinterStatusCache(offline, octoPrintStatusTTL))
+
+	getOctoPrintJSON(t, mux, "/api/printer", http.StatusConflict)
+	if job := getOctoPrintJSON(t, mux, "/api/job", http.StatusOK); job["state"] != "Offline" {
+		t.Errorf("/api/job = %v", job)
+	}
+}
+
+func TestPrinterStatusCacheDoesNotWait(t *testing.T) {
+	// an HTTP printer that waits for the touchscreen forever
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/connect":
+			writeJSON(w, http.StatusOK, map[string]string{"token": "pending"})
+		case "/api/v1/status":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	origHTTP, origWait := HTTPPort, octoPrintStatusWait
+	HTTPPort, octoPrintStatusWait = portOf(srv.Listener.Addr()), 100*time.Millisecond
+	t.Cleanup(func() { HTTPPort, octoPrintStatusWait = origHTTP, origWait })
+
+	c := newPrinterStatusCache(&Printer{IP: "127.0.0.1"}, octoPrintStatusTTL)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if st, err := c.Get(); err == nil {
+				t.Errorf("status of a printer that did not answer: %+v", st)
+			}
+		}()
+	}
+	wg.Wait()
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("requests took %s", took)
+	}
+	if text, _ := octoPrintState(c.Get()); text != "Offline" {
+		t.Errorf("state = %s", text)
+	}
+
+	// the refresh gives up once the printer is gone
+	srv.Close()
+	c.mu.Lock()
+	refresh := c.refresh
+	c.mu.Unlock()
+	if refresh != nil {
+		<-refresh
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gosuri/uilive"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// exit codes, scripts can tell what went wrong without parsing the logs
+const (
+	ExitOK              = 0
+	ExitError           = 1
+	ExitUsage           = 2
+	ExitPrinterNotFound = 3
+	ExitAuthDenied      = 4
+	ExitUploadFailed    = 5
+	ExitFileInvalid     = 6
+)
+
+var (
+	// Output is text or json, json prints events on stdout and leaves the
+	// human logs on stderr
+	Output = OutputText
+
+	eventOut = io.Writer(os.Stdout)
+	eventMu  sync.Mutex
+)
+
+/*
+Event is one line of the json output. Every event has its name and time, the
+other fields depend on the event:
+
+	printer     the printer a command runs on
+	discovered  a printer answered the discovery
+	host        a known host
+	progress    file, bytes, total and progress of a running upload
+	uploaded    file, bytes, md5 and duration of a finished upload
+	watching    a directory (file) that is watched for files to upload
+	failed      file, code and message of a watched file that was not uploaded
+	fixed       file, bytes and md5 of a file run through SMFix
+	job         action (start, pause, resume, stop) and file
+	preheat     the temperatures were set, or the printer homed
+	status      what the printer is doing
+	queue       a job of the queue, when it is listed, added or over
+	error       code, exit code and message of the error that ended the command
+*/
+type Event struct {
+	Event    string         `json:"event"`
+	Time     time.Time      `json:"time"`
+	Printer  *Printer       `json:"printer,omitempty"`
+	File     string         `json:"file,omitempty"`
+	Bytes    int64          `json:"bytes,omitempty"`
+	Total    int64          `json:"total,omitempty"`
+	Progress float64        `json:"progress,omitempty"` // 0 to 1
+	MD5      string         `json:"md5,omitempty"`
+	Duration float64        `json:"duration,omitempty"` // seconds
+	Print    bool           `json:"print,omitempty"`
+	Action   string         `json:"action,omitempty"`
+	Status   *PrinterStatus `json:"status,omitempty"`
+	Job      *Job           `json:"job,omitempty"`
+	From     string         `json:"from,omitempty"` // the old address of a printer that moved
+	Code     string         `json:"code,omitempty"`
+	Exit     int            `json:"exit,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+func jsonOutput() bool {
+	return Output == OutputJSON
+}
+
+// emit prints ev as a line of json, in text mode it does nothing
+func emit(ev Event) {
+	if !jsonOutput() {
+		return
+	}
+	ev.Time = time.Now()
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	if err := json.NewEncoder(eventOut).Encode(ev); err != nil {
+		log.Printf("write event error: %v", err)
+	}
+}
+
+// errorCode sorts err into the stable code and exit code it ends the
+// program with
+func errorCode(err error) (string, int) {
+	switch {
+	case errors.Is(err, errUsage):
+		return "usage", ExitUsage
+	case errors.Is(err, errFileInvalid), errors.Is(err, errFileEmpty), errors.Is(err, errFileTooLarge):
+		return "file_invalid", ExitFileInvalid
+	case errors.Is(err, errAccessDenied):
+		return "auth_denied", ExitAuthDenied
+	case errors.Is(err, errPrinterNotFound):
+		return "printer_not_found", ExitPrinterNotFound
+	case errors.Is(err, errUploadFailed):
+		return "upload_failed", ExitUploadFailed
+	}
+	return "error", ExitError
+}
+
+// exitWithError reports err on stderr and as an error event, and exits with
+// its exit code
+func exitWithError(err error) {
+	code, exit := errorCode(err)
+	log.Println(err)
+	emit(Event{Event: "error", Code: code, Exit: exit, Error: err.Error()})
+	os.Exit(exit)
+}
+
+// exitWithPanic reports a panic main recovered from, with the stack, and
+// exits with ExitError
+func exitWithPanic(r interface{}) {
+	reportPanic(os.Stderr, r, debug.Stack())
+	os.Exit(ExitError)
+}
+
+func reportPanic(w io.Writer, r interface{}, stack []byte) {
+	fmt.Fprintf(w, "panic: %v\n\n%s", r, stack)
+	emit(Event{Event: "error", Code: "panic", Exit: ExitError, Error: fmt.Sprint("panic: ", r)})
+}
+
+// uploadProgress is the progress of one upload, shown on its own line while
+// uploads to several printers run at the same time
+type uploadProgress struct {
+	proto   string
+	printer *Printer
+	file    string
+	line    string
+	last    int // the last whole percent sent as an event
+}
+
+// newProgress starts showing the progress of an upload, call Done when the
+// upload is over
+func newProgress(proto string, printer *Printer, file string) *uploadProgress {
+	p := &uploadProgress{proto: proto, printer: printer, file: file, last: -1}
+	if !jsonOutput() {
+		board.add(p)
+	}
+	return p
+}
+
+/*
+Update is called with the bytes sent so far. Text mode redraws the progress
+lines, json prints an event whenever another percent is done.
+*/
+func (p *uploadProgress) Update(sent, total int64) {
+	if !jsonOutput() {
+		to := p.file
+		if p.printer != nil {
+			to += " to " + p.printer.Name()
+		}
+		if total > 0 {
+			board.update(p, fmt.Sprintf("  - %s sending %.1f%% %s", p.proto, float64(sent)/float64(total)*100.0, to))
+		} else {
+			board.update(p, fmt.Sprintf("  - %s sending %s... %s", p.proto, humanReadableSize(sent), to))
+		}
+		return
+	}
+	ev := Event{Event: "progress", Printer: p.printer, File: p.file, Bytes: sent, Total: total}
+	if total > 0 {
+		ev.Progress = float64(sent) / float64(total)
+		if perc := int(ev.Progress * 100); perc > p.last {
+			p.last = perc
+			emit(ev)
+		}
+	}
+}
+
+func (p *uploadProgress) Done() {
+	if !jsonOutput() {
+		board.remove(p)
+	}
+}
+
+// how often the progress lines are redrawn at most
+const progressRedraw = 50 * time.Millisecond
+
+/*
+progressBoard keeps one refreshing line per running upload at the bottom of
+stderr. It is the output of the log too, so log lines are printed above the
+progress lines instead of breaking them.
+*/
+type progressBoard struct {
+	mu    sync.Mutex
+	w     *uilive.Writer
+	lines []*uploadProgress
+	drawn time.Time
+}
+
+var board = &progressBoard{}
+
+func (b *progressBoard) add(p *uploadProgress) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.lines) == 0 {
+		b.w = uilive.New()
+	}
+	b.lines = append(b.lines, p)
+}
+
+func (b *progressBoard) update(p *uploadProgress, line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p.line = line
+	if time.Since(b.drawn) >= progressRedraw {
+		b.draw()
+	}
+}
+
+// remove draws the last state of p and takes its line away, the lines of the
+// last upload stay on screen
+func (b *progressBoard) remove(p *uploadProgress) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, l := range b.lines {
+		if l == p {
+			b.draw()
+			b.lines = append(b.lines[:i], b.lines[i+1:]...)
+			break
+		}
+	}
+	if len(b.lines) == 0 {
+		b.w = nil
+	}
+}
+
+func (b *progressBoard) draw() {
+	if b.w == nil {
+		return
+	}
+	for _, l := range b.lines {
+		if l.line != "" {
+			fmt.Fprintln(b.w, l.line)
+		}
+	}
+	b.w.Flush()
+	b.drawn = time.Now()
+}
+
+func (b *progressBoard) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.w == nil {
+		return os.Stderr.Write(p)
+	}
+	n, err := b.w.Bypass().Write(p)
+	b.draw()
+	return n, err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+		exit int
+	}{
+		{errors.New("boom"), "error", ExitError},
+		{errNoInputFiles, "usage", ExitUsage},
+		{fmt.Errorf("%w: 10.0.0.9 is not available", errPrinterNotFound), "printer_not_found", ExitPrinterNotFound},
+		{fmt.Errorf("%w: a.gcode: %w", errUploadFailed, errAccessDenied), "auth_denied", ExitAuthDenied},
+		{fmt.Errorf("%w: a.gcode: %w", errUploadFailed, errFileEmpty), "file_invalid", ExitFileInvalid},
+		{fmt.Errorf("%w: a.gcode: %w", errUploadFailed, errUploadRejected), "upload_failed", ExitUploadFailed},
+		{fmt.Errorf("%w: open a.gcode: no such file", errFileInvalid), "file_invalid", ExitFileInvalid},
+	}
+	for _, tt := range tests {
+		code, exit := errorCode(tt.err)
+		if code != tt.code || exit != tt.exit {
+			t.Errorf("errorCode(%v) = %s, %d, want %s, %d", tt.err, code, exit, tt.code, tt.exit)
+		}
+	}
+}
+
+func TestReportPanic(t *testing.T) {
+	origOutput, origOut := Output, eventOut
+	t.Cleanup(func() { Output, eventOut = origOutput, origOut })
+	events, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	Output, eventOut = OutputJSON, events
+
+	reportPanic(stderr, "index out of range", []byte("goroutine 1 [running]:\nmain.main()\n"))
+	if !strings.HasPrefix(stderr.String(), "panic: index out of range\n") || !strings.Contains(stderr.String(), "main.main()") {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+	var ev Event
+	if err := json.Unmarshal(events.Bytes(), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Event != "error" || ev.Code != "panic" || ev.Exit != ExitError || ev.Error != "panic: index out of range" {
+		t.Errorf("event = %+v", ev)
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	origOutput, origOut := Output, eventOut
+	t.Cleanup(func() { Output, eventOut = origOutput, origOut })
+	buf := &bytes.Buffer{}
+	Output, eventOut = OutputJSON, buf
+
+	progress := newProgress("SACP", &Printer{IP: "127.0.0.1"}, "a.gcode")
+	for sent := int64(0); sent <= 1000; sent += 5 {
+		progress.Update(sent, 1000)
+	}
+	progress.Done()
+
+	dec := json.NewDecoder(buf)
+	n := 0
+	for dec.More() {
+		var ev Event
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Event != "progress" || ev.File != "a.gcode" || ev.Total != 1000 || ev.Time.IsZero() {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+		n++
+	}
+	// one event per percent, from 0 to 100
+	if n != 101 {
+		t.Errorf("got %d progress events, want 101", n)
+	}
+}
+
+func TestPrinterStatusJSON(t *testing.T) {
+	st := &PrinterStatus{State: StateRunning, Progress: 0.5, Elapsed: 90 * time.Second, Remaining: 1500 * time.Millisecond}
+	b, err := json.Marshal(Event{Event: "status", Status: st})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"elapsed":90,"remaining":1.5`) || !strings.Contains(string(b), `"state":"RUNNING"`) {
+		t.Errorf("status event = %s", b)
+	}
+	var ev Event
+	if err := json.Unmarshal(b, &ev); err != nil || !reflect.DeepEqual(ev.Status, st) {
+		t.Errorf("read back %+v, %v", ev.Status, err)
+	}
+}
@@ -1,47 +1,198 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Printer struct {
-	IP    string `yaml:"ip"`
-	ID    string `yaml:"id"`
-	Model string `yaml:"model"`
-	Token string `yaml:"token"`
-	Sacp  bool   `yaml:"sacp"`
+	IP    string     `yaml:"ip" json:"ip"`
+	ID    string     `yaml:"id" json:"id"`
+	Model string     `yaml:"model" json:"model"`
+	Token string     `yaml:"token" json:"-"`
+	Sacp  bool       `yaml:"sacp" json:"sacp"`
+	Fix   FixOptions `yaml:"fix,omitempty" json:"fix,omitempty"`
+
+	// set by hand in hosts.yaml, for the jobs of the queue; a printer that
+	// names its toolhead in the discovery reply starts with that one
+	Toolhead string   `yaml:"toolhead,omitempty" json:"toolhead,omitempty"`
+	Tags     []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+
+	// set by hand in hosts.yaml, for an OctoPrint server of several printers:
+	// the key that picks this printer, and its own listen address
+	APIKey string `yaml:"api_key,omitempty" json:"-"`
+	Listen string `yaml:"listen,omitempty" json:"listen,omitempty"`
+
+	// what the last discovery reply said, not kept in hosts.yaml: the state,
+	// the firmware when the printer tells, and every key:value pair
+	Status   string            `yaml:"-" json:"status,omitempty"`
+	Firmware string            `yaml:"-" json:"firmware,omitempty"`
+	Fields   map[string]string `yaml:"-" json:"fields,omitempty"`
 }
 
+var (
+	errDiscoveryReply = errors.New("invalid discovery reply")
+
+	// printersMu guards what the discovery service changes on printers that
+	// other goroutines use: the address, what the last reply said and the
+	// printers of the known hosts
+	printersMu sync.RWMutex
+)
+
 /*
 NewPrinter parses a discovery response such as
 "Snapmaker J1X123P@192.168.1.201|model:Snapmaker J1|status:IDLE|SACP:1"
-and returns a Printer instance.
+and returns a Printer instance. The first field is the id and the address,
+the others are key:value pairs; all of them are kept in Fields, with the keys
+in lower case. The model is required, an unknown key is fine, anything that
+is not a key:value pair or says a key twice is not.
 */
 func NewPrinter(resp []byte) (*Printer, error) {
-	msg := string(resp)
-	if !strings.Contains(msg, "|model:") || !strings.Contains(msg, "@") {
-		return nil, errors.New("invalid response")
-	}
-	var (
-		parts = strings.Split(msg, "|")
-		id    = parts[0][:strings.LastIndex(parts[0], "@")]
-		ip    = parts[0][strings.LastIndex(parts[0], "@")+1:]
-		model = parts[1][strings.Index(parts[1], ":")+1:]
-		sacp  = strings.Contains(msg, "SACP:1")
-	)
-
-	return &Printer{
-		IP:    ip,
-		ID:    id,
-		Model: model,
-		Token: "",
-		Sacp:  sacp,
-	}, nil
+	msg := strings.TrimRight(string(resp), "\x00\r\n ")
+	if !utf8.ValidString(msg) {
+		return nil, fmt.Errorf("%w: not UTF-8", errDiscoveryReply)
+	}
+	for _, r := range msg {
+		if unicode.IsControl(r) {
+			return nil, fmt.Errorf("%w: control character %q", errDiscoveryReply, r)
+		}
+	}
+
+	parts := strings.Split(msg, "|")
+	at := strings.LastIndex(parts[0], "@")
+	if at < 0 {
+		return nil, fmt.Errorf("%w: no id@ip in %q", errDiscoveryReply, parts[0])
+	}
+	id, ip := strings.TrimSpace(parts[0][:at]), parts[0][at+1:]
+	if id == "" {
+		return nil, fmt.Errorf("%w: no id", errDiscoveryReply)
+	}
+	if net.ParseIP(ip).To4() == nil {
+		return nil, fmt.Errorf("%w: %q is not an IPv4 address", errDiscoveryReply, ip)
+	}
+
+	fields := map[string]string{}
+	for _, part := range parts[1:] {
+		key, value, ok := strings.Cut(part, ":")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || !validDiscoveryKey(key) {
+			return nil, fmt.Errorf("%w: %q is not a key:value pair", errDiscoveryReply, part)
+		}
+		if _, dup := fields[key]; dup {
+			return nil, fmt.Errorf("%w: %s twice", errDiscoveryReply, key)
+		}
+		fields[key] = strings.TrimSpace(value)
+	}
+	if fields["model"] == "" {
+		return nil, fmt.Errorf("%w: no model", errDiscoveryReply)
+	}
+
+	p := &Printer{
+		IP:       ip,
+		ID:       id,
+		Model:    fields["model"],
+		Token:    "",
+		Sacp:     fields["sacp"] == "1",
+		Status:   strings.ToUpper(fields["status"]),
+		Firmware: firstField(fields, "firmware", "version", "fw"),
+		Toolhead: firstField(fields, "toolhead", "head"),
+		Fields:   fields,
+	}
+	return p, nil
+}
+
+// validDiscoveryKey allows letters, digits, '_', '-' and '.'
+func validDiscoveryKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func firstField(fields map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v := fields[k]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// IsBusy tells whether the last discovery reply had the printer in a job
+func (p *Printer) IsBusy() bool {
+	printersMu.RLock()
+	status := p.Status
+	printersMu.RUnlock()
+	if status == "" {
+		return false
+	}
+	return (&PrinterStatus{State: status}).IsBusy()
+}
+
+// Addr is the address of the printer, which changes when it moves
+func (p *Printer) Addr() string {
+	printersMu.RLock()
+	defer printersMu.RUnlock()
+	return p.IP
+}
+
+// GetToken is the token of the HTTP API, the connection changes it
+func (p *Printer) GetToken() string {
+	printersMu.RLock()
+	defer printersMu.RUnlock()
+	return p.Token
+}
+
+func (p *Printer) SetToken(token string) {
+	printersMu.Lock()
+	p.Token = token
+	printersMu.Unlock()
+}
+
+// Name is the ID of the printer, or its address before it is known
+func (p *Printer) Name() string {
+	if p.ID != "" {
+		return p.ID
+	}
+	return p.Addr()
+}
+
+// MarshalJSON reads the printer under the lock, it may be moving
+func (p *Printer) MarshalJSON() ([]byte, error) {
+	type plain Printer
+	printersMu.RLock()
+	c := plain(*p)
+	printersMu.RUnlock()
+	return json.Marshal(&c)
+}
+
+func (p *Printer) HasTag(tag string) bool {
+	for _, t := range p.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
 }
 
 /* Name for promptui */
 func (p *Printer) String() string {
-	return fmt.Sprintf("%s@%s - %s", p.ID, p.IP, p.Model)
+	printersMu.RLock()
+	defer printersMu.RUnlock()
+	s := fmt.Sprintf("%s@%s - %s", p.ID, p.IP, p.Model)
+	if p.Status != "" {
+		s += " (" + p.Status + ")"
+	}
+	return s
 }
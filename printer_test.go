@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/manifoldco/promptui"
+)
+
+func TestNewPrinter(t *testing.T) {
+	p, err := NewPrinter([]byte("Snapmaker J1X123P@192.168.1.201|model:Snapmaker J1|status:RUNNING|SACP:1|version:V2.5.1|toolhead:dual\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != "Snapmaker J1X123P" || p.IP != "192.168.1.201" || p.Model != "Snapmaker J1" || !p.Sacp {
+		t.Errorf("printer = %+v", p)
+	}
+	if p.Status != StateRunning || !p.IsBusy() || p.Firmware != "V2.5.1" || p.Toolhead != "dual" || p.Fields["sacp"] != "1" {
+		t.Errorf("fields = %+v", p)
+	}
+
+	// a Snapmaker 2 says less
+	p, err = NewPrinter([]byte("Snapmaker@10.0.5.20|model:Snapmaker 2 Model A350|status:IDLE"))
+	if err != nil || p.Sacp || p.IsBusy() || len(p.Fields) != 2 {
+		t.Errorf("Snapmaker 2 = %+v, %v", p, err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"discover",
+		"foo|model:x@y",
+		"@192.168.1.2|model:J1",
+		"J1@192.168.1.2",
+		"J1@192.168.1.2|model:",
+		"J1@printer.lan|model:J1",
+		"J1@192.168.1.2|model:J1|status",
+		"J1@192.168.1.2|model:J1|model:A350",
+		"J1@192.168.1.2|model:J1||",
+		"J1@192.168.1.2|model:J1|st atus:IDLE",
+		"J1@192.168.1.2|model:J1\nstatus:IDLE",
+		"J1@192.168.1.2|model:J1\xff",
+	} {
+		if p, err := NewPrinter([]byte(bad)); !errors.Is(err, errDiscoveryReply) {
+			t.Errorf("NewPrinter(%q) = %+v, %v", bad, p, err)
+		}
+	}
+}
+
+func FuzzNewPrinter(f *testing.F) {
+	for _, seed := range []string{
+		"Snapmaker J1X123P@192.168.1.201|model:Snapmaker J1|status:IDLE|SACP:1",
+		"Snapmaker@10.0.5.20|model:Snapmaker 2 Model A350|status:RUNNING",
+		"a@b@1.2.3.4|model:m|x:|y:1:2",
+		"foo|model:x@y",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, resp []byte) {
+		p, err := NewPrinter(resp)
+		if err != nil {
+			return
+		}
+		if p.ID == "" || p.Model == "" || net.ParseIP(p.IP).To4() == nil || p.Fields["model"] != p.Model {
+			t.Fatalf("NewPrinter(%q) = %+v", resp, p)
+		}
+		// what was read writes back to the same printer
+		reply := p.ID + "@" + p.IP
+		for k, v := range p.Fields {
+			reply += "|" + k + ":" + v
+		}
+		again, err := NewPrinter([]byte(reply))
+		if err != nil || again.ID != p.ID || again.IP != p.IP || again.Sacp != p.Sacp || len(again.Fields) != len(p.Fields) {
+			t.Fatalf("%q reads back as %+v, %v", reply, again, err)
+		}
+	})
+}
+
+func TestPrinterSelectTemplates(t *testing.T) {
+	tpl := template.Must(template.New("").Funcs(promptui.FuncMap).Parse(printerSelectTemplates.Active))
+	for _, p := range []*Printer{
+		{ID: "J1A", IP: "10.0.5.20", Model: "Snapmaker J1", Status: StateRunning},
+		{ID: "J1B", IP: "10.0.5.21", Model: "Snapmaker J1"},
+	} {
+		buf := bytes.Buffer{}
+		if err := tpl.Execute(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), p.ID+"@"+p.IP) || !strings.Contains(buf.String(), p.Status) {
+			t.Errorf("%s renders as %q", p.ID, buf.String())
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	// listen address of the PrusaLink front end, empty for none
+	PrusaLinkListenAddr string
+	// the Digest login PrusaSlicer sends, no password turns Digest off
+	PrusaLinkUser     = "maker"
+	PrusaLinkPassword string
+)
+
+// prusaLinkState turns the printer state into the state of PrusaLink
+func prusaLinkState(st *PrinterStatus) string {
+	switch st.State {
+	case StatePausing, StatePaused:
+		return "PAUSED"
+	case StateCompleted:
+		return "FINISHED"
+	case StateStopping, StateStopped:
+		return "STOPPED"
+	case StateIdle, StateUnknown:
+		return "IDLE"
+	}
+	return "PRINTING"
+}
+
+// printAfterUpload reads the Print-After-Upload header, a structured field
+// boolean ("?1") in PrusaSlicer, "1" or "true" in other clients
+func printAfterUpload(r *http.Request) bool {
+	switch strings.ToLower(r.Header.Get("Print-After-Upload")) {
+	case "?1", "1", "true":
+		return true
+	}
+	return false
+}
+
+// prusaLinkStorage is the only storage of the printer, PrusaSlicer uploads
+// to the first one that is not read only
+var prusaLinkStorage = map[string]interface{}{
+	"path":      "/local",
+	"name":      "local",
+	"type":      "LOCAL",
+	"read_only": false,
+	"available": true,
+}
+
+/*
+prusaLinkHandlers serves the /api/v1 part of the PrusaLink API that
+PrusaSlicer's PrusaLink host type uses. Uploads go the same way as the
+OctoPrint ones, the status comes from the same cache.
+*/
+func prusaLinkHandlers(mux *http.ServeMux, printer *Printer, status *printerStatusCache, _stats *stats) {
+	mux.HandleFunc("/api/v1/info", func(w http.ResponseWriter, r *http.Request) {
+		hostname, _ := os.Hostname()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"name":               printer.Name(),
+			"serial":             printer.ID,
+			"hostname":           hostname,
+			"nozzle_diameter":    0.4,
+			"mmu":                false,
+			"min_extrusion_temp": 170,
+		})
+	})
+
+	mux.HandleFunc("/api/v1/storage", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"storage_list": []interface{}{prusaLinkStorage},
+		})
+	})
+
+	mux.HandleFunc("/api/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		st, err := status.Get()
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"title": "Printer is not available", "message": err.Error()})
+			return
+		}
+		p := map[string]interface{}{
+			"state":      prusaLinkState(st),
+			"temp_bed":   st.Bed.Current,
+			"target_bed": st.Bed.Target,
+			"flow":       100,
+			"speed":      100,
+		}
+		if len(st.Nozzles) > 0 {
+			p["temp_nozzle"], p["target_nozzle"] = st.Nozzles[0].Current, st.Nozzles[0].Target
+		}
+		resp := map[string]interface{}{
+			"storage": prusaLinkStorage,
+			"printer": p,
+		}
+		if st.File != "" {
+			resp["job"] = map[string]interface{}{
+				"id":             1,
+				"progress":       st.Progress * 100,
+				"time_remaining": int(st.Remaining.Seconds()),
+				"time_printing":  int(st.Elapsed.Seconds()),
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc("/api/v1/job", func(w http.ResponseWriter, r *http.Request) {
+		st, err := status.Get()
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"title": "Printer is not available", "message": err.Error()})
+			return
+		}
+		if st.File == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":             1,
+			"state":          prusaLinkState(st),
+			"progress":       st.Progress * 100,
+			"time_remaining": int(st.Remaining.Seconds()),
+			"time_printing":  int(st.Elapsed.Seconds()),
+			"file": map[string]interface{}{
+				"name":         st.File,
+				"display_name": st.File,
+				"path":         prusaLinkStorage["path"],
+			},
+		})
+	})
+
+	// PUT /api/v1/files/<storage>/<path> with the file as the body
+	mux.HandleFunc("/api/v1/files/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+		case http.MethodHead, http.MethodGet:
+			// nothing is kept here, so nothing is overwritten either
+			http.NotFound(w, r)
+			return
+		default:
+			methodNotAllowedResponse(w, r.Method)
+			return
+		}
+
+		name := path.Base(r.URL.Path)
+		if rest := strings.TrimPrefix(r.URL.Path, "/api/v1/files/"); !strings.Contains(rest, "/") || name == "" {
+			badRequestResponse(w, "the path needs a storage and a file name")
+			return
+		}
+		if r.ContentLength < 0 {
+			http.Error(w, "Length Required", http.StatusLengthRequired)
+			return
+		}
+		if r.ContentLength > FILE_SIZE_MAX {
+			tooLargeResponse(w)
+			return
+		}
+
+		payload := NewPayload(http.MaxBytesReader(w, r.Body, FILE_SIZE_MAX), name, r.ContentLength, printAfterUpload(r))
+		applyAPIKeyFix(r, payload)
+		if err := serverUpload(printer, payload, _stats); err != nil {
+			internalServerErrorResponse(w, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+// prusaLinkVersion answers /api/version as PrusaLink, also under a
+// /printer/<id>/ prefix; PrusaSlicer's PrusaLink host type checks the name
+func prusaLinkVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/api/version") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hostname, _ := os.Hostname()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"api":      "2.0.0",
+			"server":   "2.1.2",
+			"original": "PrusaLink " + Version,
+			"text":     "PrusaLink",
+			"hostname": hostname,
+			"capabilities": map[string]bool{
+				"upload-by-put": true,
+			},
+		})
+	})
+}
+
+// prusaLinkDigest is the Digest login of the PrusaLink front end, nil
+// without a password
+func prusaLinkDigest() *digestAuth {
+	if PrusaLinkPassword == "" {
+		return nil
+	}
+	if PrusaLinkUser == "" {
+		log.Printf("PrusaLink password without a user, Digest is off")
+		return nil
+	}
+	return newDigestAuth("Printer API", PrusaLinkUser, PrusaLinkPassword)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a Digest nonce is good for, after that the client is told it is
+// stale and signs again with a new one
+const digestNonceTTL = 5 * time.Minute
+
+/*
+digestAuth checks HTTP Digest logins (RFC 7616, MD5) the way PrusaLink does.
+The nonces carry their time and a signature. The only thing kept is the
+highest nc each nonce was used with until it gets stale, so a captured
+header cannot be sent again.
+*/
+type digestAuth struct {
+	realm    string
+	user     string
+	password string
+	secret   []byte
+
+	mu   sync.Mutex
+	used map[string]nonceUse
+}
+
+type nonceUse struct {
+	nc      uint64
+	expires time.Time
+}
+
+func newDigestAuth(realm, user, password string) *digestAuth {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &digestAuth{realm: realm, user: user, password: password, secret: secret, used: map[string]nonceUse{}}
+}
+
+func (d *digestAuth) sign(ts string) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(ts))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func (d *digestAuth) nonce(now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 16)
+	return ts + d.sign(ts)
+}
+
+// checkNonce tells whether the nonce is one of ours, and whether it is too old
+func (d *digestAuth) checkNonce(nonce string, now time.Time) (ours, stale bool) {
+	if len(nonce) <= 32 {
+		return false, false
+	}
+	ts, sig := nonce[:len(nonce)-32], nonce[len(nonce)-32:]
+	if !hmac.Equal([]byte(sig), []byte(d.sign(ts))) {
+		return false, false
+	}
+	sec, err := strconv.ParseInt(ts, 16, 64)
+	if err != nil {
+		return false, false
+	}
+	return true, now.Sub(time.Unix(sec, 0)) > digestNonceTTL
+}
+
+// countNonce takes nc for the nonce, false when the nonce was used with nc or
+// a later one before
+func (d *digestAuth) countNonce(nonce string, nc uint64, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for n, u := range d.used {
+		if now.After(u.expires) {
+			delete(d.used, n)
+		}
+	}
+	if u, ok := d.used[nonce]; ok && nc <= u.nc {
+		return false
+	}
+	d.used[nonce] = nonceUse{nc: nc, expires: now.Add(digestNonceTTL)}
+	return true
+}
+
+func (d *digestAuth) challenge(w http.ResponseWriter, stale bool) {
+	h := fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth", algorithm=MD5`, d.realm, d.nonce(time.Now()))
+	if stale {
+		h += ", stale=true"
+	}
+	w.Header().Set("WWW-Authenticate", h)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// check verifies the Digest Authorization header of the request
+func (d *digestAuth) check(r *http.Request, now time.Time) (ok, stale bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Digest ") {
+		return false, false
+	}
+	p := parseDigestParams(strings.TrimPrefix(auth, "Digest "))
+	if p["username"] != d.user || p["realm"] != d.realm || p["uri"] != r.URL.RequestURI() {
+		return false, false
+	}
+	if alg := p["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return false, false
+	}
+	ours, stale := d.checkNonce(p["nonce"], now)
+	if !ours {
+		return false, false
+	}
+
+	ha1 := md5Hex(d.user + ":" + d.realm + ":" + d.password)
+	ha2 := md5Hex(r.Method + ":" + p["uri"])
+	var want string
+	switch p["qop"] {
+	case "auth":
+		want = md5Hex(ha1 + ":" + p["nonce"] + ":" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+	case "":
+		// RFC 2069 clients
+		want = md5Hex(ha1 + ":" + p["nonce"] + ":" + ha2)
+	default:
+		return false, false
+	}
+	if subtle.ConstantTimeCompare([]byte(want), []byte(p["response"])) != 1 {
+		return false, false
+	}
+	// the right password with an old nonce still has to sign again
+	if stale {
+		return false, true
+	}
+
+	if p["qop"] == "auth" {
+		nc, err := strconv.ParseUint(p["nc"], 16, 64)
+		if err != nil || !d.countNonce(p["nonce"], nc, now) {
+			// replayed
+			return false, false
+		}
+	} else if r.Method != http.MethodGet && r.Method != http.MethodHead && !d.countNonce(p["nonce"], 1, now) {
+		// RFC 2069 has no nc, a nonce signs one change and the client
+		// signs the next one with a new nonce
+		return false, true
+	}
+	return true, false
+}
+
+// parseDigestParams reads `key=value, key="quoted, value"` pairs
+func parseDigestParams(s string) map[string]string {
+	params := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimSpace(s[eq+1:])
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				end = len(s) - 1
+			}
+			value = strings.ReplaceAll(s[1:end], `\`, "")
+			s = s[end+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+		s = strings.TrimPrefix(strings.TrimSpace(s), ",")
+	}
+	return params
+}
+
+/*
+prusaLinkAuth lets requests through with one of the API keys, like
+octoPrintAuth, or with the Digest login. Everything else gets 401 and a
+Digest challenge, which is how PrusaSlicer learns to sign its requests.
+*/
+func prusaLinkAuth(listenAddr string, keys []string, digest *digestAuth, next http.Handler) http.Handler {
+	if len(keys) == 0 && digest == nil {
+		if host, _, err := net.SplitHostPort(listenAddr); err != nil || !isLoopback(host) {
+			log.Printf("No PrusaLink password or API keys, anyone on the network can upload")
+		}
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(keys) > 0 {
+			r = withAPIKeys(r)
+		}
+		if key, _ := splitAPIKey(requestAPIKey(r)); key != "" {
+			for _, k := range keys {
+				if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		stale := false
+		if digest != nil {
+			var ok bool
+			if ok, stale = digest.check(r, time.Now()); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			digest.challenge(w, stale)
+		}
+		if !stale {
+			log.Printf("Request %s %s without a valid login", r.Method, r.URL.Path)
+		}
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"title": "Unauthorized", "message": "Wrong or missing API key or login"})
+	})
+}
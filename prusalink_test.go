@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrusaLink(t *testing.T) {
+	fp, printer := startFakePrinter(t, true)
+	h := prusaLinkVersion(newOctoPrintRouter([]*Printer{printer}).prusaLink())
+
+	content := []byte("G28\nG1 X1\n")
+	r := httptest.NewRequest(http.MethodPut, "/api/v1/files/local/sub/prusa.gcode", bytes.NewReader(content))
+	r.Header.Set("Print-After-Upload", "?1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("PUT = %d %s", rec.Code, rec.Body)
+	}
+	if got, _ := fp.File("prusa.gcode"); !bytes.Equal(got, content) {
+		t.Fatalf("printer got %q", got)
+	}
+
+	get := func(path string) map[string]interface{} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		resp := map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("GET %s = %d %s", path, rec.Code, rec.Body)
+		}
+		return resp
+	}
+	if v := get("/api/version"); v["text"] != "PrusaLink" {
+		t.Errorf("/api/version = %v", v)
+	}
+	if v := get("/printer/FAKE1/api/version"); v["text"] != "PrusaLink" {
+		t.Errorf("prefixed /api/version = %v", v)
+	}
+	st := get("/api/v1/status")
+	if st["printer"].(map[string]interface{})["state"] != "PRINTING" || st["job"] == nil {
+		t.Errorf("/api/v1/status = %v", st)
+	}
+	if info := get("/api/v1/info"); info["serial"] != "FAKE1" {
+		t.Errorf("/api/v1/info = %v", info)
+	}
+}
+
+func TestPrusaLinkNotOnOctoPrintPort(t *testing.T) {
+	fp, printer := startFakePrinter(t, true)
+	// no API keys, the OctoPrint port takes anything from the network
+	h := octoPrintAuth("0.0.0.0:8844", nil, newOctoPrintRouter([]*Printer{printer}))
+
+	for _, path := range []string{"/api/v1/files/local/a.gcode", "/printer/FAKE1/api/v1/files/local/a.gcode"} {
+		r := httptest.NewRequest(http.MethodPut, path, strings.NewReader("G28\n"))
+		r.Header.Set("Print-After-Upload", "?1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != http.StatusNotFound && rec.Code != http.StatusUnauthorized {
+			t.Errorf("PUT %s on the OctoPrint port = %d", path, rec.Code)
+		}
+	}
+	if _, ok := fp.File("a.gcode"); ok {
+		t.Error("the printer got the upload")
+	}
+}
+
+// digestResponse signs a request the way PrusaSlicer does, the first one
+// with a nonce
+func digestResponse(challenge, user, password, method, uri string) string {
+	return digestResponseNC(challenge, user, password, method, uri, 1)
+}
+
+func digestResponseNC(challenge, user, password, method, uri string, nc int) string {
+	p := parseDigestParams(strings.TrimPrefix(challenge, "Digest "))
+	ha1 := md5Hex(user + ":" + p["realm"] + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	resp := md5Hex(fmt.Sprintf("%s:%s:%08x:abcdef:auth:%s", ha1, p["nonce"], nc, ha2))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", qop=auth, nc=%08x, cnonce="abcdef", response="%s", algorithm=MD5`,
+		user, p["realm"], p["nonce"], uri, nc, resp)
+}
+
+func TestPrusaLinkAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusOK, `{}`)
+	})
+	digest := newDigestAuth("Printer API", "maker", "secret")
+	h := prusaLinkAuth("127.0.0.1:8846", []string{"key"}, digest, ok)
+
+	do := func(auth, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/status", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		if key != "" {
+			r.Header.Set("X-Api-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := do("", "")
+	challenge := rec.Header().Get("WWW-Authenticate")
+	if rec.Code != http.StatusUnauthorized || !strings.HasPrefix(challenge, "Digest ") {
+		t.Fatalf("no login = %d, challenge %q", rec.Code, challenge)
+	}
+	if rec := do(digestResponse(challenge, "maker", "secret", http.MethodGet, "/api/v1/status"), ""); rec.Code != http.StatusOK {
+		t.Errorf("digest login = %d", rec.Code)
+	}
+	if rec := do(digestResponse(challenge, "maker", "wrong", http.MethodGet, "/api/v1/status"), ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password = %d", rec.Code)
+	}
+	if rec := do(digestResponse(challenge, "maker", "secret", http.MethodGet, "/api/v1/info"), ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("signed for another uri = %d", rec.Code)
+	}
+	if rec := do("", "key+preheat"); rec.Code != http.StatusOK {
+		t.Errorf("api key = %d", rec.Code)
+	}
+
+	// an old nonce asks the client to sign again
+	old := fmt.Sprintf(`Digest realm="Printer API", nonce="%s"`, digest.nonce(time.Now().Add(-digestNonceTTL-time.Minute)))
+	rec = do(digestResponse(old, "maker", "secret", http.MethodGet, "/api/v1/status"), "")
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Header().Get("WWW-Authenticate"), "stale=true") {
+		t.Errorf("stale nonce = %d, %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestPrusaLinkDigestReplay(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusOK, `{}`)
+	})
+	digest := newDigestAuth("Printer API", "maker", "secret")
+	h := prusaLinkAuth("127.0.0.1:8846", nil, digest, ok)
+	do := func(method, auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/files/usb/a.gcode", nil)
+		r.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+	challenge := fmt.Sprintf(`Digest realm="Printer API", nonce="%s"`, digest.nonce(time.Now()))
+
+	upload := digestResponseNC(challenge, "maker", "secret", http.MethodPut, "/api/v1/files/usb/a.gcode", 1)
+	if rec := do(http.MethodPut, upload); rec.Code != http.StatusOK {
+		t.Fatalf("upload = %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, upload); rec.Code != http.StatusUnauthorized {
+		t.Errorf("replayed upload = %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, digestResponseNC(challenge, "maker", "secret", http.MethodPut, "/api/v1/files/usb/a.gcode", 2)); rec.Code != http.StatusOK {
+		t.Errorf("next nc = %d", rec.Code)
+	}
+
+	// RFC 2069 clients sign every change with a new nonce
+	p := parseDigestParams(strings.TrimPrefix(challenge, "Digest "))
+	ha1 := md5Hex("maker:Printer API:secret")
+	// a nonce of its own, the one above is used
+	nonce := digest.nonce(time.Now().Add(-time.Second))
+	resp := md5Hex(ha1 + ":" + nonce + ":" + md5Hex("PUT:/api/v1/files/usb/a.gcode"))
+	old := fmt.Sprintf(`Digest username="maker", realm="%s", nonce="%s", uri="/api/v1/files/usb/a.gcode", response="%s"`, p["realm"], nonce, resp)
+	if rec := do(http.MethodPut, old); rec.Code != http.StatusOK {
+		t.Errorf("RFC 2069 upload = %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, old); rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Header().Get("WWW-Authenticate"), "stale=true") {
+		t.Errorf("RFC 2069 replay = %d, %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestParseDigestParams(t *testing.T) {
+	p := parseDigestParams(`username="maker", realm="Printer API", uri="/a?b=1,2", qop=auth, nc=00000001`)
+	want := map[string]string{"username": "maker", "realm": "Printer API", "uri": "/a?b=1,2", "qop": "auth", "nc": "00000001"}
+	if fmt.Sprint(p) != fmt.Sprint(want) {
+		t.Errorf("parseDigestParams = %v", p)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	JobQueued    = "queued"
+	JobUploading = "uploading"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+var (
+	// how often the queue daemon looks for idle printers
+	QueueInterval = 10 * time.Second
+
+	errJobNotFound = errors.New("job not found")
+)
+
+// JobConstraints pick the printers a job may go to, the empty ones match
+// every printer
+type JobConstraints struct {
+	Model    string   `yaml:"model,omitempty" json:"model,omitempty"`
+	Toolhead string   `yaml:"toolhead,omitempty" json:"toolhead,omitempty"`
+	Tags     []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+}
+
+// Match tells whether the job may go to printer. Model matches a part of
+// the model name, so "J1" matches "Snapmaker J1"; the printer needs all tags.
+func (c JobConstraints) Match(printer *Printer) bool {
+	if c.Model != "" && !strings.Contains(strings.ToLower(printer.Model), strings.ToLower(c.Model)) {
+		return false
+	}
+	if c.Toolhead != "" && !strings.EqualFold(c.Toolhead, printer.Toolhead) {
+		return false
+	}
+	for _, tag := range c.Tags {
+		if !printer.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// Job is a file waiting in the queue for a printer
+type Job struct {
+	ID             string     `yaml:"id" json:"id"`
+	Name           string     `yaml:"name" json:"name"`
+	Size           int64      `yaml:"size" json:"size"`
+	Priority       int        `yaml:"priority" json:"priority"`
+	Print          bool       `yaml:"print" json:"print"`
+	Fix            FixOptions `yaml:"fix,omitempty" json:"fix,omitempty"`
+	JobConstraints `yaml:",inline"`
+	State          string    `yaml:"state" json:"state"`
+	Printer        string    `yaml:"printer,omitempty" json:"printer,omitempty"`
+	Error          string    `yaml:"error,omitempty" json:"error,omitempty"`
+	Created        time.Time `yaml:"created" json:"created"`
+	Updated        time.Time `yaml:"updated" json:"updated"`
+}
+
+/*
+JobQueue keeps every job in its own pair of files in Dir: <id>.yaml with the
+job and <id>.data with the file, which is removed once the job is over. The
+command line and the daemon can change jobs at the same time, every file is
+replaced as a whole.
+*/
+type JobQueue struct {
+	Dir string
+}
+
+func NewJobQueue(dir string) (*JobQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &JobQueue{Dir: dir}, nil
+}
+
+func (q *JobQueue) path(id, ext string) string {
+	return filepath.Join(q.Dir, id+ext)
+}
+
+// Add copies the file of the job into the queue
+func (q *JobQueue) Add(job *Job, r io.Reader) error {
+	now := time.Now()
+	job.ID = strconv.FormatInt(now.UnixNano(), 36)
+	job.State = JobQueued
+	job.Created, job.Updated = now, now
+
+	f, err := os.Create(q.path(job.ID, ".data"))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(&limitedWriter{f, FILE_SIZE_MAX}, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	job.Size = n
+	return q.Save(job)
+}
+
+// Save writes the job, the state of a job that is over removes its file
+func (q *JobQueue) Save(job *Job) error {
+	job.Updated = time.Now()
+	b, err := yaml.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(job.ID, ".yaml.tmp")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path(job.ID, ".yaml")); err != nil {
+		return err
+	}
+	switch job.State {
+	case JobDone, JobCancelled:
+		os.Remove(q.path(job.ID, ".data"))
+	}
+	return nil
+}
+
+func (q *JobQueue) Get(id string) (*Job, error) {
+	b, err := os.ReadFile(q.path(id, ".yaml"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", errJobNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := yaml.Unmarshal(b, job); err != nil {
+		return nil, fmt.Errorf("job %s: %w", id, err)
+	}
+	return job, nil
+}
+
+// Jobs returns every job, highest priority first, then oldest first
+func (q *JobQueue) Jobs() ([]*Job, error) {
+	entries, err := os.ReadDir(q.Dir)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*Job{}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".yaml" {
+			continue
+		}
+		job, err := q.Get(strings.TrimSuffix(e.Name(), ".yaml"))
+		if err != nil {
+			log.Printf("Queue: %s", err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		if jobs[i].Priority != jobs[j].Priority {
+			return jobs[i].Priority > jobs[j].Priority
+		}
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+	return jobs, nil
+}
+
+// Open opens the file of the job
+func (q *JobQueue) Open(job *Job) (*os.File, error) {
+	return os.Open(q.path(job.ID, ".data"))
+}
+
+// SetPriority changes the priority of a job that still waits
+func (q *JobQueue) SetPriority(id string, priority int) error {
+	job, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+	if job.State != JobQueued {
+		return fmt.Errorf("job %s is %s", id, job.State)
+	}
+	job.Priority = priority
+	return q.Save(job)
+}
+
+// Cancel takes a job that still waits, or has failed, out of the queue
+func (q *JobQueue) Cancel(id string) error {
+	job, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+	if job.State != JobQueued && job.State != JobFailed {
+		return fmt.Errorf("job %s is %s", id, job.State)
+	}
+	job.State = JobCancelled
+	return q.Save(job)
+}
+
+/*
+scheduler hands every queued job to the first idle printer that matches it.
+A printer is idle when its status says so and no upload of the scheduler is
+running on it.
+*/
+type scheduler struct {
+	queue    *JobQueue
+	printers []*Printer
+
+	mu        sync.Mutex
+	uploading map[*Printer]bool
+	wg        sync.WaitGroup
+}
+
+func newScheduler(queue *JobQueue, printers []*Printer) *scheduler {
+	return &scheduler{
+		queue:     queue,
+		printers:  printers,
+		uploading: map[*Printer]bool{},
+	}
+}
+
+// requeueInterrupted puts the jobs back that were uploading when the daemon
+// stopped
+func (s *scheduler) requeueInterrupted() error {
+	jobs, err := s.queue.Jobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.State == JobUploading {
+			job.State, job.Printer = JobQueued, ""
+			if err := s.queue.Save(job); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// idlePrinters asks the printers that are not busy with an upload for their
+// status
+func (s *scheduler) idlePrinters() []*Printer {
+	idle := []*Printer{}
+	for _, p := range s.printers {
+		s.mu.Lock()
+		busy := s.uploading[p]
+		s.mu.Unlock()
+		if busy {
+			continue
+		}
+		st, err := Connector.Status(p)
+		if err != nil {
+			if Debug {
+				log.Printf("-- Queue: %s: %s", p.Name(), err)
+			}
+			continue
+		}
+		if !st.IsBusy() {
+			idle = append(idle, p)
+		}
+	}
+	return idle
+}
+
+// tick starts the uploads of the jobs that can go to a printer now
+func (s *scheduler) tick() error {
+	jobs, err := s.queue.Jobs()
+	if err != nil {
+		return err
+	}
+	queued := []*Job{}
+	for _, job := range jobs {
+		if job.State == JobQueued {
+			queued = append(queued, job)
+		}
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+
+	idle := s.idlePrinters()
+	for _, job := range queued {
+		for i, p := range idle {
+			if !job.Match(p) {
+				continue
+			}
+			job.State, job.Printer, job.Error = JobUploading, p.Name(), ""
+			if err := s.queue.Save(job); err != nil {
+				return err
+			}
+			idle = append(idle[:i], idle[i+1:]...)
+			s.mu.Lock()
+			s.uploading[p] = true
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go s.run(job, p)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *scheduler) run(job *Job, printer *Printer) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.uploading, printer)
+		s.mu.Unlock()
+	}()
+
+	log.Printf("Queue: job %s (%s) goes to %s", job.ID, job.Name, printer.Name())
+	err := func() error {
+		f, err := s.queue.Open(job)
+		if err != nil {
+			return fmt.Errorf("%w: %s", errFileInvalid, err)
+		}
+		defer f.Close()
+		p := NewPayload(f, job.Name, job.Size, job.Print)
+		p.Fix = p.Fix.Merge(job.Fix)
+		return uploadPayload(printer, p)
+	}()
+
+	job.State = JobDone
+	if err != nil {
+		log.Printf("Queue: job %s failed: %s", job.ID, err)
+		job.State, job.Error = JobFailed, err.Error()
+	}
+	if err := s.queue.Save(job); err != nil {
+		log.Printf("Queue: %s", err)
+	}
+	emit(Event{Event: "queue", Printer: printer, Job: job})
+}
+
+/*
+runQueueDaemon schedules the queued jobs on the printers until it is
+interrupted. With listenAddr it takes OctoPrint uploads into the queue; the
+form fields model, toolhead, tags (comma separated) and priority set up the
+job.
+*/
+func runQueueDaemon(queue *JobQueue, printers []*Printer, listenAddr string) error {
+	s := newScheduler(queue, printers)
+	if err := s.requeueInterrupted(); err != nil {
+		return err
+	}
+
+	if listenAddr != "" {
+		keys, err := loadOctoPrintAPIKeys()
+		if err != nil {
+			return err
+		}
+		listener, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		log.Printf("Queue takes OctoPrint uploads on http://%s", listener.Addr().String())
+		go http.Serve(listener, LoggingMiddleware(octoPrintAuth(listenAddr, keys, queueOctoPrintHandler(queue))))
+	}
+
+	names := []string{}
+	for _, p := range printers {
+		names = append(names, p.Name())
+	}
+	log.Printf("Queue %s schedules jobs on %s", queue.Dir, strings.Join(names, ", "))
+
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer signal.Stop(sc)
+
+	ticker := time.NewTicker(QueueInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.tick(); err != nil {
+			log.Printf("Queue: %s", err)
+		}
+		select {
+		case sig := <-sc:
+			log.Printf("Received signal: %s, waiting for the running uploads", sig)
+			s.wg.Wait()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func queueOctoPrintHandler(queue *JobQueue) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusOK, `{"api": "0.1", "server": "1.2.3", "text": "OctoPrint 1.2.3/Dummy"}`)
+	})
+	mux.HandleFunc("/api/files/local", func(w http.ResponseWriter, r *http.Request) {
+		payload, ok := readUpload(w, r)
+		if !ok {
+			return
+		}
+		defer payload.File.(io.Closer).Close()
+
+		job := &Job{
+			Name:  payload.Name,
+			Print: payload.Print,
+			Fix:   payload.Fix,
+			JobConstraints: JobConstraints{
+				Model:    r.FormValue("model"),
+				Toolhead: r.FormValue("toolhead"),
+				Tags:     splitList(r.FormValue("tags")),
+			},
+		}
+		if v := r.FormValue("priority"); v != "" {
+			priority, err := strconv.Atoi(v)
+			if err != nil {
+				badRequestResponse(w, "priority: "+err.Error())
+				return
+			}
+			job.Priority = priority
+		}
+		if err := queue.Add(job, payload.File); err != nil {
+			internalServerErrorResponse(w, err.Error())
+			return
+		}
+		log.Printf("Queue: job %s (%s) added", job.ID, job.Name)
+		writeResponse(w, http.StatusOK, `{"done": true}`)
+	})
+	return mux
+}
+
+// splitList splits a comma separated list and drops the empty items
+func splitList(s string) []string {
+	out := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gosuri/uilive"
+)
+
+func TestJobQueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewJobQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	low := &Job{Name: "low.gcode"}
+	high := &Job{Name: "high.gcode", Priority: 5}
+	later := &Job{Name: "later.gcode"}
+	for _, job := range []*Job{low, high, later} {
+		if err := q.Add(job, strings.NewReader("G28\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func() string {
+		jobs, err := NewJobQueue(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list, err := jobs.Jobs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := []string{}
+		for _, job := range list {
+			out = append(out, job.Name+":"+job.State)
+		}
+		return strings.Join(out, " ")
+	}
+	if got, want := names(), "high.gcode:queued low.gcode:queued later.gcode:queued"; got != want {
+		t.Errorf("jobs = %s, want %s", got, want)
+	}
+
+	if err := q.SetPriority(later.ID, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Cancel(low.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(), "later.gcode:queued high.gcode:queued low.gcode:cancelled"; got != want {
+		t.Errorf("jobs = %s, want %s", got, want)
+	}
+	if _, err := os.Stat(q.path(low.ID, ".data")); !os.IsNotExist(err) {
+		t.Error("the file of a cancelled job is kept")
+	}
+	if err := q.SetPriority(low.ID, 1); err == nil {
+		t.Error("reprioritized a cancelled job")
+	}
+	if err := q.Cancel("nope"); !errors.Is(err, errJobNotFound) {
+		t.Errorf("Cancel error = %v", err)
+	}
+}
+
+func TestJobConstraintsMatch(t *testing.T) {
+	j1 := &Printer{Model: "Snapmaker J1", Toolhead: "dual", Tags: []string{"PLA", "bay-1"}}
+	tests := []struct {
+		c    JobConstraints
+		want bool
+	}{
+		{JobConstraints{}, true},
+		{JobConstraints{Model: "j1"}, true},
+		{JobConstraints{Model: "A350"}, false},
+		{JobConstraints{Toolhead: "Dual"}, true},
+		{JobConstraints{Toolhead: "laser"}, false},
+		{JobConstraints{Tags: []string{"pla", "bay-1"}}, true},
+		{JobConstraints{Tags: []string{"pla", "petg"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.c.Match(j1); got != tt.want {
+			t.Errorf("%+v.Match = %v, want %v", tt.c, got, tt.want)
+		}
+	}
+}
+
+func TestSchedulerAssignsMatchingPrinter(t *testing.T) {
+	// two printers on loopback addresses that share the SACP port
+	fps := []*FakePrinter{}
+	printers := []*Printer{}
+	port := "0"
+	for i, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		fp := NewFakePrinter("Q"+strconv.Itoa(i+1), "Snapmaker J1", true)
+		addr, err := fp.ListenSACP(net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Skipf("listen on %s: %v", ip, err)
+		}
+		t.Cleanup(func() { fp.Close() })
+		port = strconv.Itoa(addr.(*net.TCPAddr).Port)
+		fps = append(fps, fp)
+		printers = append(printers, &Printer{IP: ip, ID: fp.ID, Model: fp.Model, Sacp: true})
+	}
+	printers[1].Tags = []string{"petg"}
+	origSACP, origNoFix, origOut := SACPPort, NoFix, uilive.Out
+	SACPPort, NoFix, uilive.Out = port, true, &bytes.Buffer{}
+	t.Cleanup(func() { SACPPort, NoFix, uilive.Out = origSACP, origNoFix, origOut })
+
+	q, err := NewJobQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	petg := &Job{Name: "petg.gcode", JobConstraints: JobConstraints{Tags: []string{"petg"}}}
+	a350 := &Job{Name: "a350.gcode", JobConstraints: JobConstraints{Model: "A350"}}
+	for _, job := range []*Job{petg, a350} {
+		if err := q.Add(job, strings.NewReader("G28\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newScheduler(q, printers)
+	if err := s.tick(); err != nil {
+		t.Fatal(err)
+	}
+	s.wg.Wait()
+
+	if _, ok := fps[1].File("petg.gcode"); !ok {
+		t.Error("the petg job did not go to the petg printer")
+	}
+	if len(fps[0].Files()) != 0 {
+		t.Errorf("printer without tags got %v", fps[0].Files())
+	}
+	if job, _ := q.Get(petg.ID); job.State != JobDone || job.Printer != "Q2" {
+		t.Errorf("petg job is %s on %q", job.State, job.Printer)
+	}
+	if job, _ := q.Get(a350.ID); job.State != JobQueued {
+		t.Errorf("a350 job is %s, no printer matches it", job.State)
+	}
+}
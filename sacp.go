@@ -9,8 +9,10 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"time"
 )
@@ -20,11 +22,14 @@ const (
 )
 
 var (
-	errInvalidSACP     = errors.New("data doesn't look like SACP packet")
-	errInvalidSACPVer  = errors.New("SACP version missmatch")
-	errInvalidChksum   = errors.New("SACP checksum doesn't match data")
-	errInvalidSize     = errors.New("SACP package is too short")
-	errTimeoutExceeded = errors.New("timeout exceeded")
+	errInvalidSACP       = errors.New("data doesn't look like SACP packet")
+	errInvalidSACPVer    = errors.New("SACP version missmatch")
+	errInvalidChksum     = errors.New("SACP checksum doesn't match data")
+	errInvalidHeadChksum = errors.New("SACP header checksum doesn't match")
+	errInvalidSize       = errors.New("SACP package is too short")
+	errTimeoutExceeded   = errors.New("timeout exceeded")
+	errCommandFailed     = errors.New("SACP command failed")
+	errUploadRejected    = errors.New("printer rejected the upload")
 )
 
 type SACP_pack struct {
@@ -68,25 +73,26 @@ func (sacp SACP_pack) Encode() []byte {
 }
 
 func (sacp *SACP_pack) Decode(data []byte) error {
-	if len(data) < 13 {
+	if len(data) < 7 {
 		return errInvalidSize
 	}
 	// ensure the packet starts with the expected 0xAA55 header bytes
 	if data[0] != 0xAA || data[1] != 0x55 {
 		return errInvalidSACP
 	}
-	dataLen := binary.LittleEndian.Uint16(data[2:4])
-	if dataLen != uint16(len(data)-7) {
-		return errInvalidSize
+	// the length can't be trusted before the header checksum is
+	if chk := sacp.headChksum(data[:6]); chk != data[6] {
+		return fmt.Errorf("%w: 0x%02x, want 0x%02x", errInvalidHeadChksum, data[6], chk)
 	}
 	if data[4] != 0x01 {
 		return errInvalidSACPVer
 	}
-	if sacp.headChksum(data[:6]) != data[6] {
-		return errInvalidChksum
+	dataLen := binary.LittleEndian.Uint16(data[2:4])
+	if dataLen < 8 || int(dataLen) != len(data)-7 {
+		return errInvalidSize
 	}
-	if binary.LittleEndian.Uint16(data[len(data)-2:]) != sacp.U16Chksum(data[7:], dataLen-2) {
-		return errInvalidChksum
+	if chk := sacp.U16Chksum(data[7:], dataLen-2); binary.LittleEndian.Uint16(data[len(data)-2:]) != chk {
+		return fmt.Errorf("%w: 0x%04x, want 0x%04x", errInvalidChksum, binary.LittleEndian.Uint16(data[len(data)-2:]), chk)
 	}
 
 	sacp.ReceiverID = data[5]
@@ -155,90 +161,154 @@ func writeLE[T any](w io.Writer, u T) {
 	binary.Write(w, binary.LittleEndian, u)
 }
 
-func SACP_connect(ip string, timeout time.Duration) (net.Conn, error) {
-	conn, err := net.Dial("tcp4", ip+":8888")
-	if err != nil {
-		// log.Printf("Error connecting to %s: %v", ip, err)
+func readSACPstring(r io.Reader) (string, error) {
+	b, err := readSACPbytes(r)
+	return string(b), err
+}
+
+func readSACPbytes(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
 		return nil, err
 	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
 
-	conn.SetWriteDeadline(time.Now().Add(timeout))
-	_, err = conn.Write(SACP_pack{
-		ReceiverID: 2,
-		SenderID:   0,
-		Attribute:  0,
-		Sequence:   1,
-		CommandSet: 0x01,
-		CommandID:  0x05,
-		Data: []byte{
-			11, 0, 's', 'm', '2', 'u', 'p', 'l', 'o', 'a', 'd', 'e', 'r',
-			0, 0,
-			0, 0,
-		},
-	}.Encode())
+func readLE[T any](r io.Reader, u *T) error {
+	return binary.Read(r, binary.LittleEndian, u)
+}
 
+func SACP_connect(ip string, timeout time.Duration) (*SACPClient, error) {
+	conn, err := net.DialTimeout("tcp4", net.JoinHostPort(ip, SACPPort), timeout)
 	if err != nil {
-		// log.Println("Error writing \"hello\": ", err)
-		conn.Close()
+		// log.Printf("Error connecting to %s: %v", ip, err)
 		return nil, err
 	}
 
-	for {
-		p, err := SACP_read(conn, timeout)
-		if err != nil || p == nil {
-			// log.Println("Error reading \"hello\" response: ", err)
-			conn.Close()
-			return nil, err
-		}
+	client := NewSACPClient(conn)
+	p, err := client.Request(2, 0x01, 0x05, []byte{
+		11, 0, 's', 'm', '2', 'u', 'p', 'l', 'o', 'a', 'd', 'e', 'r',
+		0, 0,
+		0, 0,
+	}, timeout)
 
-		if Debug {
-			log.Printf("-- SACP_connect got:\n%v", p)
-		}
-
-		if p.CommandSet == 1 && p.CommandID == 5 {
-			break
-		}
+	if err != nil {
+		// log.Println("Error reading \"hello\" response: ", err)
+		client.Close()
+		return nil, err
 	}
 
 	if Debug {
+		log.Printf("-- SACP_connect got:\n%v", p)
 		log.Println("-- Connected to printer")
 	}
 
-	return conn, nil
+	return client, nil
 }
 
+// SACP_read reads one packet, a zero timeout waits forever
 func SACP_read(conn net.Conn, timeout time.Duration) (*SACP_pack, error) {
-	var buf [SACP_data_len + 15]byte
-
-	deadline := time.Now().Add(timeout)
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
 	conn.SetReadDeadline(deadline)
 
-	n, err := conn.Read(buf[:4])
-	if err != nil {
+	var sacp SACP_pack
+	if err := NewSACPDecoder(conn).Decode(&sacp); err != nil {
 		return nil, err
 	}
-	if n != 4 {
-		return nil, errInvalidSize
+	return &sacp, nil
+}
+
+/*
+SACPDecoder reads packets from a stream. It reads exactly the bytes a frame
+needs, however the stream splits them, skips garbage up to the next 0xAA55
+header and checks the header before trusting the length in it.
+*/
+type SACPDecoder struct {
+	r io.Reader
+	// bytes read past a header that turned out to be bad, scanned again first
+	pending []byte
+}
+
+func NewSACPDecoder(r io.Reader) *SACPDecoder {
+	return &SACPDecoder{r: r}
+}
+
+func (d *SACPDecoder) readFull(b []byte) error {
+	n := copy(b, d.pending)
+	d.pending = d.pending[n:]
+	if n < len(b) {
+		_, err := io.ReadFull(d.r, b[n:])
+		return err
+	}
+	return nil
+}
+
+// Decode reads the next packet. The errors of a broken packet are the same
+// as SACP_pack.Decode's, and the stream can be read on after them.
+func (d *SACPDecoder) Decode(sacp *SACP_pack) error {
+	var head [7]byte
+
+	// look for the header
+	if err := d.readFull(head[:2]); err != nil {
+		return err
+	}
+	for head[0] != 0xAA || head[1] != 0x55 {
+		head[0] = head[1]
+		if err := d.readFull(head[1:2]); err != nil {
+			return err
+		}
 	}
 
-	dataLen := binary.LittleEndian.Uint16(buf[2:4])
-	n, err = conn.Read(buf[4 : dataLen+7])
-	if err != nil {
-		return nil, err
+	if err := d.readFull(head[2:]); err != nil {
+		return unexpectedEOF(err)
 	}
-	if n != int(dataLen+3) {
-		return nil, errInvalidSize
+	if chk := sacp.headChksum(head[:6]); chk != head[6] || head[4] != 0x01 {
+		// not a header after all, scan again from the byte after 0xAA
+		d.pending = append(append([]byte{}, head[1:]...), d.pending...)
+		if chk != head[6] {
+			return fmt.Errorf("%w: 0x%02x, want 0x%02x", errInvalidHeadChksum, head[6], chk)
+		}
+		return errInvalidSACPVer
 	}
 
-	var sacp SACP_pack
-	err = sacp.Decode(buf[:dataLen+7])
+	dataLen := binary.LittleEndian.Uint16(head[2:4])
+	if dataLen < 8 {
+		return errInvalidSize
+	}
+	frame := make([]byte, 7+int(dataLen))
+	copy(frame, head[:])
+	if err := d.readFull(frame[7:]); err != nil {
+		return unexpectedEOF(err)
+	}
 
-	return &sacp, err
+	return sacp.Decode(frame)
 }
 
-var sequence uint16 = 2
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// isSACPDecodeError tells a broken packet from a broken connection
+func isSACPDecodeError(err error) bool {
+	for _, e := range []error{errInvalidSACP, errInvalidSACPVer, errInvalidChksum, errInvalidHeadChksum, errInvalidSize} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
 
-func SACP_set_tool_temperature(conn net.Conn, tool_id uint8, temperature uint16, timeout time.Duration) error {
+func SACP_set_tool_temperature(client *SACPClient, tool_id uint8, temperature uint16, timeout time.Duration) error {
 	data := bytes.Buffer{}
 
 	data.WriteByte(0x08)
@@ -249,10 +319,10 @@ func SACP_set_tool_temperature(conn net.Conn, tool_id uint8, temperature uint16,
 	// Temperature
 	writeLE(&data, uint16(temperature))
 
-	return SACP_send_command(conn, 0x10, 0x02, data, timeout)
+	return SACP_send_command(client, 0x10, 0x02, data, timeout)
 }
 
-func SACP_set_bed_temperature(conn net.Conn, tool_id uint8, temperature uint16, timeout time.Duration) error {
+func SACP_set_bed_temperature(client *SACPClient, tool_id uint8, temperature uint16, timeout time.Duration) error {
 	data := bytes.Buffer{}
 
 	data.WriteByte(0x05)
@@ -263,81 +333,93 @@ func SACP_set_bed_temperature(conn net.Conn, tool_id uint8, temperature uint16,
 	// Temperature
 	writeLE(&data, uint16(temperature))
 
-	return SACP_send_command(conn, 0x14, 0x02, data, timeout)
+	return SACP_send_command(client, 0x14, 0x02, data, timeout)
 }
 
-func SACP_home(conn net.Conn, timeout time.Duration) error {
+func SACP_home(client *SACPClient, timeout time.Duration) error {
 	data := bytes.Buffer{}
 	data.WriteByte(0x00)
 
 	// 0x31 is also used when homing in Luban???
 	// 0x35 homes everything
-	return SACP_send_command(conn, 0x01, 0x35, data, timeout)
+	return SACP_send_command(client, 0x01, 0x35, data, timeout)
 }
 
-func SACP_send_command(conn net.Conn, command_set uint8, command_id uint8, data bytes.Buffer, timeout time.Duration) error {
-
-	sequence++
+func SACP_start_print(client *SACPClient, head_type uint8, filename string, md5hex string, timeout time.Duration) error {
+	data := bytes.Buffer{}
 
-	start := time.Now()
-	conn.SetWriteDeadline(time.Now().Add(timeout))
-	_, err := conn.Write(SACP_pack{
-		ReceiverID: 1,
-		SenderID:   0,
-		Attribute:  0,
-		Sequence:   sequence,
-		CommandSet: command_set,
-		CommandID:  command_id,
-		Data:       data.Bytes(),
-	}.Encode())
+	// Head type of the job: 0 printing, 1 laser, 2 CNC
+	data.WriteByte(head_type)
 
-	if err != nil {
+	if err := writeSACPstring(&data, filename); err != nil {
 		return err
 	}
+	if err := writeSACPstring(&data, md5hex); err != nil {
+		return err
+	}
+
+	// the file lives on the touchscreen, so the screen has to start the job
+	return SACP_send_command_to(client, 2, 0xb0, 0x08, data, timeout)
+}
 
+func SACP_pause_print(client *SACPClient, timeout time.Duration) error {
+	return SACP_send_command_to(client, 2, 0xac, 0x04, bytes.Buffer{}, timeout)
+}
+
+func SACP_resume_print(client *SACPClient, timeout time.Duration) error {
+	return SACP_send_command_to(client, 2, 0xac, 0x05, bytes.Buffer{}, timeout)
+}
+
+func SACP_stop_print(client *SACPClient, timeout time.Duration) error {
+	return SACP_send_command_to(client, 2, 0xac, 0x06, bytes.Buffer{}, timeout)
+}
+
+func SACP_send_command(client *SACPClient, command_set uint8, command_id uint8, data bytes.Buffer, timeout time.Duration) error {
+	return SACP_send_command_to(client, 1, command_set, command_id, data, timeout)
+}
+
+func SACP_send_command_to(client *SACPClient, receiver_id uint8, command_set uint8, command_id uint8, data bytes.Buffer, timeout time.Duration) error {
 	if Debug {
-		log.Printf("-- Sequence: %d Sent GCode: %x", sequence, data.Bytes())
+		log.Printf("-- Sending command %02x/%02x: %x", command_set, command_id, data.Bytes())
 	}
 
-	for {
-		remaining := timeout - time.Since(start)
-		if remaining <= 0 {
-			return errTimeoutExceeded
-		}
-		conn.SetReadDeadline(time.Now().Add(remaining))
-		p, err := SACP_read(conn, remaining)
-		if err != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && time.Since(start) >= timeout {
-				return errTimeoutExceeded
-			}
-			return err
-		}
+	p, err := client.Request(receiver_id, command_set, command_id, data.Bytes(), timeout)
+	if err != nil {
+		return err
+	}
 
-		if Debug {
-			log.Printf("-- Got reply from printer: %v", p)
-		}
+	if Debug {
+		log.Printf("-- Got reply from printer: %v", p)
+	}
 
-		if p.Sequence == sequence && p.CommandSet == command_set && p.CommandID == command_id {
-			if len(p.Data) == 1 && p.Data[0] == 0 {
-				return nil
-			}
-		}
+	if len(p.Data) == 0 {
+		return errInvalidSize
+	}
+	if p.Data[0] != 0 {
+		return fmt.Errorf("%w: %02x/%02x returned %d", errCommandFailed, command_set, command_id, p.Data[0])
 	}
+	return nil
 }
 
-func SACP_start_upload(conn net.Conn, filename string, gcode []byte, timeout time.Duration) error {
+// SACP_start_upload sends size bytes of content, which the printer asks for
+// in chunks of SACP_data_len in any order. progress, if not nil, is called
+// after every chunk.
+func SACP_start_upload(client *SACPClient, filename string, content io.ReaderAt, size int64, md5hash [md5.Size]byte, progress func(sent, total int64), timeout time.Duration) error {
 	// prepare data for upload begin packet
-	package_count := uint16((len(gcode) + SACP_data_len - 1) / SACP_data_len)
-	md5hash := md5.Sum(gcode)
+	if size > math.MaxUint32 {
+		return errInvalidSize
+	}
+	package_count := uint16((size + SACP_data_len - 1) / SACP_data_len)
+	md5hex := hex.EncodeToString(md5hash[:])
 
 	data := bytes.Buffer{}
 
 	if err := writeSACPstring(&data, filename); err != nil {
 		return err
 	}
-	writeLE(&data, uint32(len(gcode)))
+	writeLE(&data, uint32(size))
 	writeLE(&data, package_count)
-	if err := writeSACPstring(&data, hex.EncodeToString(md5hash[:])); err != nil {
+	if err := writeSACPstring(&data, md5hex); err != nil {
 		return err
 	}
 
@@ -345,40 +427,40 @@ func SACP_start_upload(conn net.Conn, filename string, gcode []byte, timeout tim
 		log.Println("-- Starting upload ...")
 	}
 
-	conn.SetWriteDeadline(time.Now().Add(timeout))
-	_, err := conn.Write(SACP_pack{
-		ReceiverID: 2,
-		SenderID:   0,
-		Attribute:  0,
-		Sequence:   1,
-		CommandSet: 0xb0,
-		CommandID:  0x00,
-		Data:       data.Bytes(),
-	}.Encode())
+	// the printer drives the transfer: it asks for every chunk with b0/01,
+	// and reports the result with b0/02
+	packets, unsubscribe := client.Subscribe(sacpTopic{0xb0, 0x01}, sacpTopic{0xb0, 0x02})
+	defer unsubscribe()
 
-	if err != nil {
+	// the printer acks the begin packet with b0/00, nobody waits for it
+	if _, err := client.Write(2, 0xb0, 0x00, data.Bytes(), timeout); err != nil {
 		return err
 	}
 
+	chunk := make([]byte, SACP_data_len)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
 	for {
-		// always receive packet, then send response
-		conn.SetReadDeadline(time.Now().Add(timeout))
-		p, err := SACP_read(conn, timeout)
-		if err != nil {
-			return err
+		var p *SACP_pack
+		select {
+		case p = <-packets:
+		case <-client.Done():
+			return client.Err()
+		case <-timer.C:
+			return errTimeoutExceeded
 		}
-
-		if p == nil {
-			return errInvalidSize
+		if !timer.Stop() {
+			<-timer.C
 		}
+		timer.Reset(timeout)
 
 		if Debug {
 			log.Printf("-- Got reply from printer: %v", p)
 		}
 
 		switch {
-		case p.CommandSet == 0xb0 && p.CommandID == 0:
-			// just ignore, don't know that this message means :)
 		case p.CommandSet == 0xb0 && p.CommandID == 1:
 			// sending next chunk
 			if len(p.Data) < 4 {
@@ -390,17 +472,24 @@ func SACP_start_upload(conn net.Conn, filename string, gcode []byte, timeout tim
 			}
 
 			pkgRequested := binary.LittleEndian.Uint16(p.Data[2+md5_len : 2+md5_len+2])
-			var pkgData []byte
-
+			if pkgRequested >= package_count {
+				return errInvalidSize
+			}
+			offset := int64(pkgRequested) * SACP_data_len
+			pkgData := chunk[:SACP_data_len]
 			if pkgRequested == package_count-1 { // last package
-				pkgData = gcode[SACP_data_len*int(pkgRequested):]
-			} else { // regular package
-				pkgData = gcode[SACP_data_len*int(pkgRequested) : SACP_data_len*int(pkgRequested+1)]
+				pkgData = chunk[:size-offset]
+			}
+			if n, err := content.ReadAt(pkgData, offset); n < len(pkgData) {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
 			}
 
 			data := bytes.Buffer{}
 			data.WriteByte(0)
-			if err := writeSACPstring(&data, hex.EncodeToString(md5hash[:])); err != nil {
+			if err := writeSACPstring(&data, md5hex); err != nil {
 				return err
 			}
 			writeLE(&data, pkgRequested)
@@ -409,21 +498,11 @@ func SACP_start_upload(conn net.Conn, filename string, gcode []byte, timeout tim
 			}
 
 			// log.Printf("  sending package %d of %d", pkgRequested+1, package_count)
-			perc := float64(pkgRequested+1) / float64(package_count) * 100.0
-			log.Printf("  - SACP sending %.1f%%", perc)
-
-			conn.SetWriteDeadline(time.Now().Add(timeout))
-			_, err := conn.Write(SACP_pack{
-				ReceiverID: 2,
-				SenderID:   0,
-				Attribute:  1,
-				Sequence:   p.Sequence,
-				CommandSet: 0xb0,
-				CommandID:  0x01,
-				Data:       data.Bytes(),
-			}.Encode())
-
-			if err != nil {
+			if progress != nil {
+				progress(offset+int64(len(pkgData)), size)
+			}
+
+			if err := client.Reply(p, data.Bytes(), timeout); err != nil {
 				return err
 			}
 
@@ -435,33 +514,19 @@ func SACP_start_upload(conn net.Conn, filename string, gcode []byte, timeout tim
 					log.Print("-- Upload finished")
 				}
 
-				if err := SACP_disconnect(conn, timeout); err != nil {
-					return err
-				}
-
 				return nil // everything is ok!
 			}
 
+			if len(p.Data) > 0 {
+				return fmt.Errorf("%w: code %d", errUploadRejected, p.Data[0])
+			}
 			log.Print("Unable to process b0/02 with invalid data", p.Data)
-
-		default:
-			continue
 		}
 
 	}
 }
 
-func SACP_disconnect(conn net.Conn, timeout time.Duration) (err error) {
-	conn.SetWriteDeadline(time.Now().Add(timeout))
-	_, err = conn.Write(SACP_pack{
-		ReceiverID: 2,
-		SenderID:   0,
-		Attribute:  0,
-		Sequence:   1,
-		CommandSet: 0x01,
-		CommandID:  0x06,
-		Data:       []byte{},
-	}.Encode())
-
+func SACP_disconnect(client *SACPClient, timeout time.Duration) (err error) {
+	_, err = client.Write(2, 0x01, 0x06, []byte{}, timeout)
 	return err
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errClientClosed = errors.New("SACP connection closed")
+
+type sacpTopic struct {
+	CommandSet byte
+	CommandID  byte
+}
+
+// sacpPendingKey identifies the reply to a request
+type sacpPendingKey struct {
+	sequence   uint16
+	commandSet byte
+	commandID  byte
+}
+
+type sacpSubscription struct {
+	topics []sacpTopic
+	ch     chan *SACP_pack
+}
+
+func (s *sacpSubscription) match(p *SACP_pack) bool {
+	if len(s.topics) == 0 {
+		return true
+	}
+	for _, t := range s.topics {
+		if t.CommandSet == p.CommandSet && t.CommandID == p.CommandID {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+SACPClient owns a single SACP connection. One goroutine reads every packet
+from it: replies go to the request waiting for them, everything else (reports
+pushed by the printer, requests made by the printer) goes to the subscribers.
+*/
+type SACPClient struct {
+	conn     net.Conn
+	sequence uint32
+
+	wmu sync.Mutex // serializes writes
+
+	mu      sync.Mutex
+	pending map[sacpPendingKey]chan *SACP_pack
+	subs    map[*sacpSubscription]empty
+
+	done chan empty
+	err  error
+}
+
+func NewSACPClient(conn net.Conn) *SACPClient {
+	c := &SACPClient{
+		conn:    conn,
+		pending: map[sacpPendingKey]chan *SACP_pack{},
+		subs:    map[*sacpSubscription]empty{},
+		done:    make(chan empty),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *SACPClient) readLoop() {
+	defer close(c.done)
+	c.conn.SetReadDeadline(time.Time{})
+	dec := NewSACPDecoder(c.conn)
+	for {
+		p := &SACP_pack{}
+		if err := dec.Decode(p); err != nil {
+			if !isSACPDecodeError(err) {
+				c.err = err
+				return
+			}
+			// a broken packet, the next one may be fine
+			if Debug {
+				log.Printf("-- SACP dropped packet: %v", err)
+			}
+			continue
+		}
+		c.dispatch(p)
+	}
+}
+
+func (c *SACPClient) dispatch(p *SACP_pack) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p.Attribute == 1 {
+		key := sacpPendingKey{p.Sequence, p.CommandSet, p.CommandID}
+		if ch, ok := c.pending[key]; ok {
+			delete(c.pending, key)
+			ch <- p
+			return
+		}
+	}
+
+	for s := range c.subs {
+		if s.match(p) {
+			select {
+			case s.ch <- p:
+			default:
+				if Debug {
+					log.Printf("-- SACP subscriber is full, dropped %02x/%02x", p.CommandSet, p.CommandID)
+				}
+			}
+		}
+	}
+}
+
+func (c *SACPClient) nextSequence() uint16 {
+	return uint16(atomic.AddUint32(&c.sequence, 1))
+}
+
+func (c *SACPClient) send(p SACP_pack, timeout time.Duration) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := c.conn.Write(p.Encode())
+	return err
+}
+
+// Write sends a request with its own sequence number without waiting for the
+// reply, and returns the sequence number.
+func (c *SACPClient) Write(receiver_id uint8, command_set uint8, command_id uint8, data []byte, timeout time.Duration) (uint16, error) {
+	seq := c.nextSequence()
+	return seq, c.send(SACP_pack{
+		ReceiverID: receiver_id,
+		SenderID:   0,
+		Attribute:  0,
+		Sequence:   seq,
+		CommandSet: command_set,
+		CommandID:  command_id,
+		Data:       data,
+	}, timeout)
+}
+
+// Request sends a request and waits for its reply
+func (c *SACPClient) Request(receiver_id uint8, command_set uint8, command_id uint8, data []byte, timeout time.Duration) (*SACP_pack, error) {
+	var (
+		seq = c.nextSequence()
+		key = sacpPendingKey{seq, command_set, command_id}
+		ch  = make(chan *SACP_pack, 1)
+	)
+	c.mu.Lock()
+	c.pending[key] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, key)
+		c.mu.Unlock()
+	}()
+
+	err := c.send(SACP_pack{
+		ReceiverID: receiver_id,
+		SenderID:   0,
+		Attribute:  0,
+		Sequence:   seq,
+		CommandSet: command_set,
+		CommandID:  command_id,
+		Data:       data,
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case p := <-ch:
+		return p, nil
+	case <-timer.C:
+		return nil, errTimeoutExceeded
+	case <-c.done:
+		return nil, c.Err()
+	}
+}
+
+// Reply answers a request made by the printer
+func (c *SACPClient) Reply(req *SACP_pack, data []byte, timeout time.Duration) error {
+	return c.send(SACP_pack{
+		ReceiverID: req.SenderID,
+		SenderID:   0,
+		Attribute:  1,
+		Sequence:   req.Sequence,
+		CommandSet: req.CommandSet,
+		CommandID:  req.CommandID,
+		Data:       data,
+	}, timeout)
+}
+
+/*
+Subscribe returns a channel that receives the packets of the given topics
+that are not replies to a request, or all of them if no topic is given.
+Call the returned function to unsubscribe.
+*/
+func (c *SACPClient) Subscribe(topics ...sacpTopic) (<-chan *SACP_pack, func()) {
+	s := &sacpSubscription{
+		topics: topics,
+		ch:     make(chan *SACP_pack, 64),
+	}
+	c.mu.Lock()
+	c.subs[s] = empty{}
+	c.mu.Unlock()
+
+	return s.ch, func() {
+		c.mu.Lock()
+		delete(c.subs, s)
+		c.mu.Unlock()
+	}
+}
+
+// Done is closed when the connection is gone
+func (c *SACPClient) Done() <-chan empty {
+	return c.done
+}
+
+// Err tells why the connection is gone
+func (c *SACPClient) Err() error {
+	select {
+	case <-c.done:
+		if c.err == nil {
+			return errClientClosed
+		}
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *SACPClient) Close() error {
+	return c.conn.Close()
+}
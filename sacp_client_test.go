@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Replies that arrive out of order must reach the request that made them, and
+// packets that nobody asked for must reach the subscribers.
+func TestSACPClientDispatch(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	client := NewSACPClient(c1)
+	pushes, unsubscribe := client.Subscribe(sacpTopicHeartbeat)
+	defer unsubscribe()
+
+	go func() {
+		var reqs []*SACP_pack
+		for len(reqs) < 2 {
+			p, err := SACP_read(c2, time.Second)
+			if err != nil {
+				return
+			}
+			reqs = append(reqs, p)
+		}
+		// a report first, then the replies in reverse order
+		c2.Write(SACP_pack{SenderID: 1, CommandSet: 0x01, CommandID: 0xa0, Sequence: 99, Data: []byte{0, 2}}.Encode())
+		for i := len(reqs) - 1; i >= 0; i-- {
+			r := reqs[i]
+			c2.Write(SACP_pack{SenderID: 1, Attribute: 1, Sequence: r.Sequence, CommandSet: r.CommandSet, CommandID: r.CommandID, Data: []byte{r.CommandID}}.Encode())
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, id := range []byte{0x30, 0x31} {
+		wg.Add(1)
+		go func(id byte) {
+			defer wg.Done()
+			p, err := client.Request(1, 0x10, id, nil, time.Second)
+			if err != nil {
+				t.Errorf("request %02x: %v", id, err)
+				return
+			}
+			if p.CommandID != id || p.Data[0] != id {
+				t.Errorf("request %02x got reply %v", id, p)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	select {
+	case p := <-pushes:
+		if p.Sequence != 99 {
+			t.Errorf("unexpected push %v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber got nothing")
+	}
+}
+
+func TestSACPClientSequence(t *testing.T) {
+	a := NewSACPClient(&recordingConn{})
+	b := NewSACPClient(&recordingConn{})
+	if a.nextSequence() != 1 || a.nextSequence() != 2 || b.nextSequence() != 1 {
+		t.Fatal("sequence numbers must be per connection")
+	}
+}
+
+func TestSACPClientClosed(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewSACPClient(c1)
+	c2.Close()
+
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client didn't notice the closed connection")
+	}
+	if client.Err() == nil {
+		t.Fatal("expected an error after the connection is gone")
+	}
+}
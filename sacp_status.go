@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// Topics the printer keeps pushing once they are subscribed with 0x01/0x00.
+var (
+	sacpTopicHeartbeat = sacpTopic{0x01, 0xa0} // machine state
+	sacpTopicExtruder  = sacpTopic{0x10, 0xa0} // nozzle temperatures
+	sacpTopicBed       = sacpTopic{0x14, 0xa0} // heated bed temperatures
+	sacpTopicLine      = sacpTopic{0xac, 0xa0} // current line of the job
+	sacpTopicTime      = sacpTopic{0xac, 0xa5} // elapsed time of the job
+
+	sacpStatusTopics = []sacpTopic{sacpTopicHeartbeat, sacpTopicExtruder, sacpTopicBed, sacpTopicLine, sacpTopicTime}
+
+	// file name, line count and estimated time of the job, asked from the screen
+	sacpJobInfo = sacpTopic{0xac, 0x1a}
+)
+
+// machine states in the order the heartbeat reports them
+var sacpStates = []string{
+	StateIdle, StateStarting, StateRunning, StatePausing, StatePaused, StateStopping,
+	StateStopped, StateFinishing, StateCompleted, StateRecovering, StateResuming,
+}
+
+const sacpSubscribeInterval = 1000 // ms
+
+// sacpJob collects the pieces of job progress that arrive in separate packets
+type sacpJob struct {
+	totalLines  uint32
+	currentLine uint32
+	estimated   uint32 // seconds
+	elapsed     uint32 // seconds
+}
+
+func (j *sacpJob) apply(st *PrinterStatus) {
+	if j.totalLines > 0 {
+		st.Progress = float64(j.currentLine) / float64(j.totalLines)
+		if st.Progress > 1 {
+			st.Progress = 1
+		}
+	}
+	st.Elapsed = time.Duration(j.elapsed) * time.Second
+	if j.estimated > j.elapsed {
+		st.Remaining = time.Duration(j.estimated-j.elapsed) * time.Second
+	}
+}
+
+// parseSACPStatus updates st from a pushed or replied packet. Every payload
+// starts with a result byte, which must be zero.
+func parseSACPStatus(st *PrinterStatus, job *sacpJob, p *SACP_pack) error {
+	if len(p.Data) < 1 {
+		return errInvalidSize
+	}
+	if p.Data[0] != 0 {
+		return errCommandFailed
+	}
+	r := bytes.NewReader(p.Data[1:])
+
+	switch (sacpTopic{p.CommandSet, p.CommandID}) {
+	case sacpTopicHeartbeat:
+		var state uint8
+		if err := readLE(r, &state); err != nil {
+			return err
+		}
+		st.State = StateUnknown
+		if int(state) < len(sacpStates) {
+			st.State = sacpStates[state]
+		}
+
+	case sacpTopicExtruder:
+		// key, head status, head active, extruder count
+		var head [4]uint8
+		if err := readLE(r, &head); err != nil {
+			return err
+		}
+		st.Nozzles = make([]Temperature, 0, head[3])
+		for i := 0; i < int(head[3]); i++ {
+			var e struct {
+				Index          uint8
+				FilamentStatus uint8
+				FilamentEnable uint8
+				Available      uint8
+				Current        int32 // m°C
+				Target         int32 // m°C
+			}
+			if err := readLE(r, &e); err != nil {
+				return err
+			}
+			st.Nozzles = append(st.Nozzles, Temperature{
+				Current: float64(e.Current) / 1000,
+				Target:  float64(e.Target) / 1000,
+			})
+		}
+
+	case sacpTopicBed:
+		// key, zone count
+		var head [2]uint8
+		if err := readLE(r, &head); err != nil {
+			return err
+		}
+		// the first zone is the one the heated bed reports for
+		for i := 0; i < int(head[1]); i++ {
+			var z struct {
+				Index   uint8
+				Current int32 // m°C
+				Target  int32 // m°C
+			}
+			if err := readLE(r, &z); err != nil {
+				return err
+			}
+			if i == 0 {
+				st.Bed = Temperature{
+					Current: float64(z.Current) / 1000,
+					Target:  float64(z.Target) / 1000,
+				}
+			}
+		}
+
+	case sacpTopicLine:
+		if err := readLE(r, &job.currentLine); err != nil {
+			return err
+		}
+		job.apply(st)
+
+	case sacpTopicTime:
+		if err := readLE(r, &job.elapsed); err != nil {
+			return err
+		}
+		job.apply(st)
+
+	case sacpJobInfo:
+		name, err := readSACPstring(r)
+		if err != nil {
+			return err
+		}
+		st.File = name
+		if err := readLE(r, &job.totalLines); err != nil {
+			return err
+		}
+		if err := readLE(r, &job.estimated); err != nil {
+			return err
+		}
+		job.apply(st)
+	}
+	return nil
+}
+
+func SACP_subscribe(client *SACPClient, topic sacpTopic, interval uint16, timeout time.Duration) error {
+	data := bytes.Buffer{}
+	data.WriteByte(topic.CommandSet)
+	data.WriteByte(topic.CommandID)
+	writeLE(&data, interval)
+	return SACP_send_command(client, 0x01, 0x00, data, timeout)
+}
+
+func SACP_unsubscribe(client *SACPClient, topic sacpTopic, timeout time.Duration) error {
+	data := bytes.Buffer{}
+	data.WriteByte(topic.CommandSet)
+	data.WriteByte(topic.CommandID)
+	return SACP_send_command(client, 0x01, 0x01, data, timeout)
+}
+
+// SACP_get_status subscribes to the status topics, waits for the first report
+// of each and unsubscribes again.
+func SACP_get_status(client *SACPClient, timeout time.Duration) (*PrinterStatus, error) {
+	packets, unsubscribe := client.Subscribe(sacpStatusTopics...)
+	defer unsubscribe()
+
+	for _, t := range sacpStatusTopics {
+		if err := SACP_subscribe(client, t, sacpSubscribeInterval, timeout); err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		for _, t := range sacpStatusTopics {
+			SACP_unsubscribe(client, t, timeout)
+		}
+	}()
+
+	var (
+		st   = &PrinterStatus{State: StateUnknown}
+		job  = &sacpJob{}
+		seen = map[sacpTopic]bool{}
+	)
+
+	// the job info is a plain request to the screen, fails when there's no job
+	if p, err := client.Request(2, sacpJobInfo.CommandSet, sacpJobInfo.CommandID, nil, timeout); err == nil {
+		if parseSACPStatus(st, job, p) == nil {
+			seen[sacpJobInfo] = true
+		}
+	}
+
+	complete := func() bool {
+		if !seen[sacpTopicHeartbeat] || !seen[sacpTopicExtruder] || !seen[sacpTopicBed] {
+			return false
+		}
+		// without a job there's no progress to wait for
+		if !st.IsBusy() && !seen[sacpJobInfo] {
+			return true
+		}
+		return seen[sacpTopicLine] && seen[sacpTopicTime]
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for !complete() {
+		select {
+		case p := <-packets:
+			if err := parseSACPStatus(st, job, p); err == nil {
+				seen[sacpTopic{p.CommandSet, p.CommandID}] = true
+			}
+			continue
+		case <-client.Done():
+			return nil, client.Err()
+		case <-timer.C:
+		}
+		break
+	}
+
+	if !seen[sacpTopicHeartbeat] {
+		return nil, errTimeoutExceeded
+	}
+	return st, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func statusPacket(topic sacpTopic, build func(*bytes.Buffer)) *SACP_pack {
+	data := bytes.Buffer{}
+	data.WriteByte(0) // result
+	build(&data)
+	return &SACP_pack{CommandSet: topic.CommandSet, CommandID: topic.CommandID, Data: data.Bytes()}
+}
+
+func TestParseSACPStatus(t *testing.T) {
+	st := &PrinterStatus{State: StateUnknown}
+	job := &sacpJob{}
+
+	packets := []*SACP_pack{
+		statusPacket(sacpTopicHeartbeat, func(b *bytes.Buffer) { b.WriteByte(2) }),
+		statusPacket(sacpTopicExtruder, func(b *bytes.Buffer) {
+			b.Write([]byte{0, 0, 0, 2})
+			for i, temp := range []int32{210500, 0} {
+				b.Write([]byte{byte(i), 0, 1, 1})
+				writeLE(b, temp)
+				writeLE(b, int32(210000))
+			}
+		}),
+		statusPacket(sacpTopicBed, func(b *bytes.Buffer) {
+			b.Write([]byte{0, 1, 0})
+			writeLE(b, int32(60000))
+			writeLE(b, int32(60000))
+		}),
+		statusPacket(sacpJobInfo, func(b *bytes.Buffer) {
+			writeSACPstring(b, "part.gcode")
+			writeLE(b, uint32(1000))
+			writeLE(b, uint32(600))
+		}),
+		statusPacket(sacpTopicLine, func(b *bytes.Buffer) { writeLE(b, uint32(250)) }),
+		statusPacket(sacpTopicTime, func(b *bytes.Buffer) { writeLE(b, uint32(100)) }),
+	}
+	for _, p := range packets {
+		if err := parseSACPStatus(st, job, p); err != nil {
+			t.Fatalf("parse %02x/%02x: %v", p.CommandSet, p.CommandID, err)
+		}
+	}
+
+	if st.State != StateRunning || !st.IsBusy() {
+		t.Errorf("state = %s", st.State)
+	}
+	if len(st.Nozzles) != 2 || st.Nozzles[0].Current != 210.5 || st.Nozzles[1].Target != 210 {
+		t.Errorf("nozzles = %+v", st.Nozzles)
+	}
+	if st.Bed.Current != 60 || st.Bed.Target != 60 {
+		t.Errorf("bed = %+v", st.Bed)
+	}
+	if st.File != "part.gcode" || st.Progress != 0.25 {
+		t.Errorf("file = %s, progress = %f", st.File, st.Progress)
+	}
+	if st.Elapsed != 100*time.Second || st.Remaining != 500*time.Second {
+		t.Errorf("elapsed = %s, remaining = %s", st.Elapsed, st.Remaining)
+	}
+}
+
+func TestParseSACPStatusTruncated(t *testing.T) {
+	st := &PrinterStatus{}
+	p := statusPacket(sacpTopicExtruder, func(b *bytes.Buffer) { b.Write([]byte{0, 0, 0, 1, 0}) })
+	if err := parseSACPStatus(st, &sacpJob{}, p); err == nil {
+		t.Fatal("expected error for truncated extruder info")
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -84,7 +87,7 @@ func getPackageCountFromStartPacket(b []byte) (uint16, error) {
 func TestPackageCountExactMultiple(t *testing.T) {
 	gcode := make([]byte, SACP_data_len*2)
 	conn := &recordingConn{}
-	_ = SACP_start_upload(conn, "f.gcode", gcode, time.Millisecond)
+	_ = SACP_start_upload(NewSACPClient(conn), "f.gcode", bytes.NewReader(gcode), int64(len(gcode)), md5.Sum(gcode), nil, time.Millisecond)
 	pkgCount, err := getPackageCountFromStartPacket(conn.Bytes())
 	if err != nil {
 		t.Fatalf("decode failed: %v", err)
@@ -97,7 +100,7 @@ func TestPackageCountExactMultiple(t *testing.T) {
 func TestPackageCountNonExactMultiple(t *testing.T) {
 	gcode := make([]byte, SACP_data_len*2+123)
 	conn := &recordingConn{}
-	_ = SACP_start_upload(conn, "f.gcode", gcode, time.Millisecond)
+	_ = SACP_start_upload(NewSACPClient(conn), "f.gcode", bytes.NewReader(gcode), int64(len(gcode)), md5.Sum(gcode), nil, time.Millisecond)
 	pkgCount, err := getPackageCountFromStartPacket(conn.Bytes())
 	if err != nil {
 		t.Fatalf("decode failed: %v", err)
@@ -106,3 +109,117 @@ func TestPackageCountNonExactMultiple(t *testing.T) {
 		t.Fatalf("expected package count 3, got %d", pkgCount)
 	}
 }
+
+func TestStartPrintPacket(t *testing.T) {
+	conn := &recordingConn{}
+	_ = SACP_start_print(NewSACPClient(conn), 0, "f.gcode", "abc", time.Millisecond)
+
+	var p SACP_pack
+	if err := p.Decode(conn.Bytes()); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if p.ReceiverID != 2 || p.CommandSet != 0xb0 || p.CommandID != 0x08 {
+		t.Fatalf("unexpected packet %d %02x/%02x", p.ReceiverID, p.CommandSet, p.CommandID)
+	}
+	want := []byte{0, 7, 0, 'f', '.', 'g', 'c', 'o', 'd', 'e', 3, 0, 'a', 'b', 'c'}
+	if !bytes.Equal(p.Data, want) {
+		t.Fatalf("data = %v, want %v", p.Data, want)
+	}
+}
+
+// fragmentReader returns the stream in pieces of the given size
+type fragmentReader struct {
+	data []byte
+	size int
+}
+
+func (f *fragmentReader) Read(b []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, io.EOF
+	}
+	n := f.size
+	if n > len(b) {
+		n = len(b)
+	}
+	if n > len(f.data) {
+		n = len(f.data)
+	}
+	copy(b, f.data[:n])
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestSACPDecoder(t *testing.T) {
+	frame := func(seq uint16, data ...byte) []byte {
+		return SACP_pack{ReceiverID: 2, SenderID: 1, Sequence: seq, CommandSet: 0xb0, CommandID: 0x01, Data: data}.Encode()
+	}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	badHead := frame(7, 1, 2, 3)
+	badHead[6] ^= 0xff
+	badData := frame(8, 1, 2, 3)
+	badData[len(badData)-1] ^= 0xff
+	badVer := frame(9)
+	badVer[4] = 0x02
+	badVer[6] = (&SACP_pack{}).headChksum(badVer[:6])
+	large := frame(10, bytes.Repeat([]byte{0x55, 0xaa}, SACP_data_len/2)...)
+
+	tests := []struct {
+		name   string
+		stream []byte
+		// sequence of each decoded packet, or the error expected in its place
+		want []interface{}
+	}{
+		{"single", frame(1, 0xaa, 0x55), []interface{}{uint16(1), io.EOF}},
+		{"back to back", join(frame(1), frame(2, 9), frame(3)), []interface{}{uint16(1), uint16(2), uint16(3), io.EOF}},
+		{"large", large, []interface{}{uint16(10), io.EOF}},
+		{"garbage before", join([]byte{0, 0x55, 0xaa, 0xaa, 1}, frame(4)), []interface{}{uint16(4), io.EOF}},
+		{"bad header checksum", join(badHead, frame(5)), []interface{}{errInvalidHeadChksum, uint16(5), io.EOF}},
+		{"header inside bad header", join([]byte{0xaa, 0x55, 0x08}, frame(6)), []interface{}{errInvalidHeadChksum, uint16(6), io.EOF}},
+		{"bad data checksum", join(badData, frame(6)), []interface{}{errInvalidChksum, uint16(6), io.EOF}},
+		{"bad version", join(badVer, frame(7)), []interface{}{errInvalidSACPVer, uint16(7), io.EOF}},
+		{"truncated", frame(1, 1, 2, 3)[:12], []interface{}{io.ErrUnexpectedEOF}},
+		{"garbage only", []byte{1, 2, 3, 0xaa}, []interface{}{io.EOF}},
+	}
+
+	readers := map[string]func([]byte) io.Reader{
+		"whole":        func(b []byte) io.Reader { return bytes.NewReader(b) },
+		"byte by byte": func(b []byte) io.Reader { return iotest.OneByteReader(bytes.NewReader(b)) },
+		"fragmented":   func(b []byte) io.Reader { return &fragmentReader{data: b, size: 5} },
+		"half":         func(b []byte) io.Reader { return iotest.HalfReader(bytes.NewReader(b)) },
+	}
+
+	for _, tt := range tests {
+		for rname, reader := range readers {
+			dec := NewSACPDecoder(reader(tt.stream))
+			for i, want := range tt.want {
+				var p SACP_pack
+				err := dec.Decode(&p)
+				switch w := want.(type) {
+				case uint16:
+					if err != nil {
+						t.Fatalf("%s/%s #%d: unexpected error %v", tt.name, rname, i, err)
+					}
+					if p.Sequence != w {
+						t.Fatalf("%s/%s #%d: sequence %d, want %d", tt.name, rname, i, p.Sequence, w)
+					}
+				case error:
+					if !errors.Is(err, w) {
+						t.Fatalf("%s/%s #%d: error %v, want %v", tt.name, rname, i, err, w)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSACPDecodeHeaderChecksumFirst(t *testing.T) {
+	encoded := SACP_pack{Sequence: 1, Data: []byte{1, 2, 3}}.Encode()
+	// a corrupted length must be reported as a header problem
+	encoded[2] = 0xff
+
+	var got SACP_pack
+	if err := got.Decode(encoded); !errors.Is(err, errInvalidHeadChksum) {
+		t.Fatalf("expected errInvalidHeadChksum, got %v", err)
+	}
+}
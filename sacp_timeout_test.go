@@ -19,7 +19,7 @@ func TestSACPSendCommandTimeout(t *testing.T) {
 	go io.Copy(io.Discard, c2)
 
 	start := time.Now()
-	err := SACP_send_command(c1, 0x10, 0x02, bytes.Buffer{}, 200*time.Millisecond)
+	err := SACP_send_command(NewSACPClient(c1), 0x10, 0x02, bytes.Buffer{}, 200*time.Millisecond)
 	elapsed := time.Since(start)
 
 	if !errors.Is(err, errTimeoutExceeded) {
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/macdylan/SMFix/fix"
+)
+
+type smfixPass struct {
+	Name    string
+	Usage   string
+	Default bool
+	Fn      fix.GcodeModifier // nil when postProcess does it while reading
+}
+
+// SMFix passes in the order they run
+var smfixPasses = []smfixPass{
+	{"trim", "drop G4 S0 (dwell for nothing) lines", true, nil},
+	{"shutoff", "shut off nozzles that are no longer used", true, fix.GcodeFixShutoff},
+	{"preheat", "pre-heat the next nozzle before a tool change, needs M73 in the gcode", false, fix.GcodeFixPreheat},
+	{"replacetool", "map tools above T1 to T0/T1", true, fix.GcodeReplaceToolNum},
+	{"reinforcetower", "extrude more on the prime tower so it does not collapse", false, fix.GcodeReinforceTower},
+	{"orcatoolunload", "remove M104 without a tool from OrcaSlicer tool changes", true, fix.GcodeFixOrcaToolUnload},
+}
+
+/*
+FixOptions turn single SMFix passes on or off by name, passes that are not
+listed keep their default. In hosts.yaml they look like
+
+	fix:
+	  preheat: true
+	  shutoff: false
+*/
+type FixOptions map[string]bool
+
+var (
+	// FixDefaults come from the command line and apply to every upload
+	FixDefaults = FixOptions{}
+
+	// SMFix keeps what it learns about the file in package globals
+	smfixMu sync.Mutex
+
+	// SMFixMaxSize is the largest file SMFix runs on. The passes need the
+	// whole program parsed in memory, about 20 times the size of the file;
+	// larger files are sent as they are.
+	SMFixMaxSize int64 = 64 << 20
+
+	errFixTooLarge = errors.New("too large for SMFix")
+)
+
+func findPass(name string) *smfixPass {
+	for i := range smfixPasses {
+		if smfixPasses[i].Name == name {
+			return &smfixPasses[i]
+		}
+	}
+	return nil
+}
+
+// Enabled tells whether the pass runs
+func (o FixOptions) Enabled(name string) bool {
+	if on, ok := o[name]; ok {
+		return on
+	}
+	if p := findPass(name); p != nil {
+		return p.Default
+	}
+	return false
+}
+
+// Merge returns o with the settings of over on top
+func (o FixOptions) Merge(over FixOptions) FixOptions {
+	out := make(FixOptions, len(o)+len(over))
+	for k, v := range o {
+		out[k] = v
+	}
+	for k, v := range over {
+		out[k] = v
+	}
+	return out
+}
+
+// String lists the settings as command line flags
+func (o FixOptions) String() string {
+	msg := []string{}
+	for _, p := range smfixPasses {
+		if on, ok := o[p.Name]; ok {
+			if on {
+				msg = append(msg, "-"+p.Name)
+			} else {
+				msg = append(msg, "-no"+p.Name)
+			}
+		}
+	}
+	return strings.Join(msg, " ")
+}
+
+/*
+fixOptionsFromApiKey reads the tokens a slicer can put in the OctoPrint API
+key, e.g. "preheat-noshutoff". A pass name turns the pass on, the name with
+"no" in front turns it off.
+*/
+func fixOptionsFromApiKey(str string) FixOptions {
+	o := FixOptions{}
+	for _, p := range smfixPasses {
+		for i := 0; ; {
+			n := strings.Index(str[i:], p.Name)
+			if n < 0 {
+				break
+			}
+			i += n
+			o[p.Name] = !strings.HasSuffix(str[:i], "no")
+			i += len(p.Name)
+		}
+	}
+	return o
+}
+
+// fixFlag is a boolean flag for one pass, set only when it is given
+type fixFlag struct {
+	name string
+	on   bool
+}
+
+func (f *fixFlag) IsBoolFlag() bool { return true }
+
+func (f *fixFlag) String() string {
+	if f == nil || f.name == "" {
+		return "false"
+	}
+	return fmt.Sprint(FixDefaults.Enabled(f.name) == f.on)
+}
+
+func (f *fixFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	FixDefaults[f.name] = v == f.on
+	return nil
+}
+
+// loadFixEnv reads SMFIX_<PASS>=true/false and SMFIX_MAX_SIZE in MB,
+// NOTRIM, NOSHUTOFF and NOREPLACETOOL still work.
+func loadFixEnv() {
+	if mb := parseIntEnv("SMFIX_MAX_SIZE", 0); mb > 0 {
+		SMFixMaxSize = int64(mb) << 20
+	}
+	for _, p := range smfixPasses {
+		if v, ok := os.LookupEnv("SMFIX_" + strings.ToUpper(p.Name)); ok {
+			if on, err := strconv.ParseBool(v); err == nil {
+				FixDefaults[p.Name] = on
+			}
+		}
+		if parseBoolEnv("NO"+strings.ToUpper(p.Name), false) {
+			FixDefaults[p.Name] = false
+		}
+	}
+}
+
+// registerFixFlags adds -<pass> for every SMFix pass, and -no<pass> for the
+// ones that run by default.
+func registerFixFlags(fs *flag.FlagSet) {
+	for _, p := range smfixPasses {
+		fs.Var(&fixFlag{p.Name, true}, p.Name, "SMFix: "+p.Usage)
+		if p.Default {
+			fs.Var(&fixFlag{p.Name, false}, "no"+p.Name, "SMFix: turn off -"+p.Name)
+		}
+	}
+}
+
+// fixDefaultsUsage sums up which passes run without options
+func fixDefaultsUsage() string {
+	on, off := []string{}, []string{}
+	for _, p := range smfixPasses {
+		if p.Default {
+			on = append(on, p.Name)
+		} else {
+			off = append(off, p.Name)
+		}
+	}
+	return fmt.Sprintf("SMFix passes on by default: %s; off by default: %s", strings.Join(on, ", "), strings.Join(off, ", "))
+}
+
+/*
+fixFiles runs SMFix on the files without uploading them. The result goes to
+stdout when output is empty or "-", into output when it is a directory, or
+else to the file output, which takes a single input.
+*/
+func fixFiles(files []string, output string, opts FixOptions) error {
+	if len(files) == 0 {
+		return errNoInputFiles
+	}
+
+	intoDir := false
+	if output != "" && output != "-" {
+		if st, err := os.Stat(output); err == nil && st.IsDir() {
+			intoDir = true
+		}
+	}
+	if !intoDir && len(files) > 1 {
+		return fmt.Errorf("%w: -fix-only writes several files only into a directory", errUsage)
+	}
+	if !intoDir && (output == "" || output == "-") && jsonOutput() {
+		return fmt.Errorf("%w: -output json needs -fix-output for the fixed files", errUsage)
+	}
+
+	for _, file := range files {
+		var w io.Writer = os.Stdout
+		if intoDir {
+			f, err := os.Create(filepath.Join(output, filepath.Base(file)))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		} else if output != "" && output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := fixFile(file, w, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fixFile(file string, w io.Writer, opts FixOptions) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errFileInvalid, err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("%w: %s", errFileInvalid, err)
+	}
+
+	p := NewPayload(f, st.Name(), st.Size(), false)
+	p.Fix = opts
+	c, err := p.Open(NoFix)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err = io.Copy(w, c.Reader()); err != nil {
+		return err
+	}
+	emit(Event{Event: "fixed", File: file, Bytes: c.Size, MD5: c.MD5Hex()})
+	return nil
+}
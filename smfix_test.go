@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// two tools on a J1, with T3 standing in for the second one
+var fixSample = strings.Join([]string{
+	"; generated by PrusaSlicer 2.6.0",
+	"G28",
+	"T0",
+	"M104 S200 T0",
+	"G1 X1 E1",
+	"T3",
+	"M104 S210 T3",
+	"G1 X2 E1",
+	"; filament used [mm] = 10.0, 20.0",
+	"; filament_type = PLA;PETG",
+	"; nozzle_diameter = 0.4,0.4",
+	"; first_layer_temperature = 200,210",
+	"; printer_model = Snapmaker J1",
+}, "\n") + "\n" + strings.Repeat("G1 X3\n", 20)
+
+func TestFixOptionsFromApiKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want FixOptions
+	}{
+		{"0123456789abcdef", FixOptions{}},
+		{"notrim", FixOptions{"trim": false}},
+		{"noshutoff-noreplacetool", FixOptions{"shutoff": false, "replacetool": false}},
+		{"preheat-reinforcetower-noorcatoolunload", FixOptions{"preheat": true, "reinforcetower": true, "orcatoolunload": false}},
+	}
+	for _, tt := range tests {
+		if got := fixOptionsFromApiKey(tt.key); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("fixOptionsFromApiKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+
+	merged := FixOptions{"trim": false, "preheat": true}.Merge(FixOptions{"preheat": false})
+	if merged.Enabled("trim") || merged.Enabled("preheat") || !merged.Enabled("shutoff") {
+		t.Errorf("Merge = %v", merged)
+	}
+	if got := merged.String(); got != "-notrim -nopreheat" {
+		t.Errorf("String = %q", got)
+	}
+}
+
+func TestFixFlags(t *testing.T) {
+	orig := FixDefaults
+	FixDefaults = FixOptions{}
+	t.Cleanup(func() { FixDefaults = orig })
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFixFlags(fs)
+	if err := fs.Parse([]string{"-preheat", "-noshutoff", "-trim=false"}); err != nil {
+		t.Fatal(err)
+	}
+	want := FixOptions{"preheat": true, "shutoff": false, "trim": false}
+	if !reflect.DeepEqual(FixDefaults, want) {
+		t.Errorf("FixDefaults = %v, want %v", FixDefaults, want)
+	}
+	if fs.Lookup("nopreheat") != nil {
+		t.Error("-nopreheat registered for a pass that is off by default")
+	}
+}
+
+func TestFixFiles(t *testing.T) {
+	origNoFix := NoFix
+	NoFix = false
+	t.Cleanup(func() { NoFix = origNoFix })
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.gcode")
+	if err := os.WriteFile(in, []byte(fixSample), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out.gcode")
+	if err := fixFiles([]string{in}, out, FixOptions{"shutoff": false}); err != nil {
+		t.Fatalf("fixFiles: %v", err)
+	}
+	b, _ := os.ReadFile(out)
+	if !strings.Contains(string(b), "\nT1\n") || strings.Contains(string(b), "Shutoff") {
+		t.Errorf("output:\n%s", b)
+	}
+	if err := fixFiles([]string{in, in}, out, nil); err == nil {
+		t.Error("several files into one output file")
+	}
+}
+
+func TestFixOptionsConcurrentUploads(t *testing.T) {
+	tests := []struct {
+		opts          FixOptions
+		shutoff, tool bool
+	}{
+		{FixOptions{}, true, true},
+		{FixOptions{"shutoff": false}, false, true},
+		{FixOptions{"replacetool": false}, true, false},
+		{FixOptions{"shutoff": false, "replacetool": false}, false, false},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8*len(tests); i++ {
+		tt := tests[i%len(tests)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := NewPayload(onlyReader{strings.NewReader(fixSample)}, "part.gcode", int64(len(fixSample)), false)
+			p.Fix = tt.opts
+			c, err := p.Open(false)
+			if err != nil {
+				t.Errorf("Open: %v", err)
+				return
+			}
+			defer c.Close()
+			b, _ := io.ReadAll(c.Reader())
+			got := string(b)
+
+			if strings.Contains(got, "(Fixed: Shutoff T0)") != tt.shutoff {
+				t.Errorf("%v: shutoff applied = %v", tt.opts, !tt.shutoff)
+			}
+			if strings.Contains(got, "\nT1\n") != tt.tool {
+				t.Errorf("%v: tool replaced = %v", tt.opts, !tt.tool)
+			}
+		}()
+	}
+	wg.Wait()
+}
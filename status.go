@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gosuri/uilive"
+)
+
+const (
+	StateUnknown    = "UNKNOWN"
+	StateIdle       = "IDLE"
+	StateStarting   = "STARTING"
+	StateRunning    = "RUNNING"
+	StatePausing    = "PAUSING"
+	StatePaused     = "PAUSED"
+	StateStopping   = "STOPPING"
+	StateStopped    = "STOPPED"
+	StateFinishing  = "FINISHING"
+	StateCompleted  = "COMPLETED"
+	StateRecovering = "RECOVERING"
+	StateResuming   = "RESUMING"
+)
+
+type Temperature struct {
+	Current float64 `json:"current"`
+	Target  float64 `json:"target"`
+}
+
+// PrinterStatus is what a printer is doing right now, as reported by
+// either protocol.
+type PrinterStatus struct {
+	State     string        `json:"state"`
+	Nozzles   []Temperature `json:"nozzles"`
+	Bed       Temperature   `json:"bed"`
+	File      string        `json:"file"`
+	Progress  float64       `json:"progress"`  // 0 to 1
+	Elapsed   time.Duration `json:"elapsed"`   // seconds in JSON
+	Remaining time.Duration `json:"remaining"` // seconds in JSON
+}
+
+// printerStatusJSON has the times in seconds, like the duration of the events
+type printerStatusJSON struct {
+	*printerStatusFields
+	Elapsed   float64 `json:"elapsed"`
+	Remaining float64 `json:"remaining"`
+}
+
+type printerStatusFields PrinterStatus
+
+func (s PrinterStatus) MarshalJSON() ([]byte, error) {
+	fields := printerStatusFields(s)
+	return json.Marshal(printerStatusJSON{&fields, s.Elapsed.Seconds(), s.Remaining.Seconds()})
+}
+
+func (s *PrinterStatus) UnmarshalJSON(b []byte) error {
+	v := printerStatusJSON{printerStatusFields: (*printerStatusFields)(s)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	s.Elapsed = time.Duration(v.Elapsed * float64(time.Second))
+	s.Remaining = time.Duration(v.Remaining * float64(time.Second))
+	return nil
+}
+
+// IsBusy reports whether the printer is in the middle of a job
+func (s *PrinterStatus) IsBusy() bool {
+	switch s.State {
+	case StateIdle, StateCompleted, StateStopped, StateUnknown:
+		return false
+	}
+	return true
+}
+
+func (s *PrinterStatus) String() string {
+	buf := bytes.Buffer{}
+	buf.WriteString("state: " + s.State + "\n")
+	for i, n := range s.Nozzles {
+		buf.WriteString(fmt.Sprintf("nozzle %d: %.1f / %.1f °C\n", i+1, n.Current, n.Target))
+	}
+	buf.WriteString(fmt.Sprintf("bed: %.1f / %.1f °C\n", s.Bed.Current, s.Bed.Target))
+	if s.File != "" {
+		buf.WriteString("file: " + s.File + "\n")
+		buf.WriteString(fmt.Sprintf("progress: %.1f%%\n", s.Progress*100))
+		buf.WriteString(fmt.Sprintf("elapsed: %s, remaining: %s\n", s.Elapsed.Round(time.Second), s.Remaining.Round(time.Second)))
+	}
+	return buf.String()
+}
+
+// printStatus prints the printer status once, or keeps refreshing it in place
+// every interval when interval > 0.
+func printStatus(printer *Printer, interval time.Duration) error {
+	st, err := Connector.Status(printer)
+	if err != nil {
+		return err
+	}
+	if jsonOutput() {
+		for {
+			emit(Event{Event: "status", Printer: printer, Status: st})
+			if interval <= 0 {
+				return nil
+			}
+			<-time.After(interval)
+			if st, err = Connector.Status(printer); err != nil {
+				return err
+			}
+		}
+	}
+	if interval <= 0 {
+		fmt.Print(st.String())
+		return nil
+	}
+
+	w := uilive.New()
+	w.Out = os.Stdout
+	w.Start()
+	defer w.Stop()
+	for {
+		fmt.Fprint(w, st.String())
+		<-time.After(interval)
+		if st, err = Connector.Status(printer); err != nil {
+			return err
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 	"io"
 	"os"
@@ -37,25 +36,25 @@ func normalizedFilename(filename string) string {
 }
 
 /*
-func postProcessFile(file_path string) (out []byte, err error) {
-	var r *os.File
-	if r, err = os.Open(file_path); err != nil {
-		return
-	}
-	defer r.Close()
-	return postProcess(r)
-}
+postProcess runs SMFix on the gcode from r and writes the result to w. The
+modifiers and the header work on the whole program, so the parsed blocks are
+kept in memory, but the output is streamed. Reading stops with errFixTooLarge
+after SMFixMaxSize bytes, which bounds that memory.
 */
-
-func postProcess(r io.Reader) (out []byte, err error) {
+func postProcess(r io.Reader, w io.Writer, opts FixOptions) (err error) {
 	var (
 		isFixed = false
+		trim    = opts.Enabled("trim")
 		nl      = []byte("\n")
 		headers = [][]byte{}
 		gcodes  = []*fix.GcodeBlock{}
-		sc      = bufio.NewScanner(r)
+		limited = &io.LimitedReader{R: r, N: SMFixMaxSize + 1}
+		sc      = bufio.NewScanner(limited)
 	)
 	for sc.Scan() {
+		if limited.N <= 0 {
+			return errFixTooLarge
+		}
 		line := sc.Text()
 		if !isFixed && strings.HasPrefix(line, "; Postprocessed by smfix") {
 			isFixed = true
@@ -63,7 +62,9 @@ func postProcess(r io.Reader) (out []byte, err error) {
 
 		g, err := fix.ParseGcodeBlock(line)
 		if err == nil {
-			if g.Is("G4") {
+			// trim: SMFix no longer exports GcodeTrimLines, and the empty
+			// lines it dropped never make it past the parser
+			if trim && g.Is("G4") {
 				var s int
 				if err := g.GetParam('S', &s); err == nil && s == 0 {
 					continue
@@ -73,45 +74,37 @@ func postProcess(r io.Reader) (out []byte, err error) {
 			continue
 		}
 		if err != fix.ErrEmptyString {
-			return nil, err
+			return err
 		}
 	}
 
 	if err = sc.Err(); err != nil {
-		return nil, err
+		return err
+	}
+	if limited.N <= 0 {
+		return errFixTooLarge
 	}
 
 	if !isFixed {
 		funcs := []fix.GcodeModifier{}
-
-		if !noTrim {
-			// funcs = append(funcs, fix.GcodeTrimLines)
-		}
-		if !noShutoff {
-			funcs = append(funcs, fix.GcodeFixShutoff)
-		}
-		// if !noPreheat {
-		// 	funcs = append(funcs, fix.GcodeFixPreheat)
-		// }
-		if !noReplaceTool {
-			funcs = append(funcs, fix.GcodeReplaceToolNum)
+		for _, p := range smfixPasses {
+			if p.Fn != nil && opts.Enabled(p.Name) {
+				funcs = append(funcs, p.Fn)
+			}
 		}
-		// if !noReinforceTower {
-		// 	funcs = append(funcs, fix.GcodeReinforceTower)
-		// }
-
-		funcs = append(funcs, fix.GcodeFixOrcaToolUnload)
 
+		smfixMu.Lock()
 		for _, fn := range funcs {
 			gcodes = fn(gcodes)
 		}
-
-		if headers, err = fix.ExtractHeader(gcodes); err != nil {
-			return nil, err
+		headers, err = fix.ExtractHeader(gcodes)
+		smfixMu.Unlock()
+		if err != nil {
+			return err
 		}
 	}
 
-	var buf bytes.Buffer
+	buf := bufio.NewWriter(w)
 
 	for _, h := range headers {
 		buf.Write(h)
@@ -122,7 +115,7 @@ func postProcess(r io.Reader) (out []byte, err error) {
 		buf.WriteString(gcode.String())
 		buf.Write(nl)
 	}
-	return buf.Bytes(), nil
+	return buf.Flush()
 }
 
 func shouldBeFix(fpath string) bool {
@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"io"
+	"runtime"
 	"testing"
 )
 
@@ -11,8 +13,44 @@ func (e errReader) Read(p []byte) (int, error) { return 0, e.err }
 
 func TestPostProcessPropagatesScannerError(t *testing.T) {
 	testErr := errors.New("boom")
-	_, err := postProcess(errReader{err: testErr})
+	err := postProcess(errReader{err: testErr}, io.Discard, FixOptions{})
 	if err != testErr {
 		t.Fatalf("expected %v, got %v", testErr, err)
 	}
 }
+
+// gcodeReader makes up n bytes of gcode without holding them
+type gcodeReader struct{ n, off int64 }
+
+func (g *gcodeReader) Read(p []byte) (int, error) {
+	const line = "G1 X10.123 Y20.456 E0.01234 F1200\n"
+	if g.n <= 0 {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && g.n > 0 {
+		p[n] = line[g.off%int64(len(line))]
+		n++
+		g.n--
+		g.off++
+	}
+	return n, nil
+}
+
+func TestPostProcessBoundsMemory(t *testing.T) {
+	orig := SMFixMaxSize
+	SMFixMaxSize = 1 << 20
+	defer func() { SMFixMaxSize = orig }()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	err := postProcess(&gcodeReader{n: 256 << 20}, io.Discard, FixOptions{})
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, errFixTooLarge) {
+		t.Fatalf("256 MB of gcode: %v", err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<20 {
+		t.Errorf("allocated %s for a cap of %s", humanReadableSize(int64(alloc)), humanReadableSize(SMFixMaxSize))
+	}
+}
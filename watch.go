@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// how often the watched directories are scanned
+	WatchInterval = 2 * time.Second
+	// how long a file must stay unchanged before it is uploaded
+	WatchSettle = 5 * time.Second
+)
+
+const (
+	watchDoneDir   = "done"
+	watchFailedDir = "failed"
+)
+
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // when size and modTime were last seen to change
+	handled bool      // uploaded but could not be moved away
+}
+
+/*
+hotFolder uploads the files that show up in Dir to Printer. Uploaded files
+are moved to Dir/done, failed ones to Dir/failed next to a .log file with the
+error. Sub-directories and hidden files are left alone.
+*/
+type hotFolder struct {
+	Dir     string
+	Printer *Printer
+
+	files map[string]*watchedFile
+}
+
+func newHotFolder(dir string, printer *Printer) *hotFolder {
+	return &hotFolder{
+		Dir:     dir,
+		Printer: printer,
+		files:   map[string]*watchedFile{},
+	}
+}
+
+// scan uploads the files that have not changed for settle, seen at now
+func (h *hotFolder) scan(now time.Time, settle time.Duration) {
+	entries, err := os.ReadDir(h.Dir)
+	if err != nil {
+		log.Printf("Watch %s: %s", h.Dir, err)
+		return
+	}
+
+	present := map[string]bool{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if _, ok := SmFixExtensions[strings.ToLower(filepath.Ext(name))]; !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		present[name] = true
+
+		f, ok := h.files[name]
+		if !ok || f.size != info.Size() || !f.modTime.Equal(info.ModTime()) {
+			// new, or still being written
+			h.files[name] = &watchedFile{size: info.Size(), modTime: info.ModTime(), since: now}
+			continue
+		}
+		if f.handled || now.Sub(f.since) < settle {
+			continue
+		}
+		if h.process(name) {
+			delete(h.files, name)
+		} else {
+			f.handled = true
+		}
+	}
+
+	for name := range h.files {
+		if !present[name] {
+			delete(h.files, name)
+		}
+	}
+}
+
+// process uploads the file and moves it out of the way, it returns false
+// when the file could not be moved
+func (h *hotFolder) process(name string) bool {
+	path := filepath.Join(h.Dir, name)
+	err := h.upload(path)
+	if err == nil {
+		dst, merr := moveInto(path, filepath.Join(h.Dir, watchDoneDir))
+		if merr != nil {
+			log.Printf("Watch %s: %s", h.Dir, merr)
+			return false
+		}
+		if Debug {
+			log.Printf("-- Moved %s to %s", name, dst)
+		}
+		return true
+	}
+
+	code, _ := errorCode(err)
+	log.Printf("Watch %s: %s", h.Dir, err)
+	emit(Event{Event: "failed", Printer: h.Printer, File: name, Code: code, Error: err.Error()})
+
+	dst, merr := moveInto(path, filepath.Join(h.Dir, watchFailedDir))
+	if merr != nil {
+		log.Printf("Watch %s: %s", h.Dir, merr)
+		return false
+	}
+	report := fmt.Sprintf("time: %s\nprinter: %s\nerror: %s\n", time.Now().Format(time.RFC3339), h.Printer.String(), err)
+	if werr := os.WriteFile(dst+".log", []byte(report), 0644); werr != nil {
+		log.Printf("Watch %s: %s", h.Dir, werr)
+	}
+	return true
+}
+
+func (h *hotFolder) upload(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errFileInvalid, err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("%w: %s", errFileInvalid, err)
+	}
+	return uploadPayload(h.Printer, NewPayload(f, st.Name(), st.Size(), StartPrint))
+}
+
+// moveInto moves the file into dir, a file of the same name that is already
+// there gets a time stamp added to the new one
+func moveInto(path, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := filepath.Base(path)
+	dst := filepath.Join(dir, name)
+	if _, err := os.Stat(dst); err == nil {
+		ext := filepath.Ext(name)
+		dst = filepath.Join(dir, strings.TrimSuffix(name, ext)+time.Now().Format("-20060102-150405")+ext)
+	}
+	return dst, os.Rename(path, dst)
+}
+
+// parseWatchDir splits "dir=host", host is empty without "="
+func parseWatchDir(arg string) (dir, host string) {
+	if i := strings.LastIndex(arg, "="); i > 0 {
+		return arg[:i], arg[i+1:]
+	}
+	return arg, ""
+}
+
+/*
+watchFolders keeps uploading what shows up in the directories until the
+program is interrupted. Every argument is a directory, optionally followed by
+"=" and the printer its files go to; directories without a printer use -host.
+*/
+func watchFolders(args []string) error {
+	ls := NewLocalStorage(KnownHosts)
+	defer ls.Save()
+
+	folders := []*hotFolder{}
+	for _, arg := range args {
+		dir, host := parseWatchDir(arg)
+		if host == "" {
+			host = Host
+		}
+		switch hosts := ls.Expand(host); len(hosts) {
+		case 0:
+		case 1:
+			host = hosts[0]
+		default:
+			return fmt.Errorf("%w: %s", errSinglePrinter, dir)
+		}
+		if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+			return fmt.Errorf("%w: %s is not a directory", errUsage, dir)
+		}
+		printer, err := findPrinter(ls, host)
+		if err != nil {
+			return err
+		}
+		folders = append(folders, newHotFolder(dir, printer))
+		log.Printf("Watching %s for %s", dir, printer.String())
+		emit(Event{Event: "watching", Printer: printer, File: dir})
+	}
+	ls.Save()
+	defer startDiscoveryService(ls, RediscoverInterval).Close()
+
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer signal.Stop(sc)
+
+	ticker := time.NewTicker(WatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case sig := <-sc:
+			log.Printf("Received signal: %s", sig)
+			for _, h := range folders {
+				// keep the tokens the printers handed out
+				ls.Add(h.Printer)
+			}
+			return nil
+		case now := <-ticker.C:
+			for _, h := range folders {
+				h.scan(now, WatchSettle)
+			}
+		}
+	}
+}
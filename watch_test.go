@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHotFolder(t *testing.T) {
+	fp, printer := startFakePrinter(t, true)
+	dir := t.TempDir()
+	content := []byte("G28\nG1 X10 Y10\n")
+	write := func(name string, b []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("part.gcode", content)
+	write("notes.txt", []byte("not gcode"))
+
+	h := newHotFolder(dir, printer)
+	now := time.Now()
+	h.scan(now, time.Second)
+	if len(fp.Files()) != 0 {
+		t.Fatal("uploaded a file before it settled")
+	}
+
+	// still being written
+	write("part.gcode", append(content, "G1 X20\n"...))
+	h.scan(now.Add(2*time.Second), time.Second)
+	if len(fp.Files()) != 0 {
+		t.Fatal("uploaded a file that changed")
+	}
+
+	h.scan(now.Add(4*time.Second), time.Second)
+	got, ok := fp.File("part.gcode")
+	if !ok || !bytes.Equal(got, append(content, "G1 X20\n"...)) {
+		t.Fatalf("printer got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, watchDoneDir, "part.gcode")); err != nil {
+		t.Errorf("not moved to done: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("other files are left alone: %v", err)
+	}
+
+	// the printer goes away
+	fp.Close()
+	write("next.gcode", content)
+	h.scan(now.Add(5*time.Second), time.Second)
+	h.scan(now.Add(7*time.Second), time.Second)
+	failed := filepath.Join(dir, watchFailedDir, "next.gcode")
+	if _, err := os.Stat(failed); err != nil {
+		t.Fatalf("not moved to failed: %v", err)
+	}
+	report, err := os.ReadFile(failed + ".log")
+	if err != nil || !strings.Contains(string(report), "not available") {
+		t.Errorf("error log = %q, %v", report, err)
+	}
+}
+
+func TestMoveIntoKeepsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	done := filepath.Join(dir, watchDoneDir)
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(dir, "a.gcode")
+		if err := os.WriteFile(path, []byte{byte(i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := moveInto(path, done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, _ := os.ReadDir(done)
+	if len(entries) != 2 {
+		t.Errorf("done has %d files, want 2", len(entries))
+	}
+}
+
+func TestParseWatchDir(t *testing.T) {
+	tests := []struct{ arg, dir, host string }{
+		{"./a350", "./a350", ""},
+		{"./a350=A350-3DP", "./a350", "A350-3DP"},
+		{"/nas/j1=192.168.1.19", "/nas/j1", "192.168.1.19"},
+	}
+	for _, tt := range tests {
+		if dir, host := parseWatchDir(tt.arg); dir != tt.dir || host != tt.host {
+			t.Errorf("parseWatchDir(%q) = %q, %q", tt.arg, dir, host)
+		}
+	}
+}